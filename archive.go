@@ -0,0 +1,229 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory the archive given with -archive is unpacked into, or "" if none
+var archiveDir string
+
+// Whether the unpacked archive is packed again on exit, after a backup
+var archiveWrite bool
+
+// Commands which modify local storage in ways not written back to an archive
+var archiveUnsupported = map[string]bool{"sync": true, "watch": true, "forget": true, "reindex": true, "dedup": true}
+
+// Checks that the given commands support -archive, and whether they
+// modify local storage so the archive needs to be written on exit
+func checkArchiveCommands(cmds []string) error {
+	for _, cmd := range cmds {
+		if archiveUnsupported[cmd] {
+			return fmt.Errorf("%s does not support -archive, unpack the archive with tar and use -l", cmd)
+		}
+		if cmd == "backup" {
+			archiveWrite = true
+		}
+	}
+	return nil
+}
+
+// Returns the name of local storage for display, the archive given with -archive
+// or the object storage given with -store if any
+func localStorageName() string {
+	if archiveFile != "" {
+		return archiveFile
+	}
+	if storeURL != "" {
+		return storeURL
+	}
+	return localStoragePath
+}
+
+// Whether the archive is gzip compressed, as indicated by its file name
+func isGzipArchive(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// Unpacks the archive given with -archive into a temporary directory next to it,
+// and uses that as local storage path. A missing archive yields an empty directory.
+func openArchive() error {
+	dir, err := os.MkdirTemp(filepath.Dir(archiveFile), ".go-imap-backup-")
+	if err != nil {
+		return err
+	}
+	archiveDir, localStoragePath = dir, dir
+
+	file, err := os.Open(archiveFile)
+	if os.IsNotExist(err) && archiveWrite {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if isGzipArchive(archiveFile) {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", archiveFile, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", archiveFile, err)
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("%s: invalid entry %q", archiveFile, hdr.Name)
+		}
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+				return err
+			}
+			if err := extractFile(name, tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported entry %q", archiveFile, hdr.Name)
+		}
+	}
+}
+
+// Writes the contents of an archive entry read from r to the named file
+func extractFile(name string, r io.Reader) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Packs the unpacked archive into the file given with -archive if a backup ran,
+// replacing it atomically, and removes the temporary directory
+func closeArchive() error {
+	if archiveDir == "" {
+		return nil
+	}
+	defer func() {
+		os.RemoveAll(archiveDir)
+		archiveDir = ""
+	}()
+	if !archiveWrite {
+		return nil
+	}
+	if entries, err := os.ReadDir(archiveDir); err != nil || len(entries) == 0 {
+		return err // nothing backed up, e.g. as login failed
+	}
+
+	tmpName := archiveFile + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName) // fails harmlessly after the rename
+	if err := writeArchive(file, archiveDir); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, archiveFile)
+}
+
+// Writes all directories and files below dir to w as a tar stream,
+// gzip compressed if the archive name asks for it
+func writeArchive(w io.Writer, dir string) error {
+	var zw *gzip.Writer
+	if isGzipArchive(archiveFile) {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// Authentication modes selectable with -auth
+const (
+	authPlain   = "plain"
+	authXoauth2 = "xoauth2"
+)
+
+// A SASL client for the XOAUTH2 mechanism used by Gmail and Office 365,
+// which authenticates with an OAuth2 access token instead of a password
+type xoauth2Client struct {
+	Username string
+	Token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.Username + "\x01auth=Bearer " + a.Token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+// On failure, the server sends a JSON error description as challenge,
+// which must be answered with an empty response to receive the final error
+func (a *xoauth2Client) Next(challenge []byte) (response []byte, err error) {
+	return []byte{}, nil
+}
+
+// Creates a SASL client for XOAUTH2 authentication with the given access token
+func newXoauth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{Username: username, Token: token}
+}
+
+// Logs into the IMAP server with the mode given by -auth
+func authenticate(c *client.Client, a *account) error {
+	if a.Token == "" {
+		return c.Login(a.User, a.Pass)
+	}
+
+	ok, err := c.SupportAuth("XOAUTH2")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &fatalError{fmt.Errorf("server %s does not advertise AUTH=XOAUTH2", a.Server)}
+	}
+	return c.Authenticate(newXoauth2Client(a.User, a.Token))
+}
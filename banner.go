@@ -0,0 +1,94 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Starts logging the lines read from the connection, until stopTap is called.
+// Used up to authentication, to show the server greeting and login responses.
+func (mc *monitoredConn) startTap() {
+	atomic.StoreInt32(&mc.tapping, 1)
+}
+
+// Stops logging the lines read from the connection
+func (mc *monitoredConn) stopTap() {
+	atomic.StoreInt32(&mc.tapping, 0)
+}
+
+// Splits the given bytes read from the connection into lines, and logs them.
+// Only called from the reading goroutine, so needs no locking.
+func (mc *monitoredConn) tap(b []byte) {
+	mc.partial = append(mc.partial, b...)
+	for {
+		i := bytes.IndexByte(mc.partial, '\n')
+		if i < 0 {
+			return
+		}
+		line := string(bytes.TrimRight(mc.partial[:i], "\r"))
+		if mc.greeting.Load() == nil {
+			mc.greeting.Store(line)
+		}
+		logServerLine(line)
+		mc.partial = mc.partial[i+1:]
+	}
+}
+
+// Returns the server greeting, or the empty string if none was read
+func (mc *monitoredConn) Greeting() string {
+	g, _ := mc.greeting.Load().(string)
+	return g
+}
+
+// Logs a response line from the server before authentication. Alerts are always
+// shown, as they often explain login failures, all other lines only with -v.
+func logServerLine(line string) {
+	if strings.Contains(strings.ToUpper(line), "["+string(imap.CodeAlert)+"]") {
+		slog.Warn("Server alert", "line", line)
+	} else if verbose {
+		slog.Info("Server", "line", line)
+	}
+}
+
+// Consumes the unilateral updates of a client after authentication until it logs out.
+// Logs status responses with -v, and alerts always. Notifies watch of mailbox changes.
+func logUpdates(c *client.Client, updates <-chan client.Update) {
+	for {
+		select {
+		case <-c.LoggedOut():
+			return
+		case u := <-updates:
+			switch u := u.(type) {
+			case *client.StatusUpdate:
+				if u.Status.Code == imap.CodeAlert {
+					slog.Warn("Server alert", "info", u.Status.Info)
+				} else if verbose {
+					slog.Info("Server", "type", u.Status.Type, "info", u.Status.Info)
+				}
+			case *client.MailboxUpdate:
+				notifyMailboxChanged()
+			}
+		}
+	}
+}
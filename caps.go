@@ -0,0 +1,105 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Capabilities which go-imap-backup uses if the server advertises them, and what for
+var capabilityUses = []struct{ Name, Use string }{
+	{compressDeflateCapability, "compresses traffic, see -compress-imap"},
+	{condstoreCapability, "backup lists only the messages changed since the last backup"},
+	{"IDLE", "watch waits for new messages instead of polling"},
+	{"MOVE", "delete -trash moves messages instead of copying and deleting them"},
+	{"NAMESPACE", "-other-user locates the mailboxes of other users"},
+	{quotaCapability, "caps reports the storage used"},
+	{"UIDPLUS", "delete expunges only the messages it deleted"},
+	{gmailCapability, "-gmail-labels and -skip-all-mail work with Gmail labels"},
+}
+
+// The result of caps, as printed with -json
+type capsResult struct {
+	Server       string   `json:"server"`
+	User         string   `json:"user"`
+	Capabilities []string `json:"capabilities"`
+	Quotas       []Quota  `json:"quotas,omitempty"`
+}
+
+// Prints the capabilities of the server, which of them go-imap-backup uses,
+// and the usage and limits of the quotas applying to the INBOX if supported.
+// Prints JSON with -json.
+func cmdCaps(c *client.Client) error {
+	caps, err := c.Capability()
+	if err != nil {
+		return err
+	}
+	res := capsResult{Server: server, User: user, Capabilities: make([]string, 0, len(caps))}
+	for name := range caps {
+		res.Capabilities = append(res.Capabilities, name)
+	}
+	sort.Strings(res.Capabilities)
+	res.Quotas, err = GetQuotaRoot(c, "INBOX")
+	if err != nil && !errors.Is(err, client.ErrExtensionUnsupported) {
+		return err
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s/%s capabilities: %s\n", server, user, strings.Join(res.Capabilities, " "))
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Used if supported:")
+	for _, u := range capabilityUses {
+		supported := "no "
+		if caps[u.Name] {
+			supported = "yes"
+		}
+		fmt.Fprintf(out, "|- %-16s %s  %s\n", u.Name, supported, u.Use)
+	}
+	fmt.Fprintln(out)
+	if !caps[quotaCapability] {
+		fmt.Fprintln(out, "Quota: not supported by the server")
+	}
+	for _, q := range res.Quotas {
+		fmt.Fprintf(out, "Quota root %q:\n", q.Root)
+		for _, r := range q.Resources {
+			usage, limit := fmt.Sprint(r.Usage), fmt.Sprint(r.Limit)
+			if strings.EqualFold(r.Name, "STORAGE") { // in units of 1024 bytes
+				usage, limit = humanReadableSize(r.Usage*1024), humanReadableSize(r.Limit*1024)
+			}
+			percent := 0.0
+			if r.Limit > 0 {
+				percent = 100 * float64(r.Usage) / float64(r.Limit)
+			}
+			fmt.Fprintf(out, "|- %s %s of %s (%.0f%%)\n", r.Name, usage, limit, percent)
+		}
+	}
+	fmt.Fprintln(out)
+	return nil
+}
@@ -19,60 +19,241 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	pb "github.com/schollz/progressbar/v3"
 )
 
-// performs the remote command given by cmd
-func cmdRemote(cmd string) (err error) {
-	// Connect
-	bar := pb.NewOptions(3, pb.OptionSetDescription("Connect"), pb.OptionSetVisibility(isTerminal))
-	addr := fmt.Sprintf("%s:%d", server, port)
-	c, err := client.DialTLS(addr, nil)
+// Returns a context for a single major IMAP operation, which expires after
+// the operation timeout if one is configured
+func newOpContext() (context.Context, context.CancelFunc) {
+	if opTimeout > 0 {
+		return context.WithTimeout(context.Background(), opTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Returns true if the time limit given by -max-duration has passed
+func timeLimitReached() bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// The server and credentials to connect to. Commands work on the account given by
+// -s, -u and so on, migrate copies it to a second one given by -s2, -u2 and so on.
+type account struct {
+	Server    string
+	Port      int
+	User      string
+	Pass      string
+	Token     string // OAuth2 access token to authenticate with instead of the password, if set
+	TLSMode   string
+	TLSConfig *tls.Config
+}
+
+// Returns the account given by the command line flags
+func sourceAccount() *account {
+	a := &account{Server: server, Port: port, User: user, Pass: pass, TLSMode: tlsMode, TLSConfig: tlsConfig}
+	if authMode == authXoauth2 {
+		a.Token = token
+	}
+	return a
+}
+
+// Connects and logs into the IMAP server given by the command line flags
+func connect() (*client.Client, error) {
+	return connectAccount(sourceAccount())
+}
+
+// Connects and logs into the IMAP server of the given account
+func connectAccount(a *account) (c *client.Client, err error) {
+	addr := net.JoinHostPort(a.Server, strconv.Itoa(a.Port))
+	conn, err := dialServer(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err := c.Logout(); err != nil {
-			// cannot return a value from a deferred function when logout fails - just log it
-			log.Printf("error logging out: %s", err)
+	var tlsConn *tls.Conn
+	if a.TLSMode == tlsImplicit {
+		tlsConn = tls.Client(conn, a.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, withCertificateHint(err)
 		}
-	}()
-	if err := bar.Add(1); err != nil {
-		return err
+		conn = tlsConn
+	}
+	if bandwidth != nil {
+		conn = &throttledConn{Conn: conn, limiter: bandwidth}
+	}
+	mc := newMonitoredConn(conn)
+	mc.tlsConn = tlsConn
+	mc.startTap()
+	cc := &compressConn{Conn: mc}
+	c, err = client.New(cc)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	setMonitoredConn(c, mc)
+	if imapTraceOut != nil {
+		c.SetDebug(newImapTrace())
 	}
 
-	// Login
-	bar.Describe("Login")
-	if err := c.Login(user, pass); err != nil {
-		return err
+	// Upgrade to TLS if requested. Never fall back to cleartext if the server
+	// can't. go-imap discards the capabilities after the upgrade, so they are
+	// re-read before authenticating.
+	if a.TLSMode == tlsStartTLS {
+		ok, err := c.SupportStartTLS()
+		if err != nil {
+			logout(c)
+			return nil, err
+		}
+		if !ok {
+			logout(c)
+			return nil, &fatalError{fmt.Errorf("server %s does not support STARTTLS", a.Server)}
+		}
+		mc.stopTap() // the monitored connection only sees ciphertext from here on
+		if err := c.StartTLS(a.TLSConfig); err != nil {
+			logout(c)
+			return nil, withCertificateHint(err)
+		}
+		// compression runs inside TLS. Nothing changes on the wire here, so
+		// go-imap's upgrade is safe.
+		if err := c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+			mc.tlsConn, _ = conn.(*tls.Conn)
+			cc = &compressConn{Conn: conn}
+			return cc, nil
+		}); err != nil {
+			logout(c)
+			return nil, err
+		}
 	}
+
+	if err := authenticate(c, a); err != nil {
+		logout(c)
+		var fe *fatalError
+		if isNetworkError(err) || errors.As(err, &fe) {
+			return nil, err
+		}
+		return nil, &authError{err}
+	}
+	mc.stopTap()
+	if err := enableCompression(c, cc); err != nil {
+		logout(c)
+		return nil, err
+	}
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+	go logUpdates(c, updates)
+	return c, nil
+}
+
+// Creates the TLS configuration for connecting to the given server, with the
+// certificate verification options given by -insecure and -cacert
+func newTLSConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caCertFile)
+		}
+	}
+	return config, nil
+}
+
+// Logs out of the IMAP server. Logs errors instead of returning them,
+// for use in deferred calls.
+func logout(c *client.Client) {
+	defer forgetMonitoredConn(c)
+	if isDisconnected(c) {
+		return
+	}
+	if err := c.Logout(); err != nil {
+		slog.Warn("Error logging out", "err", err)
+	}
+}
+
+// performs the given remote commands in sequence, sharing a single connection.
+// Returns the number of commands completed successfully.
+func cmdRemote(cmds []string) (completed int, err error) {
+	// Connect and login
+	bar := pb.NewOptions(2, pb.OptionSetDescription("Connect"), pb.OptionSetVisibility(showProgress))
+	c, err := connect()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		logout(c)
+	}()
 	if err := bar.Add(1); err != nil {
-		return err
+		return 0, err
 	}
 
 	// List folders
 	bar.Describe("List folders")
-	folderNames, err := ListFolders(c)
+	ctx, cancel := newOpContext()
+	var folderNames []string
+	if otherUser != "" {
+		folderNames, err = ListOtherUserFolders(ctx, c, otherUser)
+		if errors.Is(err, client.ErrExtensionUnsupported) {
+			err = &fatalError{fmt.Errorf("server does not support NAMESPACE, cannot locate mailboxes of user %s", otherUser)}
+		}
+	} else {
+		folderNames, err = ListNamespaceFolders(ctx, c, namespaceFlag)
+		if errors.Is(err, client.ErrExtensionUnsupported) {
+			err = &fatalError{fmt.Errorf("server does not support NAMESPACE, cannot list the %s namespace", namespaceFlag)}
+		}
+	}
+	cancel()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := bar.Add(1); err != nil {
-		return err
+		return 0, err
 	}
 
 	// Restrict if necessary
-	if len(restrictToFolderNames) > 0 {
-		folderNames = intersect(folderNames, restrictToFolderNames)
+	folderNames = selectFolders(folderNames)
+
+	// Execute given commands, reconnecting if a command left the connection closed
+	for _, cmd := range cmds {
+		if isDisconnected(c) {
+			newC, err := connect()
+			if err != nil {
+				return completed, err
+			}
+			c = newC
+		}
+		if err := cmdRemoteOne(c, cmd, folderNames); err != nil {
+			return completed, err
+		}
+		completed++
 	}
+	return completed, nil
+}
 
-	// Execute given command
+// performs the remote command given by cmd on the given folders
+func cmdRemoteOne(c *client.Client, cmd string, folderNames []string) error {
 	switch cmd {
 	case "query":
 		_, _, _, err := cmdQuery(c, folderNames)
@@ -88,9 +269,30 @@ func cmdRemote(cmd string) (err error) {
 	case "restore":
 		return cmdRestore(c)
 
+	case "sync":
+		return cmdSync(c, folderNames)
+
 	case "delete":
 		return cmdDelete(c, folderNames)
 
+	case "delete-plan":
+		return cmdDeletePlan(c, folderNames)
+
+	case "benchmark":
+		return cmdBenchmark(c, folderNames)
+
+	case "watch":
+		return cmdWatch(c, folderNames)
+
+	case "test":
+		return cmdTest(c, folderNames)
+
+	case "caps":
+		return cmdCaps(c)
+
+	case "migrate":
+		return cmdMigrate(c, folderNames)
+
 	default:
 		return fmt.Errorf("unknown command %s", cmd)
 	}
@@ -100,76 +302,187 @@ func cmdRemote(cmd string) (err error) {
 // filtering out messages already in the coresponding local storage.
 // Returns a list of folders with the filtered messages therein, or err on error.
 func cmdQuery(c *client.Client, folderNames []string) (folders []*ImapFolderMeta, filteredMsgs int, filteredSize uint64, err error) {
+	if folderNames, err = gmailBackupFolders(c, folderNames); err != nil {
+		return nil, 0, 0, err
+	}
+	pool := newConnPool(c, len(folderNames))
+	defer pool.close()
+	return queryFolders(pool, folderNames, nil, jsonOutput)
+}
+
+// The result of a query, as printed with -json
+type queryResult struct {
+	Server        string            `json:"server"`
+	User          string            `json:"user"`
+	Messages      int               `json:"messages"` // not yet backed up
+	Size          uint64            `json:"size"`
+	TotalMessages int               `json:"totalMessages"`
+	TotalSize     uint64            `json:"totalSize"`
+	Folders       []*ImapFolderMeta `json:"folders"`
+	Aliases       []string          `json:"aliases,omitempty"` // skipped with -skip-aliases
+	Failed        []string          `json:"failed,omitempty"`  // with -continue-on-error
+}
+
+// Queries the folders with given names like cmdQuery, listing them in parallel
+// on the connections of the given pool. If the manifest m is given, folders with
+// a recorded HIGHESTMODSEQ list only the messages changed since. Prints the result
+// as a tree, or as JSON if asJSON is set.
+func queryFolders(pool *connPool, folderNames []string, m *Manifest, asJSON bool) (folders []*ImapFolderMeta, filteredMsgs int, filteredSize uint64, err error) {
+	// Fetch metadata for all messages in the folders
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
+	metas := make([]*ImapFolderMeta, len(folderNames))
+	errs := make([]error, len(folderNames))
+	pool.forEach(len(folderNames), func() bool { return false }, func(c *client.Client, i int) *client.Client {
+		describeBar(bar, "List "+folderNames[i])
+		ctx, cancel := newOpContext()
+		metas[i], errs[i] = NewImapFolderMetaSince(ctx, c, folderNames[i], listingState(m, folderNames[i]))
+		cancel()
+		bar.Add(1)
+		if errs[i] != nil && continueOnError {
+			c, _ = reconnect(c) // a failed reconnect fails the next folder too
+		}
+		return c
+	})
+
 	// Process all folders
-	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(isTerminal))
-	folders = make([]*ImapFolderMeta, len(folderNames))
+	folders = make([]*ImapFolderMeta, 0, len(folderNames))
+	unfiltered := []*ImapFolderMeta{} // folders before filtering, for alias detection
+	aliases := []string{}
+	failures := []folderFailure{}
 	totalMsgs, totalSize := 0, uint64(0)
 	for i, folderName := range folderNames {
-		bar.Describe("List " + folderName)
-
-		// Fetch metadata for all messages in the folder
-		var err error
-		folders[i], err = NewImapFolderMeta(c, folderName)
+		f, err := metas[i], errs[i]
 		if err != nil {
+			// Other users' and shared folders may be partially off limits due to ACLs
+			if (otherUser != "" || namespaceFlag != namespacePersonal) && isPermissionError(err) {
+				slog.Warn("Skipping folder", "folder", folderName, "err", err)
+				continue
+			}
+			if continueOnError {
+				slog.Error("Folder failed, continuing", "folder", folderName, "err", err)
+				failures = append(failures, folderFailure{folderName, err})
+				continue
+			}
 			return nil, 0, 0, err
 		}
-		f := folders[i]
-		totalMsgs += len(f.Messages)
-		totalSize += folders[i].Size
 
-		// Check if local folder of this name exists
-		lf, err := OpenLocalFolderReadOnly(localStoragePath, folderName)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return nil, 0, 0, err
-			}
-			// fallthrough if there is no local folder
-		} else {
-			// Filter out messages which are already backed up locally
-			defer lf.Close()
-			if lfm, err := lf.ReadAllIndex(); err != nil {
-				return nil, 0, 0, err
-			} else {
-				f.Messages, f.Size = f.FilterOut(lfm)
+		// Check if this folder is an alias of one seen before, which takes all messages
+		if f.ChangedSince == 0 {
+			if g := f.FindAlias(unfiltered); g != nil {
+				slog.Warn("Folder may be an alias, both have the same UIDVALIDITY and messages", "folder", f.Name, "of", g.Name)
+				if skipAliases {
+					aliases = append(aliases, fmt.Sprintf("%s (alias of %s)", f.Name, g.Name))
+					continue
+				}
 			}
+			unfiltered = append(unfiltered, &ImapFolderMeta{Name: f.Name, UidValidity: f.UidValidity, Messages: f.Messages, Size: f.Size})
+		}
+
+		// Check if local folder of this name exists, unless it will be overwritten anyway.
+		// After a UIDVALIDITY change, no local message matches, so all are downloaded again
+		var lfm *ImapFolderMeta
+		skip := false
+		if !overwrite {
+			lfm, err = readLocalIndex(folderName)
+		}
+		if err == nil && lfm != nil && uidValidityChanged(lfm, f) {
+			skip, err = handleUidValidityChange(folderName, lfm, f, "downloading all messages again")
+		}
+		if err != nil && continueOnError {
+			slog.Error("Folder failed, continuing", "folder", folderName, "err", err)
+			failures = append(failures, folderFailure{folderName, err})
+			continue
+		} else if err != nil {
+			return nil, 0, 0, err
+		} else if skip {
+			continue
+		}
+
+		folders = append(folders, f)
+		totalMsgs += len(f.Messages)
+		totalSize += f.Size
+
+		// Filter out messages which are already backed up locally, or were removed as duplicates
+		if lfm != nil {
+			f.Messages, f.Size = f.FilterOut(lfm)
+			f.Messages, f.Size = f.FilterOut(m.removedMessages(folderName))
 		}
 
 		filteredMsgs += len(f.Messages)
 		filteredSize += f.Size
-		if err := bar.Add(1); err != nil {
-			return nil, 0, 0, err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		res := queryResult{Server: server, User: user, Messages: filteredMsgs, Size: filteredSize,
+			TotalMessages: totalMsgs, TotalSize: totalSize, Folders: folders, Aliases: aliases}
+		for _, ff := range failures {
+			res.Failed = append(res.Failed, fmt.Sprintf("%s: %s", ff.Name, ff.Err))
 		}
+		if err := enc.Encode(res); err != nil {
+			return folders, filteredMsgs, filteredSize, err
+		}
+		return folders, filteredMsgs, filteredSize, failuresError(failures)
 	}
 
 	// Print overall message summary and folder details
-	fmt.Println()
-	fmt.Printf("%s/%s (%d/%d messages, %s/%s)\n", server, user, filteredMsgs, totalMsgs,
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s/%s (%d/%d messages, %s/%s)\n", server, user, filteredMsgs, totalMsgs,
 		humanReadableSize(filteredSize), humanReadableSize(totalSize))
 	for _, f := range folders {
-		fmt.Printf("|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
+		fmt.Fprintf(out, "|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
 	}
-	fmt.Println()
+	for _, a := range aliases {
+		fmt.Fprintf(out, "|- %s skipped\n", a)
+	}
+	for _, ff := range failures {
+		fmt.Fprintf(out, "|- %s failed: %s\n", ff.Name, ff.Err)
+	}
+	fmt.Fprintln(out)
+
+	return folders, filteredMsgs, filteredSize, failuresError(failures)
+}
 
-	return folders, filteredMsgs, filteredSize, nil
+// Reads the index of the local folder with the given name, or returns nil if there is none
+func readLocalIndex(folderName string) (*ImapFolderMeta, error) {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	return lf.ReadAllIndex()
+}
+
+// Returns a folderFailuresError for the given failures, or nil if there are none
+func failuresError(failures []folderFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	return &folderFailuresError{failures}
 }
 
 // Queries an IMAP account for the contents of all folders with given names,
 // computes a histogram of message sizes. The histogram has numBins bins of
 // binStrideBytes bytes each, with the last bin serving as an "or larger" bin.
+// With -body-only, attachment sizes are taken from BODYSTRUCTURE and excluded.
 // Disregards local folders. Returns histogram on success, or err on error.
 func cmdHisto(c *client.Client, folderNames []string, numBins uint, binStrideBytes uint) (bins []uint, err error) {
 	bins = make([]uint, numBins)
 	maxMsgSize := uint(0)
 
 	// Process all folders
-	totalMsgs, totalSize := 0, uint64(0)
-	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(isTerminal))
+	totalMsgs, totalSize, totalAttSize := 0, uint64(0), uint64(0)
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
 	for _, folderName := range folderNames {
 		bar.Describe("List " + folderName)
 
 		// Fetch metadata for all messages in the folder
-		var err error
-		f, err := NewImapFolderMeta(c, folderName)
+		ctx, cancel := newOpContext()
+		f, err := NewImapFolderMeta(ctx, c, folderName)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
@@ -177,15 +490,33 @@ func cmdHisto(c *client.Client, folderNames []string, numBins uint, binStrideByt
 		totalMsgs += len(f.Messages)
 		totalSize += f.Size
 
+		// Fetch attachment sizes, if only message bodies are to be counted
+		var attSizes map[uint32]uint32
+		if bodyOnly {
+			ctx, cancel := newOpContext()
+			attSizes, err = FetchAttachmentSizes(ctx, c, folderName)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Update histogram of message sizes
 		for _, m := range f.Messages {
-			bin := uint(m.Size) / binStrideBytes
+			size := m.Size
+			if att := attSizes[m.Uid]; att > 0 {
+				att = min(att, size)
+				totalAttSize += uint64(att)
+				size -= att
+			}
+
+			bin := uint(size) / binStrideBytes
 			if bin >= numBins {
 				bin = numBins - 1
 			}
 			bins[bin]++
-			if uint(m.Size) > maxMsgSize {
-				maxMsgSize = uint(m.Size)
+			if uint(size) > maxMsgSize {
+				maxMsgSize = uint(size)
 			}
 		}
 
@@ -205,7 +536,12 @@ func cmdHisto(c *client.Client, folderNames []string, numBins uint, binStrideByt
 	// Print overall message summary and histogram
 	fmt.Println()
 	fmt.Printf("%s/%s (%d messages, %s)\n", server, user, totalMsgs, humanReadableSize(totalSize))
-	fmt.Printf("Average message size is %s.\n", humanReadableSize(totalSize/uint64(totalMsgs)))
+	if bodyOnly {
+		fmt.Printf("Attachments take up %s, histogram shows message sizes without them.\n", humanReadableSize(totalAttSize))
+		fmt.Printf("Average message size without attachments is %s.\n", humanReadableSize((totalSize-totalAttSize)/uint64(totalMsgs)))
+	} else {
+		fmt.Printf("Average message size is %s.\n", humanReadableSize(totalSize/uint64(totalMsgs)))
+	}
 	for i, b := range bins {
 		if i < len(bins)-1 {
 			fmt.Printf("  <=%6s: ", humanReadableSize(uint64((i+1)*int(binStrideBytes))))
@@ -225,38 +561,478 @@ func cmdHisto(c *client.Client, folderNames []string, numBins uint, binStrideByt
 	return bins, nil
 }
 
+// Checks that the local storage belongs to the current account, and records
+// the current account and the hierarchy delimiter of the server in its manifest
+// if there is none yet. A mismatch is fatal unless forced. A forced backup uses
+// the manifest without the folder states of the other account, and leaves it unchanged.
+func checkManifest(c *client.Client) (*Manifest, error) {
+	owner := user
+	if otherUser != "" {
+		owner = otherUser
+	}
+
+	m, err := ReadManifest(localStoragePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		m = &Manifest{Server: server, User: owner, Format: storageFormat, Mbox: mboxVariant}
+	} else if m.Server == "" && m.User == "" {
+		m.Server, m.User = server, owner // written by reindex for mailbox files of other tools
+	} else if m.Server != server || m.User != owner {
+		msg := fmt.Sprintf("local storage %s contains a backup of %s/%s, not of %s/%s",
+			localStoragePath, m.Server, m.User, server, owner)
+		if !force {
+			return nil, &fatalError{fmt.Errorf("%s, use -f to back up anyway", msg)}
+		}
+		slog.Warn(msg + ", continuing as forced without recording folder states and subscriptions in the manifest")
+		m.Folders, m.foreign = nil, true
+	} else if m.Delimiter != "" && m.Format != "" {
+		return m, nil
+	}
+
+	m.Format = storageFormat
+	if m.Delimiter == "" {
+		if m.Delimiter, err = GetDelimiter(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, m.Write(localStoragePath)
+}
+
 // Backs up new messages in an IMAP account to the coresponding local storage.
 // Returns err on error, else nil
 func cmdBackup(c *client.Client, folderNames []string) (err error) {
-	folders, filteredMsgs, filteredSize, err := cmdQuery(c, folderNames)
+	m, err := checkManifest(c)
 	if err != nil {
 		return err
 	}
-	if filteredMsgs == 0 || filteredSize == 0 {
-		return nil
+	if folderNames, err = gmailBackupFolders(c, folderNames); err != nil {
+		return err
+	}
+	if err := recordSubscriptions(c, m); err != nil {
+		return err
+	}
+
+	// skip folders without new messages since their last complete backup
+	folderNames, unchanged, err := filterUnchangedFolders(c, m, folderNames)
+	if err != nil {
+		return err
+	}
+	if len(unchanged) > 0 {
+		fmt.Fprintf(out, "Skipping %d folders unchanged since the last backup\n", len(unchanged))
+	}
+
+	// list and download folders in parallel with -j, logging out of additional
+	// connections and of replacement connections opened when resuming folders
+	pool := newConnPool(c, len(folderNames))
+	defer pool.close()
+
+	folders, filteredMsgs, filteredSize, err := queryFolders(pool, folderNames, m, false)
+	var failures []folderFailure
+	var ffe *folderFailuresError
+	if errors.As(err, &ffe) {
+		failures, err = ffe.Failures, nil
+	}
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		for _, f := range folders {
+			if len(f.Messages) == 0 {
+				recordFolderState(m, f)
+			}
+		}
+	}
+	if (filteredMsgs == 0 || filteredSize == 0) && !overwrite {
+		return printFolderSummary(append(unchanged, folderNamesOf(folders)...), failures)
+	}
+	if overwrite {
+		if err := confirm(fmt.Sprintf("Discarding the local backup of %d folders in %s.", len(folders), localStoragePath)); err != nil {
+			return err
+		}
 	}
+	sortFolders(folders, folderOrder)
 
 	// Download and append any new messages to local folder storage
-	bar := pb.NewOptions64(int64(filteredSize), pb.OptionSetDescription("Download"), pb.OptionShowBytes(true), pb.OptionSetVisibility(isTerminal))
+	pending := []*ImapFolderMeta{}
+	done := []string{}
 	for _, f := range folders {
-		if len(f.Messages) == 0 {
-			continue
+		if len(f.Messages) == 0 && !overwrite {
+			done = append(done, f.Name)
+		} else {
+			pending = append(pending, f)
 		}
-		bar.Describe("Download " + f.Name)
+	}
+	skippedEmpty, skippedTimeout := []string{}, []string{}
+	bar := pb.NewOptions64(int64(filteredSize), pb.OptionSetDescription("Download"), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
+	var timeLimitErr error
+	var mutex sync.Mutex // guards the results below, and the manifest
+	stop := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == nil && timeLimitErr == nil && timeLimitReached() {
+			timeLimitErr = errTimeLimit
+		}
+		return err != nil || timeLimitErr != nil
+	}
+	pool.forEach(len(pending), stop, func(c *client.Client, i int) *client.Client {
+		f := pending[i]
+		c, skipped, timedOut, ferr := backupFolder(c, f, bar)
 
-		// Open local mbox file and index file for appending
-		lf, err := OpenLocalFolderAppend(localStoragePath, f.Name)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if errors.Is(ferr, errTimeLimit) {
+			timeLimitErr = ferr
+		} else if ferr != nil && continueOnError {
+			slog.Error("Folder failed, continuing", "folder", f.Name, "err", ferr)
+			failures = append(failures, folderFailure{f.Name, ferr})
+			c, _ = reconnect(c) // a failed reconnect fails the next folder too
+			return c
+		} else if ferr != nil {
+			if err == nil {
+				err = ferr
+			} else {
+				slog.Error("Folder failed", "folder", f.Name, "err", ferr)
+			}
+			return c
+		}
+		if len(skipped) > 0 {
+			skippedEmpty = append(skippedEmpty, fmt.Sprintf("%s: uids %v", f.Name, skipped))
+		}
+		if len(timedOut) > 0 {
+			skippedTimeout = append(skippedTimeout, fmt.Sprintf("%s: uids %v", f.Name, timedOut))
+		}
+		if ferr == nil {
+			if len(skipped) == 0 && len(timedOut) == 0 {
+				recordFolderState(m, f)
+			}
+			done = append(done, f.Name)
+			slog.Info("Folder backed up", "folder", f.Name, "messages", len(f.Messages), "size", f.Size)
+		}
+		return c
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(skippedEmpty) > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Skipped messages without body, these will be retried on the next backup:")
+		for _, s := range skippedEmpty {
+			fmt.Fprintf(out, "|- %s\n", s)
+		}
+	}
+	if len(skippedTimeout) > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Skipped messages which exceeded -msg-timeout, these will be retried on the next backup:")
+		for _, s := range skippedTimeout {
+			fmt.Fprintf(out, "|- %s\n", s)
+		}
+	}
+	summaryErr := printFolderSummary(append(unchanged, done...), failures)
+	if timeLimitErr != nil {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "Time limit reached after %d of %d folders and %d messages. Run backup again to continue.\n",
+			len(done), len(folders), atomic.LoadUint64(&transferredMessages))
+		return timeLimitErr
+	}
+	return summaryErr
+}
+
+// Returns the names of the given folders
+func folderNamesOf(folders []*ImapFolderMeta) []string {
+	names := make([]string, len(folders))
+	for i, f := range folders {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// Prints which folders succeeded and which failed with -continue-on-error.
+// Returns a folderFailuresError if any failed, else nil.
+func printFolderSummary(succeeded []string, failures []folderFailure) error {
+	if !continueOnError {
+		return nil
+	}
+	sort.Strings(succeeded)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Name < failures[j].Name })
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%d folders succeeded, %d failed:\n", len(succeeded), len(failures))
+	for _, name := range succeeded {
+		fmt.Fprintf(out, "|- %s ok\n", name)
+	}
+	for _, ff := range failures {
+		fmt.Fprintf(out, "|- %s failed: %s\n", ff.Name, ff.Err)
+	}
+	return failuresError(failures)
+}
+
+// Downloads the new messages of a folder to local storage, retrying as configured
+// for this folder, and skipping messages which exceed the message timeout. Returns
+// the connection to continue with, which differs from c after reconnecting, and the
+// UIDs of messages skipped because they had no body or exceeded the timeout.
+func backupFolder(c *client.Client, f *ImapFolderMeta, bar *pb.ProgressBar) (newC *client.Client, skipped, timedOut []uint32, err error) {
+	describeBar(bar, "Download "+f.Name)
+
+	// Open local folder for appending, or start it fresh
+	var lf StorageBackend
+	if overwrite {
+		lf, err = OpenStorageOverwrite(localStoragePath, f.Name)
+	} else {
+		lf, err = OpenStorageAppend(localStoragePath, f.Name)
+	}
+	if err != nil {
+		return c, nil, nil, err
+	}
+	defer lf.Close()
+
+	// Without a matching rule, only network errors are retried in place, using
+	// the global settings. Other errors fail the command, which is retried as a whole.
+	maxRetries, delaySeconds, retryable := retries, retryDelaySeconds, isNetworkError
+	if rule := findFolderRetryRule(f.Name); rule != nil {
+		maxRetries, delaySeconds, retryable = rule.Retries, rule.DelaySeconds, isRetryable
+	}
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := newOpContext()
+		var s []uint32
+		s, err = f.DownloadTo(ctx, c, lf, bar)
+		cancel()
+		skipped = append(skipped, s...)
+		var mte *msgTimeoutError
+		if errors.As(err, &mte) {
+			slog.Warn("Skipping message", "folder", f.Name, "err", err)
+			timedOut = append(timedOut, mte.Uid)
+			attempt-- // a skipped message does not count as a failed attempt
+		} else if err == nil || !retryable(err) {
+			break
+		} else if attempt > maxRetries {
+			err = &retriedError{err}
+			break
+		} else {
+			slog.Warn("Error downloading folder, retrying", "folder", f.Name, "attempt", attempt, "err", err)
+			sleep(retryDelay(delaySeconds, attempt))
+		}
+		if c, err = resumeFolder(c, lf, f, timedOut); err != nil {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, errTimeLimit) {
+		return c, skipped, timedOut, err
+	}
+	// Close cannot report errors, such as failed uploads with -store
+	if ferr := lf.Flush(); ferr != nil {
+		return c, skipped, timedOut, ferr
+	}
+
+	// Persist and verify the completed or partial folder if requested
+	if durable {
+		if err := lf.Sync(); err != nil {
+			return c, skipped, timedOut, err
+		}
+		mm, err := VerifyLastMessage(localStoragePath, f.Name)
+		if err != nil {
+			return c, skipped, timedOut, err
+		}
+		slog.Info("Folder durably stored, verified last message", "folder", f.Name, "uid", mm.Uid)
+	}
+	return c, skipped, timedOut, err
+}
+
+// Measures pure download throughput on the largest of the given folders,
+// discarding the message bodies instead of writing them to disk
+func cmdBenchmark(c *client.Client, folderNames []string) (err error) {
+	// Find the largest folder
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
+	var largest *ImapFolderMeta
+	for _, folderName := range folderNames {
+		bar.Describe("List " + folderName)
+		ctx, cancel := newOpContext()
+		f, err := NewImapFolderMeta(ctx, c, folderName)
+		cancel()
 		if err != nil {
 			return err
 		}
-		defer lf.Close()
+		if largest == nil || f.Size > largest.Size {
+			largest = f
+		}
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+	fmt.Println()
+	if largest == nil || len(largest.Messages) == 0 {
+		return &fatalError{fmt.Errorf("no messages to benchmark")}
+	}
+	fmt.Printf("Benchmarking download of %s (%d messages, %s)\n", largest.Name,
+		len(largest.Messages), humanReadableSize(largest.Size))
+
+	// Download all messages of the largest folder, discarding them
+	bar = pb.NewOptions64(int64(largest.Size), pb.OptionSetDescription("Download "+largest.Name), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
+	discard := &discardAppender{}
+	start := time.Now()
+	ctx, cancel := newOpContext()
+	_, err = largest.DownloadTo(ctx, c, discard, bar)
+	cancel()
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Seconds()
+
+	fmt.Println()
+	fmt.Printf("Downloaded %d messages, %s in %.1f s\n", discard.Messages, humanReadableSize(discard.Size), elapsed)
+	fmt.Printf("Throughput %.2f MB/s, %.1f messages/s\n", float64(discard.Size)/1024/1024/elapsed,
+		float64(discard.Messages)/elapsed)
+	return nil
+}
+
+// Prepares resuming an interrupted download of a folder. The interruption may have
+// left the connection in the middle of a command, so it is dropped and the download
+// resumes on a new one. Filters out messages which were stored before the
+// interruption, as well as the given UIDs to skip. Returns the client to continue with.
+func resumeFolder(c *client.Client, lf StorageBackend, f *ImapFolderMeta, skipUids []uint32) (*client.Client, error) {
+	dropConnection(c)
+	c, err := reconnect(c)
+	if err != nil {
+		return c, err
+	}
+
+	if err := lf.Flush(); err != nil {
+		return c, err
+	}
+	rlf, err := OpenStorageReadOnly(localStoragePath, f.Name)
+	if err != nil {
+		return c, err
+	}
+	defer rlf.Close()
+	local, err := rlf.ReadAllIndex()
+	if err != nil {
+		return c, err
+	}
+	for _, uid := range skipUids {
+		local.Messages = append(local.Messages, MessageMeta{UidValidity: f.UidValidity, Uid: uid})
+	}
+	f.Messages, f.Size = f.FilterOut(local)
+	return c, nil
+}
+
+// Returns the given connection if it is still usable, or dials and logs in
+// again if it was lost. On error, the lost connection is returned.
+// Authentication errors are returned as authError, which is not retryable.
+func reconnect(c *client.Client) (*client.Client, error) {
+	if !isDisconnected(c) {
+		return c, nil
+	}
+	slog.Info("Reconnecting", "server", server)
+	newC, err := connect()
+	if err != nil {
+		return c, err
+	}
+	forgetMonitoredConn(c)
+	return newC, nil
+}
+
+// Prints the given statement and asks the user to type the given word to confirm,
+// unless forced. Used instead of confirm for irreversible operations.
+// Returns a fatal error if the user does not confirm.
+func confirmWord(statement, word string) error {
+	if force {
+		return nil
+	}
+	if statement != "" {
+		fmt.Println(statement)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("Type %s to proceed: ", word)
+	answer, _ := reader.ReadString('\n')
+	if strings.TrimSpace(answer) != word {
+		return &fatalError{fmt.Errorf("user did not type %s, aborting", word)}
+	}
+	return nil
+}
+
+// Prints the given statement and asks the user for confirmation, unless forced.
+// Returns a fatal error if the user does not confirm.
+func confirm(statement string) error {
+	if force {
+		return nil
+	}
+	if statement != "" {
+		fmt.Println(statement)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("Are you sure [y/n]: ")
+	yn, _ := reader.ReadString('\n')
+	yn = strings.TrimSpace(yn)
+	if yn != "y" && yn != "Y" {
+		return &fatalError{fmt.Errorf("user did not confirm, aborting")}
+	}
+	return nil
+}
 
-		// Download and store messages
-		err = f.DownloadTo(c, lf, bar)
+// Date format for printing days
+const ymd = "2006-01-02"
+
+// Returns the current time and the deletion cutoff time given by the age limit in months
+func deletionCutoff() (now, before time.Time) {
+	now = time.Now().UTC()
+	before = now.AddDate(0, -months, 0) // n months back
+	return now, before
+}
+
+// Previews which messages a delete command would remove, without modifying the server.
+// Caches message dates locally, so re-running the plan with a different age limit
+// only re-fetches folders which have changed in the meantime.
+func cmdDeletePlan(c *client.Client, folderNames []string) (err error) {
+	now, before := deletionCutoff()
+	// SEARCH BEFORE compares dates only, disregarding the time of day
+	beforeDay := time.Date(before.Year(), before.Month(), before.Day(), 0, 0, 0, 0, time.UTC)
+	fmt.Printf("Today is %s, planning deletion of messages %d months or older, so before %s.\n",
+		now.Format(ymd), months, before.Format(ymd))
+	if searchExpr != "" {
+		slog.Warn("delete-plan considers the age of messages only, ignoring -search")
+	}
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Plan"), pb.OptionSetVisibility(showProgress))
+	plans := make([]string, len(folderNames))
+	totalMsgs, totalSize := 0, uint64(0)
+	for i, folderName := range folderNames {
+		bar.Describe("Plan " + folderName)
+		ctx, cancel := newOpContext()
+		fd, cached, err := FetchFolderDates(ctx, c, folderName)
+		cancel()
 		if err != nil {
 			return err
 		}
+
+		numMsgs, size := 0, uint64(0)
+		for _, m := range fd.Messages {
+			if m.Date.Before(beforeDay) {
+				numMsgs++
+				size += uint64(m.Size)
+			}
+		}
+		totalMsgs += numMsgs
+		totalSize += size
+
+		source := "fetched"
+		if cached {
+			source = "cached"
+		}
+		plans[i] = fmt.Sprintf("|- %s (%d/%d messages, %s, %s)", folderName, numMsgs, len(fd.Messages),
+			humanReadableSize(size), source)
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("%s/%s (%d messages, %s would be deleted)\n", server, user, totalMsgs, humanReadableSize(totalSize))
+	for _, p := range plans {
+		fmt.Println(p)
 	}
+	fmt.Println()
+	fmt.Println("Adjust -m and re-run delete-plan to refine, or run delete to apply.")
 	return nil
 }
 
@@ -266,27 +1042,46 @@ func cmdDelete(c *client.Client, folderNames []string) (err error) {
 		return fmt.Errorf("months must be >= 0")
 	}
 
-	now := time.Now().UTC()
-	before := now.AddDate(0, -months, 0) // n months back
-	ymd := "2006-01-02"
-	fmt.Printf("Today is %s, deleting messages %d months or older, so before %s.\n",
-		now.Format(ymd), months, before.Format(ymd))
+	if dryRun {
+		return cmdDeleteDryRun(c, folderNames)
+	}
 
-	if !force {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Printf("Are you sure [y/n]: ")
-		yn, _ := reader.ReadString('\n')
-		yn = strings.TrimSpace(yn)
-		if yn != "y" && yn != "Y" {
-			return fmt.Errorf("user did not confirm, aborting")
+	now, before := deletionCutoff()
+	folderNames = withoutTrash(folderNames)
+	statement := "Deleted messages cannot be recovered from the server."
+	if trashFolder != "" {
+		ctx, cancel := newOpContext()
+		_, err := statusWithContext(ctx, c, trashFolder, []imap.StatusItem{imap.StatusMessages})
+		cancel()
+		if err != nil {
+			if isNetworkError(err) {
+				return err
+			}
+			return &fatalError{fmt.Errorf("trash folder %s: %w", trashFolder, err)}
 		}
+		fmt.Printf("Today is %s, moving messages %d months or older, so before %s, to %s.\n",
+			now.Format(ymd), months, before.Format(ymd), trashFolder)
+		statement = fmt.Sprintf("Messages will be removed from their folders, but kept in %s.", trashFolder)
+	} else {
+		fmt.Printf("Today is %s, deleting messages %d months or older, so before %s.\n",
+			now.Format(ymd), months, before.Format(ymd))
+	}
+
+	if searchExpr != "" {
+		fmt.Printf("Only messages matching %s.\n", searchExpr)
+	}
+
+	if err := confirmWord(statement, "DELETE"); err != nil {
+		return err
 	}
 
-	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Delete"), pb.OptionSetVisibility(isTerminal))
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Delete"), pb.OptionSetVisibility(showProgress))
 	totalDeleted := int64(0)
 	for _, folderName := range folderNames {
 		bar.Describe("Delete " + folderName)
-		numDeleted, err := DeleteMessagesBefore(c, folderName, before)
+		ctx, cancel := newOpContext()
+		numDeleted, err := DeleteMessagesBefore(ctx, c, folderName, before, trashFolder)
+		cancel()
 		if err != nil {
 			return err
 		}
@@ -296,7 +1091,113 @@ func cmdDelete(c *client.Client, folderNames []string) (err error) {
 		}
 	}
 
-	fmt.Printf("Total %d message deleted\n", totalDeleted)
+	if trashFolder != "" {
+		fmt.Fprintf(out, "Total %d messages moved to %s, 0 expunged\n", totalDeleted, trashFolder)
+	} else {
+		fmt.Fprintf(out, "Total 0 messages moved, %d expunged\n", totalDeleted)
+	}
+	return nil
+}
+
+// Returns the given folder names without the -trash folder, if any. Deleting
+// old messages from it would destroy them, rather than keep them.
+func withoutTrash(folderNames []string) []string {
+	if trashFolder == "" {
+		return folderNames
+	}
+	res := []string{}
+	for _, name := range folderNames {
+		if name == trashFolder {
+			slog.Info("Skipping the trash folder", "folder", name)
+			continue
+		}
+		res = append(res, name)
+	}
+	return res
+}
+
+// Lists the messages a delete command would remove per folder, with date, sender
+// and subject, without modifying the server. Writes them to the CSV file given
+// with -csv, if any, for review before deleting.
+func cmdDeleteDryRun(c *client.Client, folderNames []string) (err error) {
+	now, before := deletionCutoff()
+	folderNames = withoutTrash(folderNames)
+	fmt.Printf("Today is %s, dry run for deleting messages %d months or older, so before %s.\n",
+		now.Format(ymd), months, before.Format(ymd))
+	if searchExpr != "" {
+		fmt.Printf("Only messages matching %s.\n", searchExpr)
+	}
+
+	var w *csv.Writer
+	if csvFile != "" {
+		f, err := os.Create(csvFile)
+		if err != nil {
+			return &fatalError{err}
+		}
+		defer f.Close()
+		w = csv.NewWriter(f)
+		if err := w.Write([]string{"folder", "uid", "date", "size", "subject", "from"}); err != nil {
+			return err
+		}
+	}
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Dry run"), pb.OptionSetVisibility(showProgress))
+	folderCands := make([][]DeletionCandidate, len(folderNames))
+	totalMsgs, totalSize := 0, uint64(0)
+	for i, folderName := range folderNames {
+		bar.Describe("Dry run " + folderName)
+		ctx, cancel := newOpContext()
+		cands, err := ListMessagesBefore(ctx, c, folderName, before)
+		cancel()
+		if err != nil {
+			return err
+		}
+		folderCands[i] = cands
+		for _, m := range cands {
+			totalMsgs++
+			totalSize += uint64(m.Size)
+			if w != nil {
+				rec := []string{m.Folder, strconv.FormatUint(uint64(m.Uid), 10), m.Date.Format(time.RFC3339),
+					strconv.FormatUint(uint64(m.Size), 10), m.Subject, m.From}
+				if err := w.Write(rec); err != nil {
+					return err
+				}
+			}
+		}
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	// Print folder summaries, then the affected messages
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s/%s (%d messages, %s)\n", server, user, totalMsgs, humanReadableSize(totalSize))
+	for i, cands := range folderCands {
+		size := uint64(0)
+		for _, m := range cands {
+			size += uint64(m.Size)
+		}
+		fmt.Fprintf(out, "|- %s (%d, %s)\n", folderNames[i], len(cands), humanReadableSize(size))
+	}
+	if totalMsgs > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "%-20s %10s %9s %-16s %-30s %s\n", "FOLDER", "UID", "SIZE", "DATE", "FROM", "SUBJECT")
+		for _, cands := range folderCands {
+			for _, m := range cands {
+				fmt.Fprintf(out, "%-20s %10d %9s %-16s %-30s %s\n", m.Folder, m.Uid, humanReadableSize(uint64(m.Size)),
+					m.Date.Format("2006-01-02 15:04"), m.From, m.Subject)
+			}
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Total %d messages, %s would be deleted\n", totalMsgs, humanReadableSize(totalSize))
+	if w != nil {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote list of messages to %s\n", csvFile)
+	}
 	return nil
 }
 
@@ -306,19 +1207,22 @@ func cmdLocalQuery() (err error) {
 	if err != nil {
 		return err
 	}
+	folderNames = selectFolders(folderNames)
 
-	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Local list"), pb.OptionSetVisibility(isTerminal))
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Local list"), pb.OptionSetVisibility(showProgress))
 	folders := make([]*ImapFolderMeta, len(folderNames))
+	lfs := make([]StorageBackend, len(folderNames))
 	totalMsgs, totalSize := uint32(0), uint64(0)
 
 	for i, folderName := range folderNames {
 		bar.Describe("Local list " + folderName)
 
-		lf, err := OpenLocalFolderReadOnly(localStoragePath, folderName)
+		lf, err := OpenStorageReadOnly(localStoragePath, folderName)
 		if err != nil {
 			return err
 		}
 		defer lf.Close()
+		lfs[i] = lf
 
 		folders[i], err = lf.ReadAllIndex()
 		if err != nil {
@@ -332,9 +1236,13 @@ func cmdLocalQuery() (err error) {
 		}
 	}
 
+	if detailsOutput {
+		return printLocalDetails(lfs, folders)
+	}
+
 	// Print overall message summary and folder details
 	fmt.Println()
-	fmt.Printf("%s (%d messages, %s)\n", localStoragePath, totalMsgs, humanReadableSize(totalSize))
+	fmt.Printf("%s (%d messages, %s)\n", localStorageName(), totalMsgs, humanReadableSize(totalSize))
 	for _, f := range folders {
 		fmt.Printf("|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
 	}
@@ -342,24 +1250,223 @@ func cmdLocalQuery() (err error) {
 	return nil
 }
 
+// A message listed by lquery -details or search
+type messageDetails struct {
+	Folder string `json:"folder"`
+	Uid    uint32 `json:"uid"`
+	Size   uint32 `json:"size"`
+	MessageEnvelope
+}
+
+// Prints date, sender and subject of the messages in the given local folders,
+// restricted to the page selected with -page and -page-size, as a table or as JSON
+func printLocalDetails(lfs []StorageBackend, folders []*ImapFolderMeta) error {
+	first, last := 0, math.MaxInt
+	if page > 0 {
+		first = (page - 1) * pageSize
+		last = first + pageSize
+	}
+
+	details := []messageDetails{}
+	i := 0
+	for fi, f := range folders {
+		for _, mm := range f.Messages {
+			if i >= first && i < last {
+				env, err := lfs[fi].ReadEnvelope(mm)
+				if err != nil {
+					return err
+				}
+				details = append(details, messageDetails{Folder: f.Name, Uid: mm.Uid, Size: mm.Size, MessageEnvelope: env})
+			}
+			i++
+		}
+	}
+
+	if jsonOutput {
+		return printDetails(details)
+	}
+	fmt.Println()
+	printDetails(details)
+	if page > 0 {
+		fmt.Printf("Page %d of %d (%d messages)\n", page, (i+pageSize-1)/pageSize, i)
+	}
+	fmt.Println()
+	return nil
+}
+
+// Prints the given message details as a table, or as JSON with -json
+func printDetails(details []messageDetails) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(details)
+	}
+	fmt.Printf("%-20s %10s %9s %-16s %-30s %s\n", "FOLDER", "UID", "SIZE", "DATE", "FROM", "SUBJECT")
+	for _, d := range details {
+		date := ""
+		if !d.Date.IsZero() {
+			date = d.Date.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-20s %10d %9s %-16s %-30s %s\n", d.Folder, d.Uid, humanReadableSize(uint64(d.Size)), date, d.From, d.Subject)
+	}
+	return nil
+}
+
+// Prints the index of local folders as an aligned table, or as JSON if requested.
+// Dumps the restricted folders if given, else all local folders.
+func cmdDumpIndex() (err error) {
+	folderNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+
+	folders := make([]*ImapFolderMeta, len(folderNames))
+	for i, folderName := range folderNames {
+		lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+		if err != nil {
+			return err
+		}
+		defer lf.Close()
+
+		folders[i], err = lf.ReadAllIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(folders)
+	}
+
+	for _, f := range folders {
+		fmt.Printf("%s (%d messages, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
+		fmt.Printf("%12s %10s %9s %14s %s\n", "UIDVALIDITY", "UID", "SIZE", "OFFSET", "FLAGS")
+		for _, m := range f.Messages {
+			offset := "-" // unknown, e.g. for Maildir
+			if m.Offset != math.MaxUint64 {
+				offset = fmt.Sprintf("%d", m.Offset)
+			}
+			fmt.Printf("%12d %10d %9s %14s %s\n", m.UidValidity, m.Uid, humanReadableSize(uint64(m.Size)), offset,
+				strings.Join(m.Flags, " "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// Removes the local backup of the folders given with -r, i.e. their mailbox and
+// index files or Maildir directories, after confirmation. The next backup then fetches them afresh.
+func cmdForget() (err error) {
+	if len(restrictToFolderNames) == 0 {
+		return fmt.Errorf("forget needs the folders to remove, given with -r")
+	}
+	localNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames := selectFolders(localNames)
+	for _, name := range restrictToFolderNames {
+		if len(matchFolders(localNames, []string{name})) == 0 {
+			fmt.Printf("Folder %s not found in %s\n", name, localStoragePath)
+		}
+	}
+	if len(folderNames) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Removing the local backup of %d folders from %s:\n", len(folderNames), localStoragePath)
+	for _, name := range folderNames {
+		fmt.Printf("|- %s\n", name)
+	}
+	if err := confirm(""); err != nil {
+		return err
+	}
+
+	for _, name := range folderNames {
+		removed, err := RemoveStorage(localStoragePath, name)
+		for _, fileName := range removed {
+			fmt.Printf("Removed %s\n", fileName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// forget the recorded folder states as well, so the next backup does not skip them
+	m, err := ReadManifest(localStoragePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, name := range folderNames {
+		delete(m.Folders, name)
+		delete(m.Removed, name)
+	}
+	return m.Write(localStoragePath)
+}
+
 // Restores folders and messages therein from local storage to an IMAP server
 func cmdRestore(c *client.Client) (err error) {
 	folderNames, err := GetLocalFolderNames(localStoragePath)
 	if err != nil {
 		return err
 	}
+	folderNames = selectFolders(folderNames)
+
+	// Log out of any connection replaced during upload, the caller owns the original
+	orig := c
+	defer func() {
+		if c != orig {
+			logout(c)
+		}
+	}()
 
-	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(isTerminal))
+	// Local folder names use the hierarchy delimiter of the backed up server,
+	// convert them if the manifest records one which differs from this server's
+	delim, err := GetDelimiter(c)
+	if err != nil {
+		return err
+	}
+	srcDelim := ""
+	m, err := ReadManifest(localStoragePath)
+	if err == nil {
+		srcDelim = m.Delimiter
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
 	folders := make([]*ImapFolderMeta, len(folderNames))
 	remFolders := make([]*ImapFolderMeta, len(folderNames))
+	remNames := make([]string, len(folderNames))
+	failed := []string{}
+	merged := map[string]map[string]bool{} // keys of messages to upload by shared server folder
 	totalMsgs, totalSize := uint32(0), uint64(0)
 	filteredMsgs, filteredSize := uint32(0), uint64(0)
 
+	// Find server folders into which several local folders are restored
+	for _, folderName := range folderNames {
+		remName := restoreTargetName(folderName, srcDelim, delim)
+		if _, ok := merged[remName]; ok {
+			merged[remName] = map[string]bool{}
+		} else {
+			merged[remName] = nil
+		}
+	}
+
+	// Keep the connection alive while reading local folders
+	k := startKeepalive(c)
+	defer k.stop()
+
 	// Find messages in local folders which are not on the IMAP server
 	for i, folderName := range folderNames {
 		bar.Describe("List " + folderName)
 
-		lf, err := OpenLocalFolderReadOnly(localStoragePath, folderName)
+		lf, err := OpenStorageReadOnly(localStoragePath, folderName)
 		if err != nil {
 			return err
 		}
@@ -372,22 +1479,38 @@ func cmdRestore(c *client.Client) (err error) {
 		totalMsgs += uint32(len(folders[i].Messages))
 		totalSize += folders[i].Size
 
-		remFolders[i], err = NewImapFolderMeta(c, folderName)
+		remNames[i] = restoreTargetName(folderName, srcDelim, delim)
+		k.busy()
+		remFolders[i], err = openRestoreTarget(c, folderName, remNames[i], delim)
+		k.idle(c)
 		if err != nil {
-			if !strings.HasPrefix(err.Error(), "Mailbox doesn't exist") {
+			if failFast || isNetworkError(err) {
 				return err
 			}
-			// create folder on IMAP server if it doesn't exist
-			err = c.Create(folderName)
-			if err != nil {
+			slog.Warn("Skipping folder", "folder", folderName, "err", err)
+			failed = append(failed, fmt.Sprintf("%s: %s", folderName, err))
+			folders[i].Messages, folders[i].Size = nil, 0
+			if err := bar.Add(1); err != nil {
 				return err
 			}
-			remFolders[i], err = NewImapFolderMeta(c, folderName)
+			continue
+		}
+		k.busy()
+		subscribeRestored(c, m, folderName, remNames[i])
+		folders[i].Messages, folders[i].Size, err = filterRestoreMessages(c, lf, folders[i], remFolders[i])
+		k.idle(c)
+		if err != nil {
+			return err
+		}
+
+		// Local folders mapped to the same server folder upload each message once
+		if seen := merged[remNames[i]]; seen != nil {
+			folders[i].Messages, folders[i].Size, err = filterMerged(lf, folders[i].Messages, seen)
 			if err != nil {
 				return err
 			}
 		}
-		folders[i].Messages, folders[i].Size = folders[i].FilterOut(remFolders[i])
+		folders[i].SortBySeqNum()
 
 		filteredMsgs += uint32(len(folders[i].Messages))
 		filteredSize += folders[i].Size
@@ -398,44 +1521,129 @@ func cmdRestore(c *client.Client) (err error) {
 	}
 
 	// Print overall message summary and folder details
-	fmt.Println()
-	fmt.Printf("%s (%d/%d messages, %s/%s)\n", localStoragePath, filteredMsgs, totalMsgs,
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s (%d/%d messages, %s/%s)\n", localStorageName(), filteredMsgs, totalMsgs,
 		humanReadableSize(filteredSize), humanReadableSize(totalSize))
-	for _, f := range folders {
-		fmt.Printf("|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
+	for i, f := range folders {
+		if remNames[i] != f.Name {
+			fmt.Fprintf(out, "|- %s as %s (%d, %s)\n", f.Name, remNames[i], len(f.Messages), humanReadableSize(f.Size))
+		} else {
+			fmt.Fprintf(out, "|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
+		}
 	}
-	fmt.Println()
+	fmt.Fprintln(out)
 
-	// Upload any new messages to IMAP server
-	bar = pb.NewOptions64(int64(filteredSize), pb.OptionSetDescription("Upload"), pb.OptionShowBytes(true), pb.OptionSetVisibility(isTerminal))
+	// Upload any new messages to IMAP server. With Gmail labels, each message is
+	// uploaded once and labeled, instead of uploading a copy per label's folder.
+	bar = pb.NewOptions64(int64(filteredSize), pb.OptionSetDescription("Upload"), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
 	msgBuffer := &bytes.Buffer{}
-	for _, f := range folders {
+	labels := useGmailLabels(c)
+	labeled := map[string]bool{} // Message-IDs of labeled messages restored
+	for i, f := range folders {
+		if len(f.Messages) == 0 {
+			continue
+		}
 		bar.Describe("Upload " + f.Name)
+		flagLevel := flagsAll
+		if noFlags {
+			flagLevel = flagsNone
+		}
 
-		lf, err := OpenLocalFolderReadOnly(localStoragePath, f.Name)
+		lf, err := OpenStorageReadOnly(localStoragePath, f.Name)
 		if err != nil {
 			return err
 		}
 		defer lf.Close()
 
+		uploaded := []MessageMeta{}
 		for _, mm := range f.Messages {
+			if labels && len(mm.Labels) > 0 && mm.Envelope != nil && mm.Envelope.MessageId != "" {
+				if labeled[mm.Envelope.MessageId] {
+					bar.Add64(int64(mm.Size))
+					continue // restored from another label's folder
+				}
+				labeled[mm.Envelope.MessageId] = true
+			}
 			if err := lf.ReadMessage(mm, msgBuffer); err != nil {
 				return err
 			}
 
 			l := msgBuffer.Len()
-			clonedBuffer := bytes.NewBuffer(msgBuffer.Bytes())    // clone buffer so we can read it twice
-			receivedTime, err := GetMessageReceived(clonedBuffer) // first read the clone here...
+			receivedTime := restoreDate(mm, msgBuffer.Bytes())
+			k.busy()
+			c, err = appendWithReconnect(c, remNames[i], mm, receivedTime, msgBuffer.Bytes(), &flagLevel)
+			k.idle(c)
 			if err != nil {
-				log.Printf("Validity %d uid %d: Warning: Unable to parse received time, using dummy", mm.UidValidity, mm.Uid)
-			}
-			if err := c.Append(f.Name, nil, receivedTime, msgBuffer); err != nil { // then read the original here
 				return err
 			}
+			addTransferred(uint64(l))
+			uploaded = append(uploaded, mm)
 			if err := bar.Add64(int64(l)); err != nil {
 				return err
 			}
 		}
+		if labels {
+			k.busy()
+			err := applyGmailLabels(c, remNames[i], uploaded)
+			k.idle(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Skipped folders which could not be opened or created on the server:")
+		for _, f := range failed {
+			fmt.Fprintf(out, "|- %s\n", f)
+		}
 	}
 	return nil
 }
+
+// Appends a message like appendMessage. After network errors, reconnects and
+// retries the message up to -R times, backing off as between command retries, so restore
+// continues after the last message stored. Returns the connection to continue with.
+func appendWithReconnect(c *client.Client, folder string, mm MessageMeta, date time.Time, bs []byte, level *int) (*client.Client, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if c, err = reconnect(c); err == nil {
+			err = appendMessage(c, folder, mm, date, bs, level)
+		}
+		if err == nil || !isNetworkError(err) {
+			return c, err
+		}
+		if attempt > retries {
+			return c, &retriedError{err}
+		}
+		slog.Warn("Error uploading message, retrying", "folder", folder, "uid", mm.Uid, "attempt", attempt, "err", err)
+		sleep(retryDelay(retryDelaySeconds, attempt))
+	}
+}
+
+// Opens the server folder to restore a local folder into, creating it and its
+// parents if they don't exist yet. Returns the metadata of the messages in the server folder.
+func openRestoreTarget(c *client.Client, localName, remName, delim string) (*ImapFolderMeta, error) {
+	ctx, cancel := newOpContext()
+	remFolder, err := NewImapFolderMeta(ctx, c, remName)
+	cancel()
+	if err == nil || !isNoSuchMailbox(err) {
+		return remFolder, err
+	}
+
+	// create folder on IMAP server if it doesn't exist
+	if err := validateFolderName(remName, delim); err != nil {
+		return nil, &fatalError{fmt.Errorf("cannot restore local folder %q: %w", localName, err)}
+	}
+	if err := createParentFolders(c, remName, delim); err != nil {
+		return nil, &fatalError{fmt.Errorf("server refused to create parent folder for local folder %q: %w", localName, err)}
+	}
+	if err := c.Create(remName); err != nil {
+		return nil, &fatalError{fmt.Errorf("server refused to create folder %q for local folder %q: %w", remName, localName, err)}
+	}
+	ctx, cancel = newOpContext()
+	remFolder, err = NewImapFolderMeta(ctx, c, remName)
+	cancel()
+	return remFolder, err
+}
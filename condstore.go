@@ -0,0 +1,80 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Capability of the CONDSTORE extension of RFC 7162, and its fetch and status items
+const (
+	condstoreCapability                 = "CONDSTORE"
+	modSeqItem          imap.FetchItem  = "MODSEQ"
+	highestModSeqItem   imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+// Returns whether the server supports CONDSTORE
+func supportsCondstore(c *client.Client) bool {
+	ok, err := c.Support(condstoreCapability)
+	return err == nil && ok
+}
+
+// Returns the mod-sequence given by a HIGHESTMODSEQ status item, or by a MODSEQ
+// fetch item, which is a list of one number. Returns 0 if it is missing or malformed.
+func parseModSeq(f interface{}) uint64 {
+	if list, ok := f.([]interface{}); ok && len(list) == 1 {
+		f = list[0]
+	}
+	if f == nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(fmt.Sprint(f), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// FETCH with the CHANGEDSINCE modifier, which go-imap does not provide. The server
+// returns only messages whose MODSEQ is higher than ChangedSince.
+type fetchChangedSince struct {
+	commands.Fetch
+	ChangedSince uint64
+}
+
+func (cmd *fetchChangedSince) Command() *imap.Command {
+	c := cmd.Fetch.Command()
+	c.Arguments = append(c.Arguments, []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.ChangedSince, 10))})
+	return c
+}
+
+// Executes the given FETCH command and sends the messages returned to ch, which
+// is closed when done. Works like client.Fetch, but for any fetch command.
+func executeFetch(c *client.Client, cmd imap.Commander, seqset *imap.SeqSet, ch chan *imap.Message) error {
+	defer close(ch)
+	status, err := c.Execute(cmd, &responses.Fetch{Messages: ch, SeqSet: seqset})
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
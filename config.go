@@ -0,0 +1,126 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Settings for one account in the config file
+type ConfigProfile struct {
+	Server   string `toml:"server"`
+	Port     int    `toml:"port"`
+	TLS      string `toml:"tls"`
+	User     string `toml:"user"`
+	Auth     string `toml:"auth"`
+	Password string `toml:"password"`
+	PassFile string `toml:"password-file"`
+	Local    string `toml:"local"`
+}
+
+// Contents of the config file, with a number of named profiles
+type Config struct {
+	DefaultProfile string                   `toml:"default-profile"`
+	Profiles       map[string]ConfigProfile `toml:"profiles"`
+}
+
+// Returns the default location of the config file, or "" if it can't be determined
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-imap-backup", "config.toml")
+}
+
+// Reads the config file, failing on keys it doesn't know
+func ReadConfig(fileName string) (*Config, error) {
+	conf := &Config{}
+	md, err := toml.DecodeFile(fileName, conf)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("%s: unknown keys %s", fileName, strings.Join(keys, ", "))
+	}
+	return conf, nil
+}
+
+// Loads the profile selected with -profile, or the default profile, from the config
+// file given with -c or from the default location, and applies its settings to all
+// flags not given explicitly on the command line. A missing default config file is fine.
+func applyConfig() error {
+	fileName := configFile
+	if fileName == "" {
+		fileName = defaultConfigFile()
+		if _, err := os.Stat(fileName); fileName == "" || os.IsNotExist(err) {
+			if profile != "" {
+				return fmt.Errorf("-profile %s given, but there is no config file", profile)
+			}
+			return nil
+		}
+	}
+	conf, err := ReadConfig(fileName)
+	if err != nil {
+		return err
+	}
+
+	name := profile
+	if name == "" {
+		name = conf.DefaultProfile
+	}
+	if name == "" {
+		return nil
+	}
+	p, ok := conf.Profiles[name]
+	if !ok {
+		return fmt.Errorf("%s: no profile %s", fileName, name)
+	}
+
+	settings := []struct{ flag, value string }{
+		{"s", p.Server},
+		{"tls", p.TLS},
+		{"u", p.User},
+		{"auth", p.Auth},
+		{"P", p.Password},
+		{"P-file", p.PassFile},
+		{"l", p.Local},
+	}
+	if p.Port != 0 {
+		settings = append(settings, struct{ flag, value string }{"p", strconv.Itoa(p.Port)})
+	}
+	for _, s := range settings {
+		if s.value == "" || isFlagSet(s.flag) {
+			continue
+		}
+		if err := flag.Set(s.flag, s.value); err != nil {
+			return fmt.Errorf("%s: profile %s: %w", fileName, name, err)
+		}
+	}
+	return nil
+}
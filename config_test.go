@@ -0,0 +1,65 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleartextProfileNeedsConfirmation(t *testing.T) {
+	defer func(cf, pr, s, tm, u, p string, po int, f bool) {
+		configFile, profile, server, tlsMode, user, pass, port, force = cf, pr, s, tm, u, p, po, f
+	}(configFile, profile, server, tlsMode, user, pass, port, force)
+	newTestStorage(t, formatMbox)
+	configFile = filepath.Join(t.TempDir(), "config.toml")
+	conf := "[profiles.test]\nserver = \"imap.example.com\"\ntls = \"none\"\nuser = \"user\"\npassword = \"secret\"\n"
+	if err := os.WriteFile(configFile, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	profile = "test"
+	if err := applyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if tlsMode != tlsNone {
+		t.Fatalf("got TLS mode %s from profile, want %s", tlsMode, tlsNone)
+	}
+
+	// declining the prompt aborts, -f skips it
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WriteString("n\n")
+	w.Close()
+	os.Stdin = r
+	force = false
+	err = completeFlagsRemote()
+	var fe *fatalError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "did not confirm") {
+		t.Errorf("got %v, want the cleartext connection refused", err)
+	}
+	force = true
+	if err := completeFlagsRemote(); err != nil {
+		t.Errorf("got %v with -f, want no prompt", err)
+	}
+}
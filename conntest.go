@@ -0,0 +1,59 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Prints the negotiated TLS version, the server greeting and capabilities and
+// the number of folders of the connection c, which connect has logged in already.
+// Transfers no messages.
+func cmdTest(c *client.Client, folderNames []string) error {
+	caps, err := c.Capability()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(caps))
+	for name := range caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tlsVersion, greeting := "none", ""
+	if mc := getMonitoredConn(c); mc != nil {
+		if mc.tlsConn != nil {
+			state := mc.tlsConn.ConnectionState()
+			tlsVersion = fmt.Sprintf("%s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		}
+		greeting = mc.Greeting()
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s/%s logged in\n", server, user)
+	fmt.Fprintf(out, "|- TLS: %s\n", tlsVersion)
+	fmt.Fprintf(out, "|- Greeting: %s\n", greeting)
+	fmt.Fprintf(out, "|- Capabilities: %s\n", strings.Join(names, " "))
+	fmt.Fprintf(out, "|- Folders: %d\n", len(folderNames))
+	fmt.Fprintln(out)
+	return nil
+}
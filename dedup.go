@@ -0,0 +1,242 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Scopes for -dedup-scope
+const (
+	dedupFolder  = "folder"  // remove duplicates within each folder
+	dedupAccount = "account" // remove duplicates across all folders
+)
+
+// Duplicate messages of a local folder, found by their Message-ID
+type folderDuplicates struct {
+	name       string
+	duplicates map[uint64]bool // GetUuid() of the messages to remove
+	size       uint64          // total size of the messages to remove
+}
+
+// Removes duplicate messages from the local folders, or those given with -r, keeping
+// the first message with each Message-ID. With -dedup-scope account, the first message
+// in the sorted folders is kept, else the first in each folder. Messages without
+// Message-ID are kept. With -dry-run, only lists the number of duplicates per folder.
+// Records the removed messages in the manifest, so backups skip them.
+func cmdDedup() error {
+	if storageFormat != formatMbox && storageFormat != formatBlob {
+		return fmt.Errorf("dedup supports the mbox and blob formats only, not %s", storageFormat)
+	}
+	if dedupScope != dedupFolder && dedupScope != dedupAccount {
+		return fmt.Errorf("unknown dedup scope %s, use %s or %s", dedupScope, dedupFolder, dedupAccount)
+	}
+	folderNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+
+	// find duplicates first, so the user can confirm before anything is rewritten
+	seen := map[string]bool{}
+	found := []*folderDuplicates{}
+	totalMsgs, totalSize := 0, uint64(0)
+	for _, folderName := range folderNames {
+		if dedupScope == dedupFolder {
+			seen = map[string]bool{}
+		}
+		fd, err := findDuplicates(folderName, seen)
+		if err != nil {
+			return fmt.Errorf("folder %s: %w", folderName, err)
+		}
+		if len(fd.duplicates) == 0 {
+			continue
+		}
+		fmt.Printf("Folder %s: %d duplicates, %s\n", folderName, len(fd.duplicates), humanReadableSize(fd.size))
+		found = append(found, fd)
+		totalMsgs += len(fd.duplicates)
+		totalSize += fd.size
+	}
+	if totalMsgs == 0 {
+		fmt.Printf("No duplicates found in %d folders\n", len(folderNames))
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("Would remove %d duplicate messages, %s, from %d folders\n", totalMsgs, humanReadableSize(totalSize), len(found))
+		return nil
+	}
+	if err := confirm(fmt.Sprintf("Removing %d duplicate messages, %s, from %d folders in %s", totalMsgs,
+		humanReadableSize(totalSize), len(found), localStoragePath)); err != nil {
+		return err
+	}
+
+	// rewrite affected folders in a temporary directory, then move them into place
+	tmpPath := localStoragePath + "/.dedup"
+	defer os.RemoveAll(tmpPath)
+	for _, fd := range found {
+		if err := rewriteFolderWithout(fd, tmpPath); err != nil {
+			return fmt.Errorf("folder %s: %w", fd.name, err)
+		}
+		if err := recordRemoved(fd); err != nil {
+			return fmt.Errorf("folder %s: %w", fd.name, err)
+		}
+	}
+	fmt.Printf("Removed %d duplicate messages, reclaiming %s\n", totalMsgs, humanReadableSize(totalSize))
+	return nil
+}
+
+// Returns the messages of a local folder whose Message-ID is in seen already,
+// or occurs earlier in the folder. Adds the other Message-IDs to seen. Messages
+// without Message-ID or with a header which does not parse are kept.
+func findDuplicates(folderName string, seen map[string]bool) (*folderDuplicates, error) {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &folderDuplicates{name: folderName, duplicates: map[uint64]bool{}}
+	buf := &bytes.Buffer{}
+	for _, mm := range f.Messages {
+		id, err := messageId(lf, mm, buf)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			continue
+		}
+		if seen[id] {
+			fd.duplicates[mm.GetUuid()] = true
+			fd.size += uint64(mm.Size)
+		} else {
+			seen[id] = true
+		}
+	}
+	return fd, nil
+}
+
+// Returns the Message-ID of a message from the index if stored there, else from
+// its header. Returns the empty string if the header has none or does not parse.
+func messageId(lf StorageBackend, mm MessageMeta, buf *bytes.Buffer) (string, error) {
+	if mm.Envelope != nil {
+		return mm.Envelope.MessageId, nil
+	}
+	if err := lf.ReadMessage(mm, buf); err != nil {
+		return "", fmt.Errorf("uid %d: %w", mm.Uid, err)
+	}
+	h, err := textproto.ReadHeader(bufio.NewReader(buf))
+	if err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(h.Get("Message-Id")), nil
+}
+
+// Rewrites a local folder without its duplicates into the given temporary path, then
+// replaces the mailbox or blob file and the index with the rewritten ones. Keeps the
+// compression of the folder, and the metadata of the remaining messages.
+func rewriteFolderWithout(fd *folderDuplicates, tmpPath string) error {
+	blob := storageFormat == formatBlob
+	gz := !blob && isFolderCompressed(localStoragePath, fd.name)
+	lf, err := OpenLocalFolderReadOnly(localStoragePath, fd.name, blob)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return err
+	}
+
+	out, err := openLocalFolderWrite(tmpPath, fd.name, blob, gz, os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	for _, mm := range f.Messages {
+		if fd.duplicates[mm.GetUuid()] {
+			continue
+		}
+		if err := lf.ReadMessage(mm, buf); err != nil {
+			out.Close()
+			return err
+		}
+		from, _ := messageSender(buf.Bytes())
+		if err := out.Append(mm, from, restoreDate(mm, buf.Bytes()), bytes.NewReader(buf.Bytes())); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	out.Close()
+
+	// an interruption between the renames leaves a mismatched index, which reindex rebuilds
+	if err := os.Rename(dataFileName(tmpPath, fd.name, blob, gz), dataFileName(localStoragePath, fd.name, blob, gz)); err != nil {
+		return err
+	}
+	return os.Rename(idxFileName(tmpPath, fd.name), idxFileName(localStoragePath, fd.name))
+}
+
+// Records the messages removed from a folder in the manifest, so that backups do
+// not download them again. Without manifest, as for backups by older versions,
+// they are downloaded again.
+func recordRemoved(fd *folderDuplicates) error {
+	m, err := ReadManifest(localStoragePath)
+	if os.IsNotExist(err) {
+		slog.Warn("No manifest to record removed duplicates in, the next backup downloads them again", "folder", fd.name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if m.Removed == nil {
+		m.Removed = map[string][]uint64{}
+	}
+	removed := m.Removed[fd.name]
+	for uuid := range fd.duplicates {
+		removed = append(removed, uuid)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	m.Removed[fd.name] = removed
+	return m.Write(localStoragePath)
+}
+
+// Returns the messages removed from the given folder by dedup, as recorded in
+// the manifest, which may be nil
+func (m *Manifest) removedMessages(folderName string) *ImapFolderMeta {
+	f := &ImapFolderMeta{Name: folderName}
+	if m == nil {
+		return f
+	}
+	for _, uuid := range m.Removed[folderName] {
+		f.Messages = append(f.Messages, MessageMeta{UidValidity: uint32(uuid >> 32), Uid: uint32(uuid)})
+	}
+	return f
+}
@@ -0,0 +1,70 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDedupRecordsRemovedAndKeepsInternalDate(t *testing.T) {
+	newTestStorage(t, formatMbox)
+	defer func(f bool, scope string) { force, dedupScope = f, scope }(force, dedupScope)
+	force, dedupScope = true, dedupFolder
+	if err := (&Manifest{Server: "imap.example.com", User: "user"}).Write(localStoragePath); err != nil {
+		t.Fatal(err)
+	}
+	storeTestMessages(t, "INBOX", MessageMeta{},
+		"From: a@b.c\r\nMessage-ID: <1@x>\r\nDate: Mon, 1 Jan 2001 00:00:00 +0000\r\n\r\none\r\n",
+		"From: a@b.c\r\nMessage-ID: <1@x>\r\nDate: Mon, 1 Jan 2001 00:00:00 +0000\r\n\r\none again\r\n",
+		"From: a@b.c\r\nMessage-ID: <2@x>\r\nDate: Mon, 1 Jan 2001 00:00:00 +0000\r\n\r\ntwo\r\n")
+
+	if err := cmdDedup(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := os.ReadFile(mboxFileName(localStoragePath, "INBOX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(bs), "From a@b.c Mon May  6 07:08:09 2024\n"); n != 2 {
+		t.Errorf("got %d From lines with the INTERNALDATE, want 2:\n%s", n, bs)
+	}
+
+	// a backup lists all four messages on the server, of which only the new one is missing
+	m, err := ReadManifest(localStoragePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := readLocalIndex("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &ImapFolderMeta{Name: "INBOX", UidValidity: 1}
+	for uid := uint32(1); uid <= 4; uid++ {
+		remote.Messages = append(remote.Messages, MessageMeta{UidValidity: 1, Uid: uid})
+	}
+	remote.Messages, _ = remote.FilterOut(local)
+	remote.Messages, _ = remote.FilterOut(m.removedMessages("INBOX"))
+	if len(remote.Messages) != 1 || remote.Messages[0].Uid != 4 {
+		t.Errorf("backup would download %v, want uid 4 only", remote.Messages)
+	}
+	if f := (*Manifest)(nil).removedMessages("INBOX"); len(f.Messages) != 0 {
+		t.Errorf("got %v without manifest, want none", f.Messages)
+	}
+}
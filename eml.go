@@ -0,0 +1,224 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A local mail folder in eml format, i.e. a directory with one .eml file per
+// message holding its raw bytes, and an index .idx next to the directory
+type EmlFolder struct {
+	Name      string
+	Dir       string
+	Idx       *os.File
+	IdxWriter *bufio.Writer // for writing to the index line by line, in append mode
+	pending   []string      // files written since the last Sync
+	appended  int           // messages appended since opening, for -checkpoint
+}
+
+// Returns the name of the .eml file of a message, relative to the folder directory
+func emlFileName(mm MessageMeta) string {
+	return fmt.Sprintf("%d_%d.eml", mm.UidValidity, mm.Uid)
+}
+
+// Opens an eml folder for reading. Returns an error satisfying os.IsNotExist if there is none.
+func OpenEmlFolderReadOnly(path, folderName string) (ef *EmlFolder, err error) {
+	ef = &EmlFolder{Name: folderName, Dir: localFileName(path, folderName)}
+	if ef.Idx, err = os.Open(idxFileName(path, folderName)); err != nil {
+		return nil, err
+	}
+	return ef, nil
+}
+
+// Opens an eml folder for appending messages, creating it if necessary
+func OpenEmlFolderAppend(path, folderName string) (*EmlFolder, error) {
+	return openEmlFolderWrite(path, folderName, 0)
+}
+
+// Opens an eml folder for writing messages, discarding its previous messages.
+// Leaves nested folders alone.
+func OpenEmlFolderOverwrite(path, folderName string) (*EmlFolder, error) {
+	if _, err := removeEmlFiles(localFileName(path, folderName)); err != nil {
+		return nil, err
+	}
+	return openEmlFolderWrite(path, folderName, os.O_TRUNC)
+}
+
+// Opens an eml folder for appending messages, with additional flags for opening the index
+func openEmlFolderWrite(path, folderName string, flags int) (ef *EmlFolder, err error) {
+	ef = &EmlFolder{Name: folderName, Dir: localFileName(path, folderName)}
+	if err := os.MkdirAll(ef.Dir, 0700); err != nil {
+		return nil, err
+	}
+	ef.Idx, err = os.OpenFile(idxFileName(path, folderName), os.O_APPEND|os.O_CREATE|os.O_WRONLY|flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ef.IdxWriter = bufio.NewWriter(ef.Idx)
+	return ef, nil
+}
+
+// Removes the .eml files in the given directory. Returns their number.
+func removeEmlFiles(dir string) (n int, err error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Removes the messages and index of an eml folder, and its directory if nothing else is left in it
+func removeEmlFolder(path, folderName string) (removed []string, err error) {
+	dir := localFileName(path, folderName)
+	n, err := removeEmlFiles(dir)
+	if err != nil {
+		return removed, err
+	}
+	removed = append(removed, fmt.Sprintf("%d .eml files in %s", n, dir))
+	if err := os.Remove(dir); err == nil {
+		removed = append(removed, dir)
+	}
+	if err := os.Remove(idxFileName(path, folderName)); err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	return append(removed, idxFileName(path, folderName)), nil
+}
+
+// Reads the entire index of the eml folder, and returns it as folder metadata
+func (ef *EmlFolder) ReadAllIndex() (f *ImapFolderMeta, err error) {
+	f = &ImapFolderMeta{Name: ef.Name}
+	scanner := bufio.NewScanner(ef.Idx)
+	scanner.Split(scanCompleteLines)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		mm, err := parseIndexLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", ef.Idx.Name(), lineNo, err.Error())
+		}
+		f.Messages = append(f.Messages, mm)
+		f.UidValidity = mm.UidValidity
+		f.Size += uint64(mm.Size)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reads the given message into the provided buffer
+func (ef *EmlFolder) ReadMessage(mm MessageMeta, buf *bytes.Buffer) error {
+	file, err := os.Open(ef.Dir + "/" + emlFileName(mm))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf.Reset()
+	_, err = buf.ReadFrom(file)
+	return err
+}
+
+// Returns the envelope of the given message from the index, if stored there.
+// Else reads it by parsing only the message header.
+func (ef *EmlFolder) ReadEnvelope(mm MessageMeta) (env MessageEnvelope, err error) {
+	if mm.Envelope != nil {
+		return *mm.Envelope, nil
+	}
+	file, err := os.Open(ef.Dir + "/" + emlFileName(mm))
+	if err != nil {
+		return env, err
+	}
+	defer file.Close()
+	env, err = readEnvelope(bufio.NewReader(file))
+	if err != nil {
+		return env, fmt.Errorf("reading header of message %d in %s: %w", mm.Uid, ef.Name, err)
+	}
+	return env, nil
+}
+
+// Appends a message to the eml folder, writing it to its own file before adding it
+// to the index. A file left behind by an interrupted append is replaced on the next one.
+func (ef *EmlFolder) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	name := ef.Dir + "/" + emlFileName(mm)
+	n, sum, err := writeMessageFile(name, r)
+	if err != nil {
+		return err
+	}
+	ef.pending = append(ef.pending, name)
+
+	mm.Size = uint32(n)
+	mm.Offset = math.MaxUint64
+	if sum != "" {
+		mm.Sha256 = sum
+	}
+	if _, err := fmt.Fprintf(ef.IdxWriter, "%s\n", formatIndexLine(mm)); err != nil {
+		return err
+	}
+	ef.appended++
+	if checkpoint > 0 && ef.appended%checkpoint == 0 {
+		return ef.Sync()
+	}
+	return nil
+}
+
+// Flushes the index writer, so readers of the index see all appended messages
+func (ef *EmlFolder) Flush() error {
+	return ef.IdxWriter.Flush()
+}
+
+// Commits the messages appended since the last call and the index to stable storage.
+// The messages go first, so the index never points at messages not on disk.
+func (ef *EmlFolder) Sync() error {
+	for _, name := range append(ef.pending, ef.Dir) {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	ef.pending = nil
+	if err := ef.Flush(); err != nil {
+		return err
+	}
+	return ef.Idx.Sync()
+}
+
+// Closes an eml folder
+func (ef *EmlFolder) Close() {
+	if ef.IdxWriter != nil {
+		ef.IdxWriter.Flush()
+		ef.IdxWriter = nil
+	}
+	ef.Idx.Close()
+	ef.Idx = nil
+}
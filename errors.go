@@ -0,0 +1,257 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+)
+
+// An error which occurred while authenticating against the IMAP server
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string {
+	return "authentication failed: " + e.err.Error()
+}
+
+func (e *authError) Unwrap() error {
+	return e.err
+}
+
+// An error which retrying the operation will not fix, such as a refusal by the user
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+// An error which persisted through the retries of a single operation, such as
+// downloading a folder. Not retried again by the command loop, which would
+// repeat the same retries with longer delays.
+type retriedError struct {
+	err error
+}
+
+func (e *retriedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retriedError) Unwrap() error {
+	return e.err
+}
+
+// An error indicating that downloading a single message took longer than
+// -msg-timeout. The connection has been terminated, and the message is skipped.
+type msgTimeoutError struct {
+	Uid uint32
+}
+
+func (e *msgTimeoutError) Error() string {
+	return fmt.Sprintf("download of uid %d exceeded the message timeout of %s", e.Uid, msgTimeout)
+}
+
+// A folder which failed with -continue-on-error, and the error it failed with
+type folderFailure struct {
+	Name string
+	Err  error
+}
+
+// Returned with -continue-on-error after all folders were processed, if some failed.
+// Not retried, as the failed folders exhausted their retries already.
+type folderFailuresError struct {
+	Failures []folderFailure
+}
+
+func (e *folderFailuresError) Error() string {
+	return fmt.Sprintf("%d folders failed", len(e.Failures))
+}
+
+// Returned when -max-duration has passed, and the command stopped early
+var errTimeLimit = errors.New("time limit reached")
+
+// Server responses indicating that retrying the same operation will not help
+var fatalErrorTexts = []string{
+	"authenticationfailed",
+	"authentication failed",
+	"authorizationfailed",
+	"invalid credentials",
+	"login failed",
+	"login is disabled",
+	"noperm",
+	"permission denied",
+}
+
+// Server responses indicating missing access rights, e.g. due to ACLs
+var permissionErrorTexts = []string{
+	"noperm",
+	"permission denied",
+	"access denied",
+	"not allowed",
+}
+
+// Server responses and local errors indicating a transient network problem
+var transientErrorTexts = []string{
+	"connection closed",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+}
+
+// Returns true if err indicates a transient network problem,
+// such as a timeout, a dropped connection or a premature end of file.
+// Expired operation timeouts count as network errors too, local file errors don't.
+func isNetworkError(err error) bool {
+	var pathErr *fs.PathError // wraps a syscall.Errno, which satisfies net.Error
+	if errors.As(err, &pathErr) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, t := range transientErrorTexts {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server responses indicating that a mailbox does not exist. Dovecot says
+// "Mailbox doesn't exist", others use the NONEXISTENT response code of RFC 5530.
+var noMailboxErrorTexts = []string{
+	"doesn't exist",
+	"does not exist",
+	"no such mailbox",
+	"nonexistent",
+	"unknown mailbox",
+}
+
+// Returns true if err indicates that a mailbox does not exist
+func isNoSuchMailbox(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, t := range noMailboxErrorTexts {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if err indicates that the server's TLS certificate failed verification
+func isCertificateError(err error) bool {
+	var uae x509.UnknownAuthorityError
+	var he x509.HostnameError
+	var cie x509.CertificateInvalidError
+	return errors.As(err, &uae) || errors.As(err, &he) || errors.As(err, &cie)
+}
+
+// Adds a hint on trusting the server's certificate to certificate errors
+func withCertificateHint(err error) error {
+	if isCertificateError(err) {
+		return fmt.Errorf("%w, use -cacert to trust a self-signed certificate", err)
+	}
+	return err
+}
+
+// Returns true if err indicates missing access rights to a mailbox
+func isPermissionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, t := range permissionErrorTexts {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the operation which failed with err should be retried.
+// Network errors are retried, authentication and permission failures are not.
+// Unknown errors are retried, to remain on the safe side for flaky servers.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isCertificateError(err) || errors.Is(err, errTimeLimit) {
+		return false
+	}
+	if isNetworkError(err) {
+		return true
+	}
+	var ae *authError
+	if errors.As(err, &ae) {
+		return false
+	}
+	var fe *fatalError
+	if errors.As(err, &fe) {
+		return false
+	}
+	var ffe *folderFailuresError
+	if errors.As(err, &ffe) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, t := range fatalErrorTexts {
+		if strings.Contains(msg, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Exit statuses, for scripts to tell the cause of a failure
+const (
+	exitFailure = 1 // any other error, e.g. a server or local storage error
+	exitUsage   = 2 // invalid command line, flags or config file
+	exitAuth    = 3 // authentication failed
+	exitNetwork = 4 // network errors persisted through all retries
+	exitPartial = 5 // time limit reached, or folders failed with -continue-on-error
+)
+
+// Returns the exit status for the error which ended the run
+func exitStatus(err error) int {
+	var ae *authError
+	var ffe *folderFailuresError
+	switch {
+	case errors.As(err, &ae):
+		return exitAuth
+	case errors.Is(err, errTimeLimit), errors.As(err, &ffe):
+		return exitPartial
+	case isNetworkError(err):
+		return exitNetwork
+	default:
+		return exitFailure
+	}
+}
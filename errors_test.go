@@ -0,0 +1,108 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// Returns the error of a tagged NO or BAD response of the server, as go-imap reports it
+func statusError(typ imap.StatusRespType, info string) error {
+	return (&imap.StatusResp{Type: typ, Info: info}).Err()
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		network   bool
+		retryable bool
+		status    int
+	}{
+		{"auth", &authError{statusError(imap.StatusRespNo, "[AUTHENTICATIONFAILED] Invalid credentials")}, false, false, exitAuth},
+		{"auth text", statusError(imap.StatusRespNo, "LOGIN failed."), false, false, exitFailure},
+		{"tls unknown authority", fmt.Errorf("dialing: %w", x509.UnknownAuthorityError{}), false, false, exitFailure},
+		{"tls hostname", &net.OpError{Op: "remote error", Err: x509.HostnameError{Host: "imap.example.com"}}, true, false, exitNetwork},
+		{"network reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true, true, exitNetwork},
+		{"network eof", fmt.Errorf("fetching: %w", io.ErrUnexpectedEOF), true, true, exitNetwork},
+		{"network deadline", fmt.Errorf("select: %w", context.DeadlineExceeded), true, true, exitNetwork},
+		{"network text", statusError(imap.StatusRespNo, "imap: connection closed during command execution"), true, true, exitNetwork},
+		{"local file", &fs.PathError{Op: "write", Path: "INBOX.mbox", Err: syscall.ENOSPC}, false, true, exitFailure},
+		{"server no", statusError(imap.StatusRespNo, "[SERVERBUG] Internal error occurred"), false, true, exitFailure},
+		{"server bad", statusError(imap.StatusRespBad, "Error in IMAP command UID FETCH: Invalid messageset"), false, true, exitFailure},
+		{"server no permission", statusError(imap.StatusRespNo, "[NOPERM] Permission denied"), false, false, exitFailure},
+		{"fatal", &fatalError{errors.New("refused by user")}, false, false, exitFailure},
+		{"time limit", fmt.Errorf("backup: %w", errTimeLimit), false, false, exitPartial},
+		{"folder failures", &folderFailuresError{[]folderFailure{{"INBOX", io.EOF}}}, false, false, exitPartial},
+	} {
+		if got := isNetworkError(tc.err); got != tc.network {
+			t.Errorf("%s: isNetworkError(%v) = %t, want %t", tc.name, tc.err, got, tc.network)
+		}
+		if got := isRetryable(tc.err); got != tc.retryable {
+			t.Errorf("%s: isRetryable(%v) = %t, want %t", tc.name, tc.err, got, tc.retryable)
+		}
+		if got := exitStatus(tc.err); got != tc.status {
+			t.Errorf("%s: exitStatus(%v) = %d, want %d", tc.name, tc.err, got, tc.status)
+		}
+	}
+}
+
+func TestMailboxErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		info       string
+		noMailbox  bool
+		permission bool
+	}{
+		{"Mailbox doesn't exist: Archive", true, false},
+		{"[NONEXISTENT] Unknown Mailbox: Archive (Failure)", true, false},
+		{"[NOPERM] Permission denied", false, true},
+		{"[ACCESS DENIED] Access denied", false, true},
+		{"[SERVERBUG] Internal error occurred", false, false},
+	} {
+		err := statusError(imap.StatusRespNo, tc.info)
+		if got := isNoSuchMailbox(err); got != tc.noMailbox {
+			t.Errorf("isNoSuchMailbox(%q) = %t, want %t", tc.info, got, tc.noMailbox)
+		}
+		if got := isPermissionError(err); got != tc.permission {
+			t.Errorf("isPermissionError(%q) = %t, want %t", tc.info, got, tc.permission)
+		}
+	}
+}
+
+func TestCertificateErrorsGetHint(t *testing.T) {
+	err := withCertificateHint(fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}))
+	if !isCertificateError(err) {
+		t.Errorf("hint hides the certificate error %v", err)
+	}
+	if want := "use -cacert"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q, want a hint on %s", err, want)
+	}
+	if err := withCertificateHint(io.EOF); err != io.EOF {
+		t.Errorf("got %v for an error unrelated to certificates", err)
+	}
+}
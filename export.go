@@ -0,0 +1,133 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// Exports the local folders, or those given with -r, to mbox files with index in
+// the directory given with -export-dir. Works from any storage format, e.g. to give
+// mbox readers access to a backup in blob format.
+func cmdExportMbox() error {
+	if exportDir == "" {
+		return fmt.Errorf("export-mbox needs the target directory, given with -export-dir")
+	}
+	if filepath.Clean(exportDir) == filepath.Clean(localStoragePath) {
+		return fmt.Errorf("export directory must differ from the local storage path %s", localStoragePath)
+	}
+	folderNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+
+	// record the origin of the exported messages, so the export can serve as mbox backup
+	if m, err := ReadManifest(localStoragePath); err == nil {
+		m.Format, m.Mbox = formatMbox, exportMboxVariant()
+		if err := m.Write(exportDir); err != nil {
+			return err
+		}
+	}
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Export"), pb.OptionSetVisibility(showProgress))
+	totalMsgs, totalSize := 0, uint64(0)
+	buf := &bytes.Buffer{}
+	for _, folderName := range folderNames {
+		bar.Describe("Export " + folderName)
+		n, size, err := exportFolder(folderName, buf)
+		if err != nil {
+			return err
+		}
+		totalMsgs += n
+		totalSize += size
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Exported %d folders with %d messages, %s, to %s\n", len(folderNames), totalMsgs,
+		humanReadableSize(totalSize), exportDir)
+	return nil
+}
+
+// Returns the mbox variant to export to, as given by -mbox-variant, else mboxrd
+func exportMboxVariant() string {
+	if mboxVariantFlag == mboxAuto {
+		return mboxRd
+	}
+	return mboxVariantFlag
+}
+
+// Exports a single local folder to an mbox file with index in the export directory,
+// replacing a previous export. Returns the number and total size of messages exported.
+func exportFolder(folderName string, buf *bytes.Buffer) (n int, size uint64, err error) {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	out, err := OpenLocalFolderOverwrite(exportDir, folderName, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+	out.Variant = exportMboxVariant() // regardless of the variant of the local storage
+
+	for _, mm := range f.Messages {
+		if err := lf.ReadMessage(mm, buf); err != nil {
+			return n, size, err
+		}
+		from, date := messageSender(buf.Bytes())
+		if !mm.InternalDate.IsZero() {
+			date = mm.InternalDate
+		}
+		if err := out.Append(mm, from, date, bytes.NewReader(buf.Bytes())); err != nil {
+			return n, size, err
+		}
+		n++
+		size += uint64(buf.Len())
+	}
+	return n, size, out.Sync()
+}
+
+// Returns the sender address and date of a message for its mbox From line,
+// as far as they can be parsed from the message header
+func messageSender(bs []byte) (from string, date time.Time) {
+	r, err := mail.CreateReader(bytes.NewReader(bs))
+	if err != nil {
+		return "", time.Time{}
+	}
+	defer r.Close()
+	if addrs, err := r.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+		from = addrs[0].Address
+	}
+	date, _ = r.Header.Date() // leave zero if missing or malformed
+	return from, date
+}
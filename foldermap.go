@@ -0,0 +1,106 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Parses a comma-separated list of old=new folder mappings for restore, as given with -map
+func parseFolderMap(separated string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, entry := range strings.Split(separated, ",") {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("-map: %q is not of the form old=new", entry)
+		}
+		from, to := entry[:i], entry[i+1:]
+		if _, ok := res[from]; ok {
+			return nil, fmt.Errorf("-map: folder %s is mapped twice", from)
+		}
+		res[from] = to
+	}
+	return res, nil
+}
+
+// Returns the server folder to restore the local folder of the given name into. Folders
+// mapped with -map and their subfolders go to the new name, with the longest mapping
+// winning, all others keep their name. srcDelim is the hierarchy delimiter of local
+// folder names, dstDelim that of the server.
+func restoreTargetName(name, srcDelim, dstDelim string) string {
+	if srcDelim == "" {
+		srcDelim = dstDelim // older manifests don't record it
+	}
+	best := ""
+	for from := range folderMap {
+		if (name == from || strings.HasPrefix(name, from+srcDelim)) && len(from) > len(best) {
+			best = from
+		}
+	}
+	if best == "" {
+		return convertDelimiter(name, srcDelim, dstDelim)
+	}
+	if name == best {
+		return folderMap[best]
+	}
+	return folderMap[best] + dstDelim + convertDelimiter(name[len(best)+len(srcDelim):], srcDelim, dstDelim)
+}
+
+// Returns the key by which messages from local folders restored into the same server
+// folder are recognized as the same message: its Message-ID, or for messages without
+// one, the SHA-256 of the message. UIDs do not serve, as they differ between folders.
+func restoreMergeKey(lf StorageBackend, mm MessageMeta, buf *bytes.Buffer) (string, error) {
+	id, err := messageId(lf, mm, buf)
+	if err != nil || id != "" {
+		return id, err
+	}
+	if mm.Sha256 != "" {
+		return mm.Sha256, nil
+	}
+	if err := lf.ReadMessage(mm, buf); err != nil {
+		return "", fmt.Errorf("uid %d: %w", mm.Uid, err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Filters out the messages of a local folder which are uploaded from another local
+// folder restored into the same server folder, whose keys are in seen, and adds the
+// keys of this folder to seen. Copies within the folder itself are all kept.
+// Returns the remaining messages and their total size in bytes.
+func filterMerged(lf StorageBackend, messages []MessageMeta, seen map[string]bool) (res []MessageMeta, size uint64, err error) {
+	buf := &bytes.Buffer{}
+	keys := make([]string, len(messages))
+	res = []MessageMeta{}
+	for i, mm := range messages {
+		if keys[i], err = restoreMergeKey(lf, mm, buf); err != nil {
+			return nil, 0, err
+		}
+		if !seen[keys[i]] {
+			res = append(res, mm)
+			size += uint64(mm.Size)
+		}
+	}
+	for _, key := range keys {
+		seen[key] = true
+	}
+	return res, size, nil
+}
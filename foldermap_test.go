@@ -0,0 +1,92 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilterMergedByMessageIdOrContents(t *testing.T) {
+	for _, format := range []string{formatMbox, formatBlob, formatMaildir, formatEml} {
+		newTestStorage(t, format)
+		storeTestMessages(t, "Sent", MessageMeta{},
+			"Message-ID: <1@x>\r\n\r\none\r\n",
+			"Subject: no id\r\n\r\ntwo\r\n",
+			"Message-ID: <3@x>\r\n\r\nthree\r\n")
+		storeTestMessages(t, "Sent Items", MessageMeta{UidValidity: 2},
+			"Message-ID: <1@x>\r\n\r\none, as rewritten by another client\r\n",
+			"Subject: no id\r\n\r\ntwo\r\n",
+			"Subject: no id\r\n\r\nfour\r\n",
+			"Subject: no id\r\n\r\nfour\r\n",
+			"Message-ID: <3@x>\r\n\r\nthree\r\n")
+
+		seen := map[string]bool{}
+		for _, tc := range []struct {
+			folder string
+			uids   []uint32
+		}{
+			{"Sent", []uint32{1, 2, 3}},
+			{"Sent Items", []uint32{3, 4}}, // copies within a folder are kept
+		} {
+			lf, err := OpenStorageReadOnly(localStoragePath, tc.folder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := lf.ReadAllIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := filterMerged(lf, f.Messages, seen)
+			lf.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			uids := []uint32{}
+			for _, mm := range res {
+				uids = append(uids, mm.Uid)
+			}
+			if fmt.Sprint(uids) != fmt.Sprint(tc.uids) {
+				t.Errorf("%s %s: got uids %v, want %v", format, tc.folder, uids, tc.uids)
+			}
+		}
+	}
+}
+
+func TestRestoreTargetNameConvertsDelimiter(t *testing.T) {
+	defer func(m map[string]string) { folderMap = m }(folderMap)
+	folderMap = map[string]string{"INBOX.Old": "Archive/Old mail", "Sent": "[Gmail]/Sent Mail"}
+	for _, tc := range []struct {
+		name, srcDelim, dstDelim, want string
+	}{
+		// from a Dovecot server to Gmail
+		{"INBOX.Work.2024", ".", "/", "INBOX/Work/2024"},
+		{"INBOX.Old", ".", "/", "Archive/Old mail"},
+		{"INBOX.Old.2020", ".", "/", "Archive/Old mail/2020"},
+		{"INBOX.Older", ".", "/", "INBOX/Older"},
+		// from Gmail to a Dovecot server
+		{"Sent", "/", ".", "[Gmail]/Sent Mail"},
+		{"Sent/2024", "/", ".", "[Gmail]/Sent Mail.2024"},
+		// older manifests don't record the delimiter, which is then taken as the server's
+		{"Work/2024", "", "/", "Work/2024"},
+		{"Work/2024", "/", "", "Work/2024"},
+	} {
+		if got := restoreTargetName(tc.name, tc.srcDelim, tc.dstDelim); got != tc.want {
+			t.Errorf("%s from %q to %q: got %s, want %s", tc.name, tc.srcDelim, tc.dstDelim, got, tc.want)
+		}
+	}
+}
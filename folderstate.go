@@ -0,0 +1,106 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// State of a folder on the server as of its last complete backup. The server
+// assigns UIDs in ascending order below UIDNEXT, so a folder with the same
+// UIDVALIDITY and UIDNEXT has no new messages since.
+type FolderState struct {
+	UidValidity   uint32 `json:"uidValidity"`
+	UidNext       uint32 `json:"uidNext"`
+	HighestModSeq uint64 `json:"highestModSeq,omitempty"` // on servers with CONDSTORE
+}
+
+// Returns the given folders without those which have no new messages since their
+// last complete backup according to the manifest, as found by a cheap STATUS
+// command. Folders without recorded state, or without local backup, are kept.
+func filterUnchangedFolders(c *client.Client, m *Manifest, folderNames []string) (changed, unchanged []string, err error) {
+	if m == nil || len(m.Folders) == 0 || overwrite {
+		return folderNames, nil, nil
+	}
+	items := []imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity}
+	for _, folderName := range folderNames {
+		state, ok := m.Folders[folderName]
+		if ok {
+			ctx, cancel := newOpContext()
+			status, err := statusWithContext(ctx, c, folderName, items)
+			cancel()
+			if err != nil && continueOnError && !isNetworkError(err) {
+				changed = append(changed, folderName) // listing it fails and records the error
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+			ok = status.UidNext != 0 && status.UidValidity == state.UidValidity && status.UidNext == state.UidNext
+		}
+		if ok && hasLocalFolder(folderName) {
+			unchanged = append(unchanged, folderName)
+		} else {
+			changed = append(changed, folderName)
+		}
+	}
+	return changed, unchanged, nil
+}
+
+// Returns whether the given folder has a local backup
+func hasLocalFolder(folderName string) bool {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if err != nil {
+		return false
+	}
+	lf.Close()
+	return true
+}
+
+// Returns the state of the given folder as of its last complete backup, from which
+// on only changed messages need to be listed, or a zero state to list all messages
+func listingState(m *Manifest, folderName string) FolderState {
+	if m == nil || overwrite || !hasLocalFolder(folderName) {
+		return FolderState{}
+	}
+	return m.Folders[folderName]
+}
+
+// Returns the status of the given folder, terminating the connection if the context expires
+func statusWithContext(ctx context.Context, c *client.Client, folderName string, items []imap.StatusItem) (status *imap.MailboxStatus, err error) {
+	defer watchContext(ctx, c, &err)()
+	return c.Status(folderName, items)
+}
+
+// Records in the manifest that the given folder was backed up completely,
+// as of the UIDNEXT seen when listing its messages. Failures only cost
+// the shortcut on the next backup, so they are logged and not returned.
+func recordFolderState(m *Manifest, f *ImapFolderMeta) {
+	if m == nil || f.UidNext == 0 {
+		return
+	}
+	if m.Folders == nil {
+		m.Folders = map[string]FolderState{}
+	}
+	m.Folders[f.Name] = FolderState{UidValidity: f.UidValidity, UidNext: f.UidNext, HighestModSeq: f.HighestModSeq}
+	if err := m.Write(localStoragePath); err != nil {
+		slog.Warn("Unable to record folder state in manifest", "folder", f.Name, "err", err)
+	}
+}
@@ -0,0 +1,148 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupSkipsUnchangedFolders(t *testing.T) {
+	defer func(w io.Writer, o bool) { out, overwrite = w, o }(out, overwrite)
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	for _, folder := range []string{"Stable", "Busy", "Moved"} {
+		appendTestMessage(t, c, folder, nil, time.Now(), "Subject: 1\r\n\r\none\r\n")
+	}
+	if err := cmdBackup(c, []string{"Stable", "Busy", "Moved"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(localStoragePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m.Folders["Stable"]; state.UidNext != 2 || state.UidValidity == 0 {
+		t.Fatalf("got state %+v, want UIDNEXT 2", state)
+	}
+
+	// new mail in Busy, Moved recreated with another UIDVALIDITY
+	appendTestMessage(t, c, "Busy", nil, time.Now(), "Subject: 2\r\n\r\ntwo\r\n")
+	state := m.Folders["Moved"]
+	state.UidValidity++
+	m.Folders["Moved"] = state
+	appendTestMessage(t, c, "New", nil, time.Now(), "Subject: 1\r\n\r\none\r\n")
+
+	changed, unchanged, err := filterUnchangedFolders(c, m, []string{"Stable", "Busy", "Moved", "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changed) != "[Busy Moved New]" || fmt.Sprint(unchanged) != "[Stable]" {
+		t.Errorf("got changed %v and unchanged %v", changed, unchanged)
+	}
+
+	// without local backup, or with -overwrite, the state does not count
+	if _, err := RemoveStorage(localStoragePath, "Stable"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _, _ := filterUnchangedFolders(c, m, []string{"Stable"}); fmt.Sprint(changed) != "[Stable]" {
+		t.Errorf("got changed %v without local backup", changed)
+	}
+	overwrite = true
+	if changed, _, _ := filterUnchangedFolders(c, m, []string{"Busy"}); fmt.Sprint(changed) != "[Busy]" {
+		t.Errorf("got changed %v with -overwrite", changed)
+	}
+	overwrite = false
+
+	// the next backup skips the unchanged folder and picks up the new mail
+	if err := m.Write(localStoragePath); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	out = buf
+	if err := cmdBackup(c, []string{"Busy", "Moved"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Skipping") {
+		t.Errorf("skipped changed folders: %q", buf.String())
+	}
+	buf.Reset()
+	if err := cmdBackup(c, []string{"Busy", "Moved"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Skipping 2 folders unchanged") {
+		t.Errorf("got %q, want both folders skipped", buf.String())
+	}
+	lf, err := OpenStorageReadOnly(localStoragePath, "Busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	if f, err := lf.ReadAllIndex(); err != nil || len(f.Messages) != 2 {
+		t.Errorf("got %v, %v, want 2 messages in Busy", f, err)
+	}
+}
+
+func TestBackupOfOtherAccountNeedsForce(t *testing.T) {
+	defer func(f bool) { force = f }(force)
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	for i := 1; i <= 3; i++ {
+		appendTestMessage(t, c, "Work", nil, time.Now(), fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i))
+	}
+	f, err := NewImapFolderMeta(context.Background(), c, "Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestMessages(t, "Work", MessageMeta{UidValidity: f.UidValidity}, "Subject: 1\r\n\r\nbody\r\n")
+	other := &Manifest{Server: "imap.example.com", User: "other",
+		Folders: map[string]FolderState{"Work": {UidValidity: f.UidValidity, UidNext: f.UidNext}},
+		Removed: map[string][]uint64{"Work": {f.Messages[1].GetUuid()}}}
+	if err := other.Write(localStoragePath); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(localStoragePath + "/" + manifestFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	force = false
+	err = cmdBackup(c, []string{"Work"})
+	var fe *fatalError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), "contains a backup of imap.example.com/other, not of 127.0.0.1/username, use -f") {
+		t.Fatalf("got %v, want a fatal error naming both accounts", err)
+	}
+
+	// forced, the folder state of the other account does not skip the folder, the
+	// message removed by dedup stays out, and the manifest is left unchanged
+	force = true
+	if err := cmdBackup(c, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	if local, err := readLocalIndex("Work"); err != nil || len(local.Messages) != 2 || local.Messages[1].Uid != f.Messages[2].Uid {
+		t.Errorf("got %v, %v, want the third message added", local, err)
+	}
+	if after, err := os.ReadFile(localStoragePath + "/" + manifestFileName); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("manifest changed to %s, %v", after, err)
+	}
+}
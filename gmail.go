@@ -0,0 +1,206 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Capability of Gmail's IMAP extensions, and the fetch and store item for labels
+const (
+	gmailCapability                = "X-GM-EXT-1"
+	gmailLabelsItem imap.FetchItem = "X-GM-LABELS"
+)
+
+// Warns once per run that -gmail-labels has no effect
+var warnNoGmail sync.Once
+
+// Returns whether to back up and restore Gmail labels, i.e. if -gmail-labels
+// is given and the server supports Gmail's extensions
+func useGmailLabels(c *client.Client) bool {
+	if !gmailLabels {
+		return false
+	}
+	ok, err := c.Support(gmailCapability)
+	if err != nil || !ok {
+		warnNoGmail.Do(func() {
+			slog.Warn("Server does not support " + gmailCapability + ", ignoring -gmail-labels")
+		})
+		return false
+	}
+	return true
+}
+
+// Returns the Gmail labels of a fetched message, decoded from modified UTF-7,
+// or nil if they were not fetched
+func parseGmailLabels(msg *imap.Message) []string {
+	labels, err := imap.ParseStringList(msg.Items[gmailLabelsItem])
+	if err != nil {
+		return nil
+	}
+	for i, l := range labels {
+		if decoded, err := utf7.Encoding.NewDecoder().String(l); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return labels
+}
+
+// Adds the stored Gmail labels to the given messages restored into a folder. Finds
+// each message by its Message-ID, as APPEND does not return its UID. Messages
+// without Message-ID or labels are left alone.
+func applyGmailLabels(c *client.Client, folder string, msgs []MessageMeta) error {
+	if _, err := c.Select(folder, false); err != nil {
+		return err
+	}
+	for _, mm := range msgs {
+		if len(mm.Labels) == 0 || mm.Envelope == nil || mm.Envelope.MessageId == "" {
+			continue
+		}
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Add("Message-Id", mm.Envelope.MessageId)
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			slog.Warn("Restored message not found, not adding labels", "folder", folder, "uid", mm.Uid, "messageId", mm.Envelope.MessageId)
+			continue
+		}
+
+		// system labels such as \Inbox are atoms, others strings. go-imap's UidStore
+		// would send all of them as atoms, breaking labels with spaces.
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uids...)
+		labels := make([]interface{}, len(mm.Labels))
+		for i, l := range mm.Labels {
+			if strings.HasPrefix(l, "\\") {
+				labels[i] = imap.RawString(l)
+			} else {
+				labels[i], _ = utf7.Encoding.NewEncoder().String(l)
+			}
+		}
+		cmd := &commands.Uid{Cmd: &commands.Store{SeqSet: seqset, Item: "+" + imap.StoreItem(gmailLabelsItem), Value: labels}}
+		status, err := c.Execute(cmd, nil)
+		if err == nil {
+			err = status.Err()
+		}
+		if isNetworkError(err) {
+			return err
+		} else if err != nil {
+			slog.Warn("Server rejected labels", "folder", folder, "uid", mm.Uid, "labels", strings.Join(mm.Labels, ", "), "err", err)
+		}
+	}
+	return nil
+}
+
+// Warns once per run that -skip-all-mail has no effect
+var warnNoGmailSkip sync.Once
+
+// Returns the special-use attributes of the Gmail folders which matter for
+// backups: All Mail, Important and Starred, which are virtual views of the
+// messages of other folders, and Spam and Trash, which All Mail does not contain
+func listGmailSpecialFolders(c *client.Client) (map[string]string, error) {
+	mailboxesCh := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxesCh)
+	}()
+
+	special := map[string]string{}
+	for m := range mailboxesCh {
+		for _, attr := range m.Attributes {
+			switch attr {
+			case imap.AllAttr, imap.ImportantAttr, imap.FlaggedAttr, imap.JunkAttr, imap.TrashAttr:
+				special[m.Name] = attr
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return special, nil
+}
+
+// Returns whether a Gmail folder with the given special-use attribute is a virtual view
+func isGmailVirtual(attr string) bool {
+	return attr == imap.AllAttr || attr == imap.ImportantAttr || attr == imap.FlaggedAttr
+}
+
+// Selects the folders to back up on Gmail, where All Mail, Important and Starred
+// show messages of other folders once more. Skips these with -skip-all-mail. With
+// -gmail-labels, backs up All Mail as the single copy of all messages instead,
+// along with Spam and Trash which it does not contain. Otherwise warns if virtual
+// and other folders are backed up together. Leaves other servers alone.
+func gmailBackupFolders(c *client.Client, folderNames []string) ([]string, error) {
+	if ok, err := c.Support(gmailCapability); err != nil || !ok {
+		if skipAllMail {
+			warnNoGmailSkip.Do(func() {
+				slog.Warn("Server does not support " + gmailCapability + ", ignoring -skip-all-mail")
+			})
+		}
+		return folderNames, err
+	}
+	special, err := listGmailSpecialFolders(c)
+	if err != nil {
+		return nil, err
+	}
+
+	allMail := ""
+	virtual, others := []string{}, 0
+	for _, name := range folderNames {
+		if special[name] == imap.AllAttr {
+			allMail = name
+		}
+		if isGmailVirtual(special[name]) {
+			virtual = append(virtual, name)
+		} else {
+			others++
+		}
+	}
+	if len(virtual) == 0 || others == 0 {
+		return folderNames, nil
+	}
+
+	res := make([]string, 0, len(folderNames))
+	for _, name := range folderNames {
+		switch {
+		case skipAllMail && isGmailVirtual(special[name]):
+		case !skipAllMail && gmailLabels && allMail != "" && name != allMail &&
+			special[name] != imap.JunkAttr && special[name] != imap.TrashAttr:
+		default:
+			res = append(res, name)
+		}
+	}
+	if skipAllMail {
+		fmt.Fprintf(out, "Skipping %d Gmail folders which show messages of other folders: %s\n", len(virtual), strings.Join(virtual, ", "))
+	} else if gmailLabels && allMail != "" {
+		fmt.Fprintf(out, "Skipping %d Gmail folders, their messages are backed up from %s with their labels\n", len(folderNames)-len(res), allMail)
+	} else {
+		slog.Warn(fmt.Sprintf("%s show the messages of the %d other folders once more, backing up all of them stores most messages several times. "+
+			"Use -skip-all-mail, or -r '[Gmail]/All Mail' -gmail-labels to store each message once", strings.Join(virtual, ", "), others))
+	}
+	return res, nil
+}
@@ -1,20 +1,22 @@
 module github.com/mlnoga/go-imap-backup
 
-go 1.17
+go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-message v0.16.0
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/schollz/progressbar/v3 v3.12.1
+	golang.org/x/net v0.1.0
 	golang.org/x/term v0.1.0
+	golang.org/x/text v0.4.0
 )
 
 require (
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
 	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.2 // indirect
 	golang.org/x/sys v0.1.0 // indirect
-	golang.org/x/text v0.3.8 // indirect
 )
@@ -0,0 +1,179 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// A network connection which records the number of bytes read and the time
+// of the last read, for monitoring the health of long downloads
+type monitoredConn struct {
+	net.Conn
+	bytesRead uint64       // accessed atomically
+	lastRead  int64        // unix nanoseconds, accessed atomically
+	tapping   int32        // 1 if lines read are logged, accessed atomically
+	partial   []byte       // incomplete line read while tapping
+	greeting  atomic.Value // first line read while tapping, the server greeting
+	tlsConn   *tls.Conn    // TLS connection below the client, if any, set by connect
+}
+
+func newMonitoredConn(conn net.Conn) *monitoredConn {
+	return &monitoredConn{Conn: conn, lastRead: time.Now().UnixNano()}
+}
+
+func (mc *monitoredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&mc.bytesRead, uint64(n))
+		atomic.StoreInt64(&mc.lastRead, time.Now().UnixNano())
+		if atomic.LoadInt32(&mc.tapping) != 0 {
+			mc.tap(b[:n])
+		}
+	}
+	return n, err
+}
+
+// Returns the total number of bytes read so far, and the time of the last read
+func (mc *monitoredConn) Stats() (bytesRead uint64, lastRead time.Time) {
+	return atomic.LoadUint64(&mc.bytesRead), time.Unix(0, atomic.LoadInt64(&mc.lastRead))
+}
+
+// Monitored connections of the clients opened by connect()
+var monitoredConns = map[*client.Client]*monitoredConn{}
+var monitoredConnsMutex sync.Mutex
+
+// Registers the monitored connection of a client
+func setMonitoredConn(c *client.Client, mc *monitoredConn) {
+	monitoredConnsMutex.Lock()
+	defer monitoredConnsMutex.Unlock()
+	monitoredConns[c] = mc
+}
+
+// Forgets the monitored connection of a client which has logged out
+func forgetMonitoredConn(c *client.Client) {
+	monitoredConnsMutex.Lock()
+	defer monitoredConnsMutex.Unlock()
+	delete(monitoredConns, c)
+}
+
+// Returns the monitored connection of a client, or nil if there is none
+func getMonitoredConn(c *client.Client) *monitoredConn {
+	monitoredConnsMutex.Lock()
+	defer monitoredConnsMutex.Unlock()
+	return monitoredConns[c]
+}
+
+// An error indicating that no data arrived for longer than -stall-timeout,
+// upon which the connection was terminated
+type stallError struct {
+	since time.Duration
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("connection stalled, no data received for %s", e.since.Round(time.Second))
+}
+
+// Periodically logs throughput and connection health while downloading a folder,
+// and terminates the connection if it stalls for longer than -stall-timeout
+type healthMonitor struct {
+	MessageAppender
+	folder   string
+	messages uint64 // accessed atomically
+	stalled  time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Starts monitoring the download of a folder over the given client's connection,
+// if -health-interval or -stall-timeout are set. Messages must be appended via the
+// returned monitor, which counts them. The returned function stops monitoring, and
+// replaces a non-nil *err with a stallError if the connection stalled.
+func startHealthMonitor(c *client.Client, folder string, lf MessageAppender, err *error) (h *healthMonitor, stop func()) {
+	h = &healthMonitor{MessageAppender: lf, folder: folder, done: make(chan struct{})}
+	mc := getMonitoredConn(c)
+	if mc == nil || (healthInterval == 0 && stallTimeout == 0) {
+		return h, func() {}
+	}
+
+	interval := healthInterval
+	if interval == 0 || (stallTimeout > 0 && stallTimeout/4 < interval) {
+		interval = stallTimeout / 4
+	}
+	h.wg.Add(1)
+	go h.run(c, mc, interval)
+
+	return h, func() {
+		close(h.done)
+		h.wg.Wait()
+		if *err != nil && h.stalled > 0 {
+			*err = &stallError{h.stalled}
+		}
+	}
+}
+
+func (h *healthMonitor) run(c *client.Client, mc *monitoredConn, interval time.Duration) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prevBytes, _ := mc.Stats()
+	start := time.Now()
+	prevTime, lastLog := start, start
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			bytesRead, lastRead := mc.Stats()
+			if lastRead.Before(start) {
+				lastRead = start // the connection may have been idle before the download
+			}
+			idle := now.Sub(lastRead)
+			if stallTimeout > 0 && idle > stallTimeout {
+				slog.Warn("No data received, reconnecting", "folder", h.folder, "idle", idle.Round(time.Second))
+				h.stalled = idle
+				c.Terminate()
+				return
+			}
+			if healthInterval > 0 && now.Sub(lastLog) >= healthInterval {
+				rate := float64(bytesRead-prevBytes) / now.Sub(prevTime).Seconds()
+				slog.Info("Download health", "folder", h.folder, "rate", humanReadableSize(uint64(rate))+"/s",
+					"messages", atomic.LoadUint64(&h.messages), "idle", idle.Round(time.Second))
+				prevBytes, prevTime, lastLog = bytesRead, now, now
+			}
+		}
+	}
+}
+
+// Appends a message to the monitored destination, counting it
+func (h *healthMonitor) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	if err := h.MessageAppender.Append(mm, from, when, r); err != nil {
+		return err
+	}
+	atomic.AddUint64(&h.messages, 1)
+	return nil
+}
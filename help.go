@@ -0,0 +1,236 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Help for a single command, as printed by the help command
+type commandHelp struct {
+	Name        string
+	Summary     string   // one line, for the usage message
+	Description string   // longer explanation for help <command>
+	Examples    []string // example invocations
+}
+
+// Help for all commands, in the order of the usage message
+var commandHelps = []commandHelp{
+	{"query", "fetch folder and message overview from IMAP server",
+		"Lists the folders on the IMAP server with their number of messages and total size, " +
+			"and warns about folders which appear to be aliases of another. " +
+			"With -json, prints the folders and the UID, size and flags of messages not yet backed up as JSON.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com query",
+			"go-imap-backup -s imap.example.com -u me@example.com -r INBOX,Sent query",
+			"go-imap-backup -s imap.example.com -u me@example.com -json query",
+		}},
+	{"histo", "fetch folder and message overview, and calculate message size histogram",
+		"Like query, and additionally prints a histogram of message sizes per folder. " +
+			"With -body-only, attachments are excluded from the sizes and reported separately.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com histo",
+			"go-imap-backup -s imap.example.com -u me@example.com -body-only -r INBOX histo",
+		}},
+	{"lquery", "fetch folder and message metadata from local storage",
+		"Lists the folders in local storage with their number of messages and total size, without contacting the server. " +
+			"With -details, lists date, sender and subject of each message, optionally paged with -page and -page-size.",
+		[]string{
+			"go-imap-backup -l backups/me lquery",
+			"go-imap-backup -l backups/me -r INBOX -details -page 2 lquery",
+			"go-imap-backup -archive backups/me.tar.gz lquery",
+		}},
+	{"search", "list local messages matching a search expression",
+		"Reads the messages of the local folders, or those given with -r, one at a time, and lists those matching -search, " +
+			"as a table or as JSON with -json. With -export-dir, also exports the matches to mbox files there. " +
+			"before: and since: refer to the Date header.",
+		[]string{
+			"go-imap-backup -l backups/me -search 'from:alice subject:invoice since:2023-01-01' search",
+			"go-imap-backup -l backups/me -search 'body:\"project x\"' -export-dir found search",
+		}},
+	{"dump-index", "print the index of local folders as a table, or as JSON with -json",
+		"Prints the index entries of the local folders, i.e. UIDVALIDITY, UID, size, offset and flags of each message.",
+		[]string{
+			"go-imap-backup -l backups/me -r INBOX dump-index",
+			"go-imap-backup -l backups/me -json dump-index",
+		}},
+	{"forget", "remove the local backup of the folders given with -r, so the next backup fetches them afresh",
+		"Deletes the local mailbox and index files of the folders given with -r after confirmation, " +
+			"e.g. after a UIDVALIDITY reset on the server. Requires -r.",
+		[]string{
+			"go-imap-backup -l backups/me -r Archive forget",
+		}},
+	{"export-mbox", "export local folders to mbox files in the directory given with -export-dir",
+		"Writes the local folders, or those given with -r, to mbox files with index in the directory given with -export-dir, " +
+			"replacing previous exports. Works from any storage format, e.g. to read a backup in blob format with mbox tools.",
+		[]string{
+			"go-imap-backup -l backups/me -export-dir export/me export-mbox",
+			"go-imap-backup -l backups/me -r INBOX,Sent -export-dir export/me export-mbox",
+		}},
+	{"verify", "check local folders for consistency between index and messages",
+		"Reads every message of the local folders, or those given with -r, and checks that its header parses, " +
+			"and that it is stored where and with the size the index says. Lists problems by folder, index line and uid, " +
+			"and exits with a non-zero status if there are any.",
+		[]string{
+			"go-imap-backup -l backups/me verify",
+			"go-imap-backup -l backups/me -r INBOX verify",
+		}},
+	{"reindex", "rebuild lost or corrupt indexes from mailbox or blob files",
+		"Scans the mailbox or blob files of the local folders, or those given with -r, and writes a new index for each. " +
+			"Keeps matching records of an existing index, recovers uids from X-UID headers, and assigns surrogate uids otherwise. " +
+			"The previous index is kept with suffix .bak. Supports the mbox and blob formats.",
+		[]string{
+			"go-imap-backup -l backups/me -r INBOX reindex",
+		}},
+	{"dedup", "remove duplicate messages from local storage",
+		"Finds messages with the same Message-ID in each local folder, or across all folders with -dedup-scope account, " +
+			"and rewrites the folders keeping only the first. With -dry-run, only lists the duplicates per folder. " +
+			"Supports the mbox and blob formats.",
+		[]string{
+			"go-imap-backup -l backups/me -dry-run dedup",
+			"go-imap-backup -l backups/me -dedup-scope account dedup",
+		}},
+	{"backup", "save new messages on IMAP server to local storage",
+		"Downloads the messages not yet stored locally into an mbox file and index per folder. " +
+			"Backups are incremental unless -overwrite is given.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com backup",
+			"go-imap-backup -s imap.example.com -u me@example.com -P-file ~/.imap-password -l backups/me backup",
+			"go-imap-backup -profile work -max-duration 2h -folder-order inbox-first backup",
+			"go-imap-backup -profile gmail -skip-all-mail backup",
+			"go-imap-backup -profile work -x 'Spam,Trash,Archive/*' backup",
+			"go-imap-backup -profile work -limit 2MB backup",
+			"go-imap-backup -profile work -continue-on-error backup",
+			"go-imap-backup -profile work -namespace all backup",
+			"go-imap-backup -profile work -archive backups/work.tar.gz backup",
+		}},
+	{"restore", "restore messages from local storage to IMAP server",
+		"Uploads the messages from local storage which are missing on the server, creating folders as needed. " +
+			"Folders which cannot be created are skipped and reported, unless -fail-fast is given. " +
+			"Restored folders are subscribed if they were at the last backup, unless -subscribe=false.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me restore",
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me -r INBOX restore",
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me -map 'INBOX.Sent=Sent,INBOX.Trash=Trash' restore",
+		}},
+	{"migrate", "copy messages from the IMAP server to a second one, without local storage",
+		"Copies the selected folders to the destination account given with -s2, -u2, -P2 and so on, creating folders as needed, " +
+			"and renaming them with -map. Messages keep their flags and internal dates. " +
+			"Messages whose Message-ID is already in the destination folder are skipped, so an interrupted migration can simply be run again.",
+		[]string{
+			"go-imap-backup -s imap.old.com -u me@old.com -s2 imap.new.com -u2 me@new.com migrate",
+			"go-imap-backup -s imap.old.com -u me@old.com -s2 imap.new.com -u2 me@new.com -map 'INBOX.Sent=Sent' -x 'INBOX.Trash' migrate",
+		}},
+	{"sync", "download new server messages and upload local-only messages in one pass",
+		"Lists each folder once on the server and locally, then downloads the messages missing locally like backup, " +
+			"and uploads the messages missing on the server like restore. Reports the messages to pull and push per folder. " +
+			"-sync-mode pull or push restricts it to one direction. Pushing supports the mbox and blob formats.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me sync",
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me -r INBOX -sync-mode push sync",
+		}},
+	{"watch", "back up, then keep backing up new messages as they arrive",
+		"Runs a backup, then waits for new messages in -watch-folder with IDLE and backs them up as they arrive. " +
+			"Backs up all selected folders again every -watch-interval, and reconnects after connection losses. " +
+			"Runs until interrupted with Ctrl-C or SIGTERM.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me watch",
+			"go-imap-backup -s imap.example.com -u me@example.com -l backups/me -r 'INBOX,Sent' -watch-interval 5m watch",
+		}},
+	{"delete", "delete older messages from IMAP server",
+		"Deletes messages older than -m months from the server, after confirmation unless -f is given. " +
+			"Run backup first. With -dry-run, only lists the messages which would be deleted. " +
+			"With -trash, moves them to the given folder instead of expunging them.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com -m 12 -dry-run -csv plan.csv delete",
+			"go-imap-backup -s imap.example.com -u me@example.com -m 12 backup delete",
+			"go-imap-backup -s imap.example.com -u me@example.com -m 12 -trash Trash delete",
+		}},
+	{"test", "check the connection, login and TLS settings without transferring messages",
+		"Connects and logs in, then prints the negotiated TLS version, the server greeting, the capabilities " +
+			"and the number of folders, and logs out. Exits with status 3 if authentication fails.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com test",
+			"go-imap-backup -s imap.example.com -tls starttls -p 143 -u me@example.com test",
+		}},
+	{"caps", "print the server's capabilities and quota",
+		"Prints the capabilities advertised by the server, marks those which go-imap-backup uses, " +
+			"e.g. COMPRESS=DEFLATE, CONDSTORE, MOVE and UIDPLUS, and prints the usage and limits of the quotas " +
+			"applying to the INBOX if the server supports QUOTA. Prints JSON with -json.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com caps",
+			"go-imap-backup -s imap.example.com -u me@example.com -json caps",
+		}},
+	{"benchmark", "measure download throughput on the largest folder, without writing to disk",
+		"Downloads the largest folder, or the largest of the folders given with -r, and reports the throughput. " +
+			"Nothing is written to local storage.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com benchmark",
+		}},
+	{"delete-plan", "preview which messages delete would remove, caching message dates locally",
+		"Counts the messages older than -m months per folder, without modifying the server. " +
+			"Message dates are cached, so re-running with a different -m is fast.",
+		[]string{
+			"go-imap-backup -s imap.example.com -u me@example.com -m 24 delete-plan",
+			"go-imap-backup -s imap.example.com -u me@example.com -m 36 delete-plan",
+		}},
+}
+
+// Returns the help for the given command, or nil if there is no such command
+func findCommandHelp(name string) *commandHelp {
+	for i := range commandHelps {
+		if commandHelps[i].Name == name {
+			return &commandHelps[i]
+		}
+	}
+	return nil
+}
+
+// Prints the one-line summaries of all commands, for the usage message
+func printCommandSummaries(o io.Writer) {
+	for _, h := range commandHelps {
+		fmt.Fprintf(o, "  %-12s %s\n", h.Name+":", h.Summary)
+	}
+	fmt.Fprintf(o, "  %-12s %s\n", "help:", "show description and examples of a command, e.g. help backup")
+}
+
+// Prints description and examples of the given commands, or of all commands if none are given
+func cmdHelp(o io.Writer, names []string) error {
+	if len(names) == 0 {
+		for _, h := range commandHelps {
+			names = append(names, h.Name)
+		}
+	}
+	for i, name := range names {
+		h := findCommandHelp(strings.ToLower(name))
+		if h == nil {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		if i > 0 {
+			fmt.Fprintln(o)
+		}
+		fmt.Fprintf(o, "%s: %s\n\n", h.Name, h.Summary)
+		fmt.Fprintf(o, "  %s\n\n", h.Description)
+		fmt.Fprintln(o, "  Examples:")
+		for _, e := range h.Examples {
+			fmt.Fprintf(o, "    %s\n", e)
+		}
+	}
+	return nil
+}
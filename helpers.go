@@ -18,23 +18,145 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/unicode/norm"
 )
 
-// Returns a slice of all strings which are in as and bs, in stable order of as
+// Returns a slice of all strings which are in as and bs, in stable order of as.
+// Strings are compared in Unicode normalization form NFC, so composed and
+// decomposed spellings of accented characters match. Returns the forms in as.
 func intersect(as []string, bs []string) []string {
 	have := make(map[string]bool)
 	for _, b := range bs {
-		have[b] = true
+		have[norm.NFC.String(b)] = true
 	}
 	cs := []string{}
 	for _, a := range as {
-		if _, ok := have[a]; ok {
+		if _, ok := have[norm.NFC.String(a)]; ok {
 			cs = append(cs, a)
 		}
 	}
 	return cs
 }
 
+// Returns the names selected with -r and -x, in stable order. Without -r, all
+// names are selected. Names matching -x are then removed, so -x takes precedence.
+func selectFolders(names []string) []string {
+	if len(restrictToFolderNames) > 0 {
+		names = matchFolders(names, restrictToFolderNames)
+	}
+	if len(excludeFolderNames) > 0 {
+		excluded := map[string]bool{}
+		for _, name := range matchFolders(names, excludeFolderNames) {
+			excluded[name] = true
+		}
+		res := []string{}
+		for _, name := range names {
+			if !excluded[name] {
+				res = append(res, name)
+			}
+		}
+		names = res
+	}
+	return names
+}
+
+// Returns the names which match any of the given patterns, in stable order of
+// names. In patterns, * matches any sequence of characters including the hierarchy
+// delimiter, and ? any single character. All other characters match themselves,
+// including brackets as in [Gmail]/*. With -r-regex, patterns are regular
+// expressions instead. Names are compared in Unicode normalization form NFC
+// like with intersect. Patterns must have been checked with folderPattern.
+func matchFolders(names []string, patterns []string) []string {
+	res := []string{}
+	exact := []string{}
+	regexps := []*regexp.Regexp{}
+	for _, p := range patterns {
+		if folderRegex || strings.ContainsAny(p, "*?") {
+			re, _ := folderPattern(p)
+			regexps = append(regexps, re)
+		} else {
+			exact = append(exact, p)
+		}
+	}
+	matched := map[string]bool{}
+	for _, name := range intersect(names, exact) {
+		matched[name] = true
+	}
+	for _, name := range names {
+		if !matched[name] {
+			for _, re := range regexps {
+				if re.MatchString(norm.NFC.String(name)) {
+					matched[name] = true
+					break
+				}
+			}
+		}
+		if matched[name] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Compiles a folder name pattern with wildcards * and ? into a regular expression
+// matching whole names, or with -r-regex the regular expression given
+func folderPattern(p string) (*regexp.Regexp, error) {
+	p = norm.NFC.String(p)
+	if folderRegex {
+		return regexp.Compile("^(?:" + p + ")$")
+	}
+	quoted := regexp.QuoteMeta(p)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.Compile("^" + quoted + "$")
+}
+
+// Prepares a header value such as a subject or sender for display. Decodes MIME
+// encoded-words in any charset known to go-message, and replaces invalid UTF-8
+// and control characters, so terminal output stays clean. Values which fail to
+// decode are shown as they are.
+func displayText(s string) string {
+	dec := mime.WordDecoder{CharsetReader: charset.Reader}
+	if decoded, err := dec.DecodeHeader(s); err == nil {
+		s = decoded
+	}
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// Parses a size such as 500KB, 1.5MB or 2G into bytes. Units are powers of 1024 as
+// with humanReadableSize, case-insensitive, and the B may be left out. A number
+// without unit is taken as bytes.
+func parseSize(s string) (uint64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := uint64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(t, unit) {
+			t = strings.TrimSuffix(t, unit)
+			mult = uint64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500KB or 5MB", s)
+	}
+	return uint64(f * float64(mult)), nil
+}
+
 // Print a given size in bytes as a human-readable string
 // using KB, MB, GB, TB as appropriate.
 func humanReadableSize(n uint64) string {
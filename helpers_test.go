@@ -0,0 +1,125 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFolderNamesMatchInAnyNormalizationForm(t *testing.T) {
+	defer func(regex bool) { folderRegex = regex }(folderRegex)
+	composed, decomposed := "Entw\u00fcrfe", "Entwu\u0308rfe"
+	if composed == decomposed {
+		t.Fatal("test names are equal")
+	}
+	local := []string{"INBOX", composed, "Sent"}
+	remote := []string{decomposed, "INBOX"}
+	if got := intersect(local, remote); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", []string{"INBOX", composed}) {
+		t.Errorf("got %q, want the local names", got)
+	}
+	if got := intersect(remote, local); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", remote) {
+		t.Errorf("got %q, want the remote names", got)
+	}
+
+	for _, tc := range []struct {
+		regex    bool
+		patterns []string
+	}{
+		{false, []string{decomposed}},
+		{false, []string{"Entwu\u0308*"}},
+		{false, []string{"Entw?rfe"}},
+		{true, []string{"Entwu\u0308rf.*"}},
+	} {
+		folderRegex = tc.regex
+		if got := matchFolders(local, tc.patterns); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", []string{composed}) {
+			t.Errorf("%q: got %q, want %q", tc.patterns, got, composed)
+		}
+		if got := matchFolders(remote, tc.patterns); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", []string{decomposed}) {
+			t.Errorf("%q: got %q, want %q", tc.patterns, got, decomposed)
+		}
+	}
+}
+
+func TestSelectFoldersByPatterns(t *testing.T) {
+	defer func(r, x []string, regex bool) {
+		restrictToFolderNames, excludeFolderNames, folderRegex = r, x, regex
+	}(restrictToFolderNames, excludeFolderNames, folderRegex)
+	names := []string{"Archive", "Archive/2023", "Archive/2024", "INBOX", "Inbox/Old", "G", "[Gmail]/Sent Mail", "[Gmail]/Spam"}
+	for _, tc := range []struct {
+		regex     bool
+		r, x      string
+		want      string
+		wantError bool
+	}{
+		// overlapping patterns select each folder once, in the order of the names
+		{false, "Archive/*,Archive/2024,*4", "", "[Archive/2023 Archive/2024]", false},
+		{false, "Archive*", "Archive/202?", "[Archive]", false},
+		{false, "Archive*", "*", "[]", false},
+		{false, "", "Archive/*,Archive", "[INBOX Inbox/Old G [Gmail]/Sent Mail [Gmail]/Spam]", false},
+		// names are case sensitive, also INBOX, as the server is free to list it in any case
+		{false, "inbox*,archive", "", "[]", false},
+		{false, "IN*", "", "[INBOX]", false},
+		// brackets are literal, and do not form a character class matching G
+		{false, "[Gmail]/*", "", "[[Gmail]/Sent Mail [Gmail]/Spam]", false},
+		{false, "[Gmail]*", "[Gmail]/Spam", "[[Gmail]/Sent Mail]", false},
+		{false, "[Gmail]", "", "[]", false},
+		// with -r-regex, patterns match whole names
+		{true, `Archive/\d+`, "", "[Archive/2023 Archive/2024]", false},
+		{true, `(?i)inbox.*`, `.*Old`, "[INBOX]", false},
+		{true, `\[Gmail\]/.*`, `.*Spam`, "[[Gmail]/Sent Mail]", false},
+		{true, `[Gmail]`, "", "[G]", false},
+		{true, `Archive/(`, "", "", true},
+	} {
+		folderRegex = tc.regex
+		restrictToFolderNames, excludeFolderNames = splitFolderNames(tc.r), splitFolderNames(tc.x)
+		if err := validateFolderPatterns(); (err != nil) != tc.wantError {
+			t.Errorf("-r %s -x %s: got error %v", tc.r, tc.x, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if got := fmt.Sprint(selectFolders(names)); got != tc.want {
+			t.Errorf("-r %s -x %s, regex %t: got %s, want %s", tc.r, tc.x, tc.regex, got, tc.want)
+		}
+	}
+}
+
+func TestDisplayText(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"plain subject", "plain subject"},
+		{"=?UTF-8?B?R3LDvMOfZSBhdXMgS8O2bG4=?=", "Grüße aus Köln"},
+		{"=?ISO-8859-1?Q?Gr=FC=DFe?= und =?iso-8859-15?q?=A4uro?=", "Grüße und €uro"},
+		{"=?windows-1252?Q?=93quoted=94?=", "“quoted”"},
+		{"=?ISO-2022-JP?B?GyRCRnxLXDhsGyhC?=", "日本語"},
+		{"=?Shift_JIS?B?k/qWe4zq?=", "日本語"},
+		{"=?KOI8-R?B?8NLJ18XU?=", "Привет"},
+		{"=?GB2312?B?1tDOxA==?=", "中文"},
+		{"=?UTF-8?Q?split_?= =?UTF-8?Q?words?=", "split words"},
+		{"=?UTF-8?X?unknown encoding?=", "=?UTF-8?X?unknown encoding?="},
+		{"invalid \xff\xfe bytes", "invalid � bytes"},
+		{"=?UTF-8?B?aW52YWxpZCD/?=", "invalid �"},
+		{"line\r\nbreak\tand\x1bescape\x7f", "line  break and escape "},
+		{"=?UTF-8?Q?encoded=0Abreak=1B?=", "encoded break "},
+	} {
+		if got := displayText(tc.in); got != tc.want {
+			t.Errorf("displayText(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -17,18 +17,69 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 	pb "github.com/schollz/progressbar/v3"
 	"io"
+	"log/slog"
 	"math"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Watches the given context while an IMAP operation is running, and terminates
+// the connection if the context expires, so the blocked operation returns.
+// The returned function stops watching, and replaces a non-nil *err with
+// the context error if the context had expired. Use with named results as
+// defer watchContext(ctx, c, &err)()
+func watchContext(ctx context.Context, c *client.Client, err *error) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Terminate()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		if *err != nil && ctx.Err() != nil {
+			*err = fmt.Errorf("operation aborted: %w", ctx.Err())
+		}
+	}
+}
+
+// Closes the connection of the client, e.g. one left in the middle of a command,
+// and waits until the client has noticed, so that reconnect dials a new one
+func dropConnection(c *client.Client) {
+	c.Terminate()
+	<-c.LoggedOut()
+}
+
+// Returns true if the connection of the client has been closed, either by
+// logging out, by the server, or by terminating it after a timeout
+func isDisconnected(c *client.Client) bool {
+	if c.State() == imap.LogoutState {
+		return true
+	}
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
 // Retrieves a list of all folders from an Imap server
-func ListFolders(c *client.Client) ([]string, error) {
+func ListFolders(ctx context.Context, c *client.Client) (folderNames []string, err error) {
+	defer watchContext(ctx, c, &err)()
+
 	// Query list of folders
 	mailboxesCh := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
@@ -49,31 +100,178 @@ func ListFolders(c *client.Client) ([]string, error) {
 	return mailboxes, nil
 }
 
+// Retrieves a sorted list of the selectable folders matching the given LIST pattern
+func listSelectableFolders(c *client.Client, pattern string) ([]string, error) {
+	mailboxesCh := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", pattern, mailboxesCh)
+	}()
+
+	mailboxes := []string{}
+	for m := range mailboxesCh {
+		selectable := true
+		for _, attr := range m.Attributes {
+			if attr == imap.NoSelectAttr {
+				selectable = false
+			}
+		}
+		if selectable {
+			mailboxes = append(mailboxes, m.Name)
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Strings(mailboxes)
+	return mailboxes, nil
+}
+
+// Returns the hierarchy delimiter of the Imap server, or "" if it has a flat namespace
+func GetDelimiter(c *client.Client) (delim string, err error) {
+	mailboxesCh := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "", mailboxesCh)
+	}()
+	for m := range mailboxesCh {
+		delim = m.Delimiter
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+	return delim, nil
+}
+
+// Creates the missing parent folders of a hierarchical folder name, from the top
+// down, as not all servers create them along with the folder
+func createParentFolders(c *client.Client, name, delim string) error {
+	if delim == "" {
+		return nil
+	}
+	levels := strings.Split(name, delim)
+	for i := 1; i < len(levels); i++ {
+		parent := strings.Join(levels[:i], delim)
+		exists, err := folderExists(c, parent)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := c.Create(parent); err != nil {
+				return fmt.Errorf("%q: %w", parent, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns whether a folder of the given name exists on the server, including
+// folders which cannot be selected, such as pure hierarchy levels
+func folderExists(c *client.Client, name string) (bool, error) {
+	mailboxesCh := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", name, mailboxesCh)
+	}()
+	exists := false
+	for range mailboxesCh {
+		exists = true
+	}
+	return exists, <-done
+}
+
+// Converts a folder name from the hierarchy delimiter srcDelim to dstDelim.
+// Returns the name unchanged if either delimiter is unknown.
+func convertDelimiter(name, srcDelim, dstDelim string) string {
+	if srcDelim == "" || dstDelim == "" || srcDelim == dstDelim {
+		return name
+	}
+	return strings.ReplaceAll(name, srcDelim, dstDelim)
+}
+
+// Checks whether a folder name can be created on an Imap server with the given
+// hierarchy delimiter. Rejects empty names and hierarchy levels, wildcards and
+// control characters. Non-ASCII characters are fine, as they are sent in modified UTF-7.
+func validateFolderName(name, delim string) error {
+	if name == "" {
+		return fmt.Errorf("folder name is empty")
+	}
+	for _, r := range name {
+		if r == '*' || r == '%' {
+			return fmt.Errorf("folder name %q contains wildcard %q", name, r)
+		}
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("folder name %q contains control character %#x", name, r)
+		}
+	}
+	if delim != "" {
+		for _, level := range strings.Split(name, delim) {
+			if level == "" {
+				return fmt.Errorf("folder name %q contains an empty hierarchy level for delimiter %q", name, delim)
+			}
+		}
+	}
+	return nil
+}
+
 // Creates local metadata for an imap folder by fetching metadata for all its messages
-func NewImapFolderMeta(c *client.Client, folderName string) (ifm *ImapFolderMeta, err error) {
+func NewImapFolderMeta(ctx context.Context, c *client.Client, folderName string) (ifm *ImapFolderMeta, err error) {
+	return NewImapFolderMetaSince(ctx, c, folderName, FolderState{})
+}
+
+// Creates local metadata for an imap folder like NewImapFolderMeta. On servers with
+// CONDSTORE, also records the HIGHESTMODSEQ of the folder and the MODSEQ of each
+// message. If the given state of the last complete backup has a HIGHESTMODSEQ and
+// the same UIDVALIDITY, only messages changed since are fetched, which include all
+// new messages, and ChangedSince is set.
+func NewImapFolderMetaSince(ctx context.Context, c *client.Client, folderName string, since FolderState) (ifm *ImapFolderMeta, err error) {
+	defer watchContext(ctx, c, &err)()
+
 	ifm = &ImapFolderMeta{Name: folderName}
+	condstore := supportsCondstore(c)
+	if condstore {
+		// before listing, so that changes while listing are seen again next time
+		status, err := c.Status(folderName, []imap.StatusItem{imap.StatusUidValidity, highestModSeqItem})
+		if err != nil {
+			return nil, err
+		}
+		ifm.HighestModSeq = parseModSeq(status.Items[highestModSeqItem])
+		if since.HighestModSeq != 0 && since.UidValidity == status.UidValidity {
+			ifm.ChangedSince = since.HighestModSeq
+		}
+	}
 	mbox, err := c.Select(folderName, true)
 	if err != nil {
 		return nil, err
 	}
 	ifm.UidValidity = mbox.UidValidity
+	ifm.UidNext = mbox.UidNext
 	if mbox.Messages == 0 {
 		return ifm, nil
 	}
 
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(1, mbox.Messages)
-	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchFlags}
+	if condstore {
+		items = append(items, modSeqItem)
+	}
+	var cmd imap.Commander = &commands.Fetch{SeqSet: seqset, Items: items}
+	if ifm.ChangedSince != 0 {
+		cmd = &fetchChangedSince{Fetch: commands.Fetch{SeqSet: seqset, Items: items}, ChangedSince: ifm.ChangedSince}
+	}
 
 	messages := make(chan *imap.Message, 16)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		done <- executeFetch(c, cmd, seqset, messages)
 	}()
 
 	ifm.Messages = []MessageMeta{}
 	for msg := range messages {
-		d := MessageMeta{SeqNum: msg.SeqNum, UidValidity: mbox.UidValidity, Uid: msg.Uid, Size: msg.Size, Offset: math.MaxUint64}
+		d := MessageMeta{SeqNum: msg.SeqNum, UidValidity: mbox.UidValidity, Uid: msg.Uid, Size: msg.Size, Offset: math.MaxUint64,
+			Flags: storableFlags(msg.Flags), ModSeq: parseModSeq(msg.Items[modSeqItem])}
 		ifm.Messages = append(ifm.Messages, d)
 		ifm.Size += uint64(msg.Size)
 	}
@@ -83,71 +281,412 @@ func NewImapFolderMeta(c *client.Client, folderName string) (ifm *ImapFolderMeta
 	return ifm, nil
 }
 
+// Fetches the BODYSTRUCTURE of all messages in an IMAP folder, and returns
+// the number of bytes taken up by attachments in each message, by UID
+func FetchAttachmentSizes(ctx context.Context, c *client.Client, folderName string) (sizes map[uint32]uint32, err error) {
+	defer watchContext(ctx, c, &err)()
+
+	sizes = make(map[uint32]uint32)
+	mbox, err := c.Select(folderName, true)
+	if err != nil {
+		return nil, err
+	}
+	if mbox.Messages == 0 {
+		return sizes, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, mbox.Messages)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure}
+
+	messages := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqset, items, messages)
+	}()
+	for msg := range messages {
+		sizes[msg.Uid] = attachmentSize(msg.BodyStructure)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// Returns the number of bytes of all attachments in the given body structure.
+// Parts count as attachments if their disposition says so, or if they carry a
+// file name and are not inline text.
+func attachmentSize(bs *imap.BodyStructure) uint32 {
+	if bs == nil {
+		return 0
+	}
+	if len(bs.Parts) > 0 {
+		size := uint32(0)
+		for _, p := range bs.Parts {
+			size += attachmentSize(p)
+		}
+		return size
+	}
+	if bs.Disposition == "attachment" {
+		return bs.Size
+	}
+	if name, _ := bs.Filename(); name != "" && !(bs.Disposition == "inline" && strings.EqualFold(bs.MIMEType, "text")) {
+		return bs.Size
+	}
+	return 0
+}
+
+// A destination for downloaded messages, such as a local folder. Append reads
+// the message from r, which should have a Len method to avoid buffering it.
+type MessageAppender interface {
+	Append(mm MessageMeta, from string, when time.Time, r io.Reader) error
+}
+
+// A message destination which discards all messages, counting them
+type discardAppender struct {
+	Messages int
+	Size     uint64
+}
+
+func (d *discardAppender) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	n, err := io.Copy(io.Discard, r)
+	d.Messages++
+	d.Size += uint64(n)
+	return err
+}
+
+// A downloaded message waiting to be written to local storage
+type queuedMessage struct {
+	mm   MessageMeta
+	from string
+	date time.Time
+	r    *progressReader
+}
+
+// Reads a message body fetched from the server, reporting the bytes read to the
+// progress bar. Keeps the Len method of the literal, so it is stored without
+// being copied in memory.
+type progressReader struct {
+	imap.Literal
+	bar *pb.ProgressBar
+	n   int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Literal.Read(p)
+	r.n += int64(n)
+	r.bar.Add(n)
+	return n, err
+}
+
 // Download the given set of messages from the remote Imap mailbox,
 // and save them to local folders using the remote folder name,
-// reporting download progress in bytes to the progress bar after every message
-func (f *ImapFolderMeta) DownloadTo(c *client.Client, lf *LocalFolder, bar *pb.ProgressBar) error {
+// reporting download progress in bytes to the progress bar as messages are stored.
+// Messages are fetched in batches of -batch, bounding the work per command.
+// With -msg-timeout, messages are downloaded one by one, and a msgTimeoutError
+// is returned if one of them takes too long. With -stall-timeout, a stallError
+// is returned if no data arrives for too long.
+// Returns the UIDs of messages skipped because the server returned no body.
+func (f *ImapFolderMeta) DownloadTo(ctx context.Context, c *client.Client, lf MessageAppender, bar *pb.ProgressBar) (skipped []uint32, err error) {
+	defer watchContext(ctx, c, &err)()
+	h, stop := startHealthMonitor(c, f.Name, lf, &err)
+	defer stop()
+	lf = h
+
 	// Select mailbox on server
 	mbox, err := c.Select(f.Name, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if mbox.UidValidity != f.UidValidity {
-		return fmt.Errorf("UidValidity changed from %d to %d, this should not happen",
-			mbox.UidValidity, f.UidValidity)
+		return nil, fmt.Errorf("UIDVALIDITY changed from %d to %d while backing up, run backup again",
+			f.UidValidity, mbox.UidValidity)
+	}
+
+	if msgTimeout == 0 {
+		// download messages in batches of -batch, or all in one go
+		n := batchSize
+		if n == 0 {
+			n = len(f.Messages)
+		}
+		for start := 0; start < len(f.Messages); start += n {
+			end := start + n
+			if end > len(f.Messages) {
+				end = len(f.Messages)
+			}
+			seqset := new(imap.SeqSet)
+			fetch := func() error {
+				if seqset.Empty() {
+					return nil
+				}
+				s, err := f.fetchMessages(c, seqset, false, lf, bar)
+				skipped = append(skipped, s...)
+				seqset = new(imap.SeqSet)
+				return err
+			}
+			for _, message := range f.Messages[start:end] {
+				if message.Size < largeMessageSize {
+					seqset.AddNum(message.SeqNum)
+					continue
+				}
+				// large messages are streamed on their own, after the messages before them
+				if err := fetch(); err != nil {
+					return skipped, err
+				}
+				if err := f.streamMessage(c, message.Uid, lf, bar); err != nil {
+					return skipped, err
+				}
+				if timeLimitReached() {
+					return skipped, errTimeLimit
+				}
+			}
+			if err := fetch(); err != nil {
+				return skipped, err
+			}
+		}
+		return skipped, nil
 	}
 
-	// prepare sequence set and trigger download of messages
-	totalSize := uint64(0)
-	seqset := new(imap.SeqSet)
 	for _, message := range f.Messages {
-		seqset.AddNum(message.SeqNum)
-		totalSize += uint64(message.Size)
+		s, err := f.downloadMessage(ctx, c, message, lf, bar)
+		skipped = append(skipped, s...)
+		if err != nil {
+			return skipped, err
+		}
 	}
+	return skipped, nil
+}
 
+// Downloads a single message, streaming it if it is large. Terminates the connection
+// and returns a msgTimeoutError if this takes longer than -msg-timeout.
+func (f *ImapFolderMeta) downloadMessage(ctx context.Context, c *client.Client, message MessageMeta, lf MessageAppender, bar *pb.ProgressBar) (skipped []uint32, err error) {
+	msgCtx, cancel := context.WithTimeout(ctx, msgTimeout)
+	defer cancel()
+	defer func() {
+		if err != nil && msgCtx.Err() != nil && ctx.Err() == nil {
+			err = &msgTimeoutError{Uid: message.Uid}
+		}
+	}()
+	defer watchContext(msgCtx, c, &err)()
+
+	if message.Size >= largeMessageSize {
+		return nil, f.streamMessage(c, message.Uid, lf, bar)
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(message.Uid)
+	return f.fetchMessages(c, seqset, true, lf, bar)
+}
+
+// Returns the items to fetch for storing a message, except its body
+func messageItems(c *client.Client) []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchFlags, imap.FetchEnvelope, imap.FetchInternalDate}
+	if useGmailLabels(c) {
+		items = append(items, gmailLabelsItem)
+	}
+	if supportsCondstore(c) {
+		items = append(items, modSeqItem)
+	}
+	return items
+}
+
+// Returns the metadata for storing a fetched message, along with the sender and
+// date for its From line
+func (f *ImapFolderMeta) storedMessageMeta(msg *imap.Message) (mm MessageMeta, from string, date time.Time) {
+	// malformed messages may come without envelope or sender, in which
+	// case the local storage uses a placeholder sender
+	envelope := msg.Envelope
+	if envelope == nil {
+		slog.Warn("Server returned no envelope, storing without sender and subject", "folder", f.Name, "uid", msg.Uid)
+		envelope = &imap.Envelope{}
+	}
+	if len(envelope.From) > 0 && envelope.From[0].MailboxName != "" {
+		from = envelope.From[0].Address()
+	} else if msg.Envelope != nil {
+		slog.Warn("Message has no sender, storing without", "folder", f.Name, "uid", msg.Uid)
+	}
+
+	// prefer the server's receipt time over the sender's Date header, which
+	// is often wrong or missing on spam
+	date = msg.InternalDate
+	if date.IsZero() {
+		date = envelope.Date
+		if date.IsZero() {
+			date = time.Now()
+			slog.Warn("Server returned neither INTERNALDATE nor Date, using the current time", "folder", f.Name, "uid", msg.Uid)
+		} else {
+			slog.Warn("Server returned no INTERNALDATE, using the Date header", "folder", f.Name, "uid", msg.Uid)
+		}
+	}
+	mm = MessageMeta{SeqNum: msg.SeqNum, UidValidity: f.UidValidity, Uid: msg.Uid, Flags: storableFlags(msg.Flags),
+		Envelope: newMessageEnvelope(msg.Envelope), Labels: parseGmailLabels(msg), InternalDate: msg.InternalDate,
+		ModSeq: parseModSeq(msg.Items[modSeqItem])}
+	return mm, from, date
+}
+
+// Fetches the given messages from the selected mailbox, by sequence number
+// or by UID, and appends them to lf.
+// Returns the UIDs of messages skipped because the server returned no body.
+func (f *ImapFolderMeta) fetchMessages(c *client.Client, seqset *imap.SeqSet, byUid bool, lf MessageAppender, bar *pb.ProgressBar) (skipped []uint32, err error) {
 	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchEnvelope, section.FetchItem()}
+	items := append(messageItems(c), section.FetchItem())
 
-	messages := make(chan *imap.Message, 16)
+	// The client reads each message including its body into memory on its own
+	// goroutine, and hands it over below. Large messages are streamed instead,
+	// see streamMessage.
+	messages := make(chan *imap.Message)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		if byUid {
+			done <- c.UidFetch(seqset, items, messages)
+		} else {
+			done <- c.Fetch(seqset, items, messages)
+		}
+	}()
+
+	// Another goroutine writes the messages to lf in order, so that disk writes
+	// overlap with receiving the next messages. The capacity of the queue bounds
+	// how far downloading may run ahead of writing. After a write error, the
+	// writer discards the rest of the queue and closes failed.
+	queue := make(chan queuedMessage, pipelineDepth)
+	written := make(chan error, 1)
+	failed := make(chan struct{})
+	go func() {
+		var err error
+		for q := range queue {
+			if err != nil {
+				continue
+			}
+			if err = lf.Append(q.mm, q.from, q.date, q.r); err != nil {
+				close(failed)
+				continue
+			}
+			addTransferred(uint64(q.r.n))
+			slog.Debug("Downloaded message", "folder", f.Name, "uid", q.mm.Uid, "size", q.r.n)
+		}
+		written <- err
+	}()
+
+	// On return, wait for the queued messages to be written, and return a write
+	// error in preference to others. When returning early, abandon the rest of
+	// the fetch. The client blocks on the unread messages, so drop the
+	// connection, and drain the channel until the fetch command returns.
+	fetching := true
+	defer func() {
+		close(queue)
+		if werr := <-written; werr != nil {
+			skipped, err = nil, werr
+		}
+		if fetching {
+			c.Terminate()
+			for range messages {
+			}
+			<-done
+			<-c.LoggedOut()
+		}
 	}()
 
 	// process messages received
 	for msg := range messages {
-		// print progress
-		if err := bar.Add64(int64(msg.Size)); err != nil {
-			return err
+		body := msg.GetBody(section)
+		if body == nil {
+			if !skipEmptyBody {
+				return nil, fmt.Errorf("server didn't return message body for uid %d", msg.Uid)
+			}
+			slog.Warn("Server didn't return message body, skipping", "folder", f.Name, "uid", msg.Uid)
+			bar.Add64(int64(msg.Size))
+			skipped = append(skipped, msg.Uid)
+			continue
 		}
 
-		// read message into memory
-		r := msg.GetBody(section)
-		if r == nil {
-			return fmt.Errorf("server didn't return message body")
+		mm, from, date := f.storedMessageMeta(msg)
+		select {
+		case queue <- queuedMessage{mm: mm, from: from, date: date, r: &progressReader{Literal: body, bar: bar}}:
+		case <-failed:
+			return nil, nil // the deferred function returns the write error
 		}
-		bs, err := io.ReadAll(r)
-		if err != nil {
-			return err
+
+		// stop after the current message once the time limit is reached,
+		// abandoning the rest of the fetch
+		if timeLimitReached() {
+			return skipped, errTimeLimit
 		}
+	}
+	fetching = false
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
+
+// Date and size of a message on an IMAP server, used for planning deletions
+type MessageDate struct {
+	Uid  uint32    `json:"uid"`
+	Size uint32    `json:"size"`
+	Date time.Time `json:"date"` // INTERNALDATE on the server
+}
+
+// Dates and sizes of all messages in an IMAP folder, along with the folder
+// status they were fetched for. UIDVALIDITY, UIDNEXT and the message count
+// change whenever messages are added or expunged, so they serve as cache key.
+type FolderDates struct {
+	Name        string        `json:"name"`
+	UidValidity uint32        `json:"uidValidity"`
+	UidNext     uint32        `json:"uidNext"`
+	NumMessages uint32        `json:"numMessages"`
+	Messages    []MessageDate `json:"messages"`
+}
+
+// Fetches dates and sizes of all messages in an IMAP folder. Reuses the
+// locally cached result if the folder status has not changed since, which
+// only costs a STATUS command. Returns whether the cache was used.
+func FetchFolderDates(ctx context.Context, c *client.Client, folderName string) (fd *FolderDates, cached bool, err error) {
+	defer watchContext(ctx, c, &err)()
+
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity}
+	status, err := c.Status(folderName, items)
+	if err != nil {
+		return nil, false, err
+	}
+	if fd := loadCachedFolderDates(folderName); fd != nil && fd.UidValidity == status.UidValidity &&
+		fd.UidNext == status.UidNext && fd.NumMessages == status.Messages {
+		return fd, true, nil
+	}
+
+	fd = &FolderDates{Name: folderName, UidValidity: status.UidValidity, UidNext: status.UidNext,
+		NumMessages: status.Messages, Messages: []MessageDate{}}
+	mbox, err := c.Select(folderName, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if mbox.Messages > 0 {
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(1, mbox.Messages)
+		fetchItems := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchInternalDate}
 
-		var env string
-		if len(msg.Envelope.From) > 0 {
-			env = msg.Envelope.From[0].Address()
+		messages := make(chan *imap.Message, 16)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Fetch(seqset, fetchItems, messages)
+		}()
+		for msg := range messages {
+			fd.Messages = append(fd.Messages, MessageDate{Uid: msg.Uid, Size: msg.Size, Date: msg.InternalDate})
 		}
-		date := msg.Envelope.Date
-		if err := lf.Append(mbox.UidValidity, msg.Uid, env, date, bs); err != nil {
-			return err
+		if err := <-done; err != nil {
+			return nil, false, err
 		}
 	}
-	if err := <-done; err != nil {
-		return err
+
+	if err := saveCachedFolderDates(fd); err != nil {
+		slog.Warn("Unable to cache message dates", "folder", folderName, "err", err)
 	}
-	return nil
+	return fd, false, nil
 }
 
-// Delete messages before the given time from an Imap server
-func DeleteMessagesBefore(c *client.Client, folderName string, before time.Time) (numDeleted int, err error) {
+// Delete messages before the given time from an Imap server. With a non-empty
+// trash folder, moves them there instead of expunging them.
+func DeleteMessagesBefore(ctx context.Context, c *client.Client, folderName string, before time.Time, trash string) (numDeleted int, err error) {
+	defer watchContext(ctx, c, &err)()
+
 	mbox, err := c.Select(folderName, false) // need r/w access
 	if err != nil {
 		return 0, err
@@ -156,36 +695,216 @@ func DeleteMessagesBefore(c *client.Client, folderName string, before time.Time)
 		return 0, nil
 	}
 
-	ids, err := findMessagesBefore(c, before)
+	uids, err := findMessagesBefore(c, before)
 	if err != nil {
 		return 0, err
 	}
-	if len(ids) == 0 {
+	if len(uids) == 0 {
 		return 0, nil
 	}
 
-	err = deleteMessages(c, ids)
+	if trash != "" {
+		// Not retried, as a failed attempt may have copied some messages already
+		if err := moveMessages(c, uids, trash); err != nil {
+			return 0, err
+		}
+		return len(uids), nil
+	}
+
+	err = deleteMessages(c, uids)
+	if err != nil && isNoMailboxSelected(err) {
+		// Some servers lose the selected state on slow connections. UIDs remain
+		// valid across a re-SELECT, so simply retry once.
+		slog.Warn("Re-selecting folder and retrying", "folder", folderName, "err", err)
+		if _, err := c.Select(folderName, false); err != nil {
+			return 0, err
+		}
+		err = deleteMessages(c, uids)
+	}
 	if err != nil {
 		return 0, err
 	}
-	return len(ids), nil
+	return len(uids), nil
+}
+
+// A message which a delete command would remove
+type DeletionCandidate struct {
+	Folder  string
+	Uid     uint32
+	Date    time.Time // INTERNALDATE on the server
+	Size    uint32
+	Subject string
+	From    string
 }
 
+// Lists the messages before the given time in an Imap folder, along with their
+// metadata, without modifying the folder
+func ListMessagesBefore(ctx context.Context, c *client.Client, folderName string, before time.Time) (cands []DeletionCandidate, err error) {
+	defer watchContext(ctx, c, &err)()
+
+	mbox, err := c.Select(folderName, true)
+	if err != nil {
+		return nil, err
+	}
+	if mbox.Messages == 0 {
+		return nil, nil
+	}
+	uids, err := findMessagesBefore(c, before)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchEnvelope}
+
+	messages := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+	for msg := range messages {
+		cand := DeletionCandidate{Folder: folderName, Uid: msg.Uid, Date: msg.InternalDate, Size: msg.Size}
+		if msg.Envelope != nil {
+			cand.Subject = displayText(msg.Envelope.Subject)
+			if len(msg.Envelope.From) > 0 {
+				cand.From = formatAddress(msg.Envelope.From[0])
+			}
+		}
+		cands = append(cands, cand)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return cands, nil
+}
+
+// Formats an envelope address for display, as name and address if it has a name
+func formatAddress(addr *imap.Address) string {
+	if addr.PersonalName == "" {
+		return addr.Address()
+	}
+	return fmt.Sprintf("%s <%s>", displayText(addr.PersonalName), addr.Address())
+}
+
+// Returns true if err indicates that the server or client lost the selected mailbox
+func isNoMailboxSelected(err error) bool {
+	return err == client.ErrNoMailboxSelected || strings.Contains(strings.ToLower(err.Error()), "no mailbox selected")
+}
+
+// Returns the UIDs of messages in the selected folder with an internal date before
+// the given time, which also match the -search expression, if any
 func findMessagesBefore(c *client.Client, before time.Time) ([]uint32, error) {
 	criteria := imap.NewSearchCriteria()
-	criteria.Before = before
-	return c.Search(criteria)
+	if err := parseSearch(searchExpr, criteria); err != nil {
+		return nil, &fatalError{err}
+	}
+	if criteria.Before.IsZero() || before.Before(criteria.Before) {
+		criteria.Before = before
+	}
+	return c.UidSearch(criteria)
 }
 
-func deleteMessages(c *client.Client, ids []uint32) error {
+// Flags the messages with the given UIDs in the selected folder as deleted, and expunges them.
+// Expunges only these messages if the server supports UIDPLUS, otherwise all messages
+// flagged as deleted in the folder, including those flagged by other clients.
+func deleteMessages(c *client.Client, uids []uint32) error {
 	seqset := new(imap.SeqSet)
-	seqset.AddNum(ids...)
+	seqset.AddNum(uids...)
 
 	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{imap.DeletedFlag}
-	if err := c.Store(seqset, item, flags, nil); err != nil {
+	if err := c.UidStore(seqset, item, flags, nil); err != nil {
+		return err
+	}
+
+	ok, err := c.Support("UIDPLUS")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		warnNoUidPlus.Do(func() {
+			slog.Warn("Server does not support UIDPLUS, expunging all messages flagged as deleted")
+		})
+		return c.Expunge(nil)
+	}
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqset}}}
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// Warns once per run that expunging may affect messages flagged by other clients
+var warnNoUidPlus sync.Once
+
+// Moves the messages with the given UIDs in the selected folder to another folder.
+// Uses MOVE if the server supports it, or else COPY and deleteMessages, which
+// expunges only these messages on UIDPLUS servers. Some servers announce MOVE
+// but reject it for some folders, these get the latter too.
+func moveMessages(c *client.Client, uids []uint32, dest string) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	ok, err := c.Support("MOVE")
+	if err != nil {
+		return err
+	}
+	if ok {
+		err := c.UidMove(seqset, dest)
+		if err == nil || isNetworkError(err) {
+			return err
+		}
+		slog.Warn("Moving messages failed, copying them instead", "to", dest, "err", err)
+	}
+	if err := c.UidCopy(seqset, dest); err != nil {
 		return err
 	}
+	return deleteMessages(c, uids)
+}
+
+// How many of the stored flags to pass when appending a message on restore
+const (
+	flagsAll    = iota // system flags and keywords
+	flagsSystem        // system flags like \Seen only, as some servers reject keywords
+	flagsNone          // no flags
+)
+
+// Descriptions of the flag levels for logging
+var flagLevelNames = []string{"all flags", "system flags only", "no flags"}
+
+// Returns the stored flags of a message to pass on restore, according to level
+// and -restore-unread. Leaves out \Recent, which indexes of older versions may
+// hold, as the server sets it itself.
+func restoreFlags(flags []string, level int) []string {
+	res := []string{}
+	if level == flagsNone {
+		return res
+	}
+	for _, f := range storableFlags(flags) {
+		if restoreUnread && f == imap.SeenFlag {
+			continue
+		}
+		if level == flagsSystem && !strings.HasPrefix(f, "\\") {
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
 
-	return c.Expunge(nil)
+// Appends a message to the given server folder with its stored flags. If the server
+// rejects them, retries with system flags only and then without flags, logging the
+// dropped flags. The fallback is kept in *level for the next messages of the folder.
+func appendMessage(c *client.Client, folder string, mm MessageMeta, date time.Time, bs []byte, level *int) error {
+	for {
+		flags := restoreFlags(mm.Flags, *level)
+		err := c.Append(folder, flags, date, bytes.NewReader(bs))
+		if err == nil || isNetworkError(err) || len(flags) == 0 {
+			return err
+		}
+		*level++
+		slog.Warn("Server rejected flags, retrying", "folder", folder, "uid", mm.Uid,
+			"flags", strings.Join(flags, " "), "with", flagLevelNames[*level], "err", err)
+	}
 }
@@ -0,0 +1,532 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// A message destination which fails on the first message
+type failingAppender struct{}
+
+func (failingAppender) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	return errors.New("disk full")
+}
+
+func TestDownloadDropsConnectionOnAppendError(t *testing.T) {
+	c := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		appendTestMessage(t, c, "INBOX", nil, time.Now(), fmt.Sprintf("Subject: %d\r\n\r\nbody %d\r\n", i, i))
+	}
+	pipelineDepth, batchSize = 1, 0 // leave the client blocked on unread messages
+	f, err := NewImapFolderMeta(context.Background(), c, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.DownloadTo(context.Background(), c, failingAppender{}, pb.NewOptions(0, pb.OptionSetVisibility(false)))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not return after the append error")
+	}
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("got error %v, want disk full", err)
+	}
+	if !isDisconnected(c) {
+		t.Fatal("connection left in the middle of the fetch")
+	}
+	newC, err := reconnect(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logout(newC)
+	if newC == c {
+		t.Fatal("reconnect reused the abandoned connection")
+	}
+	if _, err := NewImapFolderMeta(context.Background(), newC, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A message destination which records the subjects of the messages in order
+type recordingAppender struct {
+	subjects []string
+}
+
+func (a *recordingAppender) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond) // a slow disk lets downloads run ahead
+	a.subjects = append(a.subjects, string(bs[:bytes.IndexByte(bs, '\r')]))
+	return nil
+}
+
+func TestDownloadKeepsOrderWhileWritingAhead(t *testing.T) {
+	c := newTestServer(t)
+	want := []string{}
+	for i := 0; i < 30; i++ {
+		appendTestMessage(t, c, "Pipeline", nil, time.Now(), fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i))
+		want = append(want, fmt.Sprintf("Subject: %d", i))
+	}
+	for _, depth := range []int{0, 1, 16} {
+		pipelineDepth, batchSize = depth, 7
+		f, err := NewImapFolderMeta(context.Background(), c, "Pipeline")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &recordingAppender{}
+		if _, err := f.DownloadTo(context.Background(), c, a, pb.NewOptions(0, pb.OptionSetVisibility(false))); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(a.subjects) != fmt.Sprint(want) {
+			t.Errorf("depth %d: got %v, want %v", depth, a.subjects, want)
+		}
+	}
+}
+
+// A server backend whose mailboxes lose the selected state when storing flags,
+// for the given number of times, as some servers do on slow connections
+type dropSelectionBackend struct {
+	backend.Backend
+	drops atomic.Int32
+}
+
+type dropSelectionUser struct {
+	backend.User
+	be *dropSelectionBackend
+}
+
+type dropSelectionMailbox struct {
+	backend.Mailbox
+	be *dropSelectionBackend
+}
+
+func (be *dropSelectionBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &dropSelectionUser{u, be}, nil
+}
+
+func (u *dropSelectionUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dropSelectionMailbox{mbox, u.be}, nil
+}
+
+func (mbox *dropSelectionMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	if mbox.be.drops.Add(-1) >= 0 {
+		return errors.New("No mailbox selected")
+	}
+	return mbox.Mailbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func TestDeleteReselectsAfterDroppedSelection(t *testing.T) {
+	be := &dropSelectionBackend{Backend: memory.New()}
+	c := newTestServerWithBackend(t, be)
+	before := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, date := range []time.Time{before.AddDate(-2, 0, 0), before.AddDate(-1, 0, 0), before.AddDate(1, 0, 0)} {
+		appendTestMessage(t, c, "Old", nil, date, fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i))
+	}
+
+	// a selection dropped once is restored, and the delete retried
+	be.drops.Store(1)
+	n, err := DeleteMessagesBefore(context.Background(), c, "Old", before, "")
+	if err != nil || n != 2 {
+		t.Fatalf("deleted %d messages, %v, want 2", n, err)
+	}
+	if be.drops.Load() >= 0 {
+		t.Errorf("selection was not dropped")
+	}
+	if got := fmt.Sprint(fetchTestSubjects(t, c, "Old")); got != "[2]" {
+		t.Errorf("got messages %s, want [2]", got)
+	}
+
+	// a selection dropped again fails the delete
+	appendTestMessage(t, c, "Old", nil, before.AddDate(-1, 0, 0), "Subject: 3\r\n\r\nbody\r\n")
+	be.drops.Store(2)
+	if _, err := DeleteMessagesBefore(context.Background(), c, "Old", before, ""); err == nil || !isNoMailboxSelected(err) {
+		t.Errorf("got %v, want the dropped selection", err)
+	}
+}
+
+func TestValidateFolderName(t *testing.T) {
+	for _, tc := range []struct {
+		name, delim string
+		valid       bool
+	}{
+		{"Old Mail", "/", true},
+		{"Archive/Old Mail/2024", "/", true},
+		{"INBOX.Sent Items", ".", true},
+		{"Entwürfe/受信トレイ", "/", true},
+		{"a/b.c", "", true},
+		{"", "/", false},
+		{"Archive//2024", "/", false},
+		{"/Archive", "/", false},
+		{"Archive.", ".", false},
+		{"Work*", "/", false},
+		{"100%", "/", false},
+		{"Tab\tName", "/", false},
+	} {
+		if err := validateFolderName(tc.name, tc.delim); (err == nil) != tc.valid {
+			t.Errorf("%q with delimiter %q: got %v, want valid %t", tc.name, tc.delim, err, tc.valid)
+		}
+	}
+}
+
+func TestRestoreCreatesNestedFolderNames(t *testing.T) {
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	names := []string{"Old Mail/2024 Q1", "Projekte/Übersicht/Nächste Schritte"}
+	for _, name := range names {
+		storeTestMessages(t, name, MessageMeta{}, "From: a@b.c\r\nSubject: "+name+"\r\n\r\nbody\r\n")
+	}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(names, "Old Mail", "Projekte", "Projekte/Übersicht") {
+		if exists, err := folderExists(c, name); err != nil || !exists {
+			t.Errorf("folder %q not created, %v", name, err)
+		}
+	}
+
+	// names the server cannot take are skipped, or with -fail-fast fail the
+	// restore, naming the local folder
+	defer func(w io.Writer, ff bool) { out, failFast = w, ff }(out, failFast)
+	storeTestMessages(t, "Done*", MessageMeta{}, "Subject: wildcard\r\n\r\nbody\r\n")
+	buf := &bytes.Buffer{}
+	out = buf
+	if err := cmdRestore(c); err != nil || !strings.Contains(buf.String(), `local folder "Done*"`) {
+		t.Errorf("got %v and output %q, want the skipped local folder reported", err, buf.String())
+	}
+	failFast = true
+	err := cmdRestore(c)
+	var fe *fatalError
+	if !errors.As(err, &fe) || !strings.Contains(err.Error(), `local folder "Done*"`) {
+		t.Errorf("got %v, want a fatal error naming the local folder", err)
+	}
+}
+
+func TestConvertDelimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name, srcDelim, dstDelim, want string
+	}{
+		// from a Dovecot server to Gmail, and back
+		{"INBOX.Work.2024", ".", "/", "INBOX/Work/2024"},
+		{"Sent/2024", "/", ".", "Sent.2024"},
+		// older manifests don't record the delimiter, which is then taken as the server's
+		{"Work/2024", "", "/", "Work/2024"},
+		{"Work/2024", "/", "", "Work/2024"},
+	} {
+		if got := convertDelimiter(tc.name, tc.srcDelim, tc.dstDelim); got != tc.want {
+			t.Errorf("%s from %q to %q: got %s, want %s", tc.name, tc.srcDelim, tc.dstDelim, got, tc.want)
+		}
+	}
+}
+
+func TestRestoreCreatesFoldersWithServerDelimiter(t *testing.T) {
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	storeTestMessages(t, "INBOX.Work.2024", MessageMeta{}, "From: a@b.c\r\nSubject: 1\r\n\r\none\r\n")
+	m := &Manifest{Server: server, User: user, Delimiter: "."} // backed up from a Dovecot server
+	if err := m.Write(localStoragePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"INBOX/Work", "INBOX/Work/2024"} {
+		if exists, err := folderExists(c, name); err != nil || !exists {
+			t.Errorf("folder %s not created, %v", name, err)
+		}
+	}
+	if got := fetchTestSubjects(t, c, "INBOX/Work/2024"); fmt.Sprint(got) != "[1]" {
+		t.Errorf("got messages %v", got)
+	}
+}
+
+func TestStoredMessageMetaWithoutSenderOrDate(t *testing.T) {
+	f := &ImapFolderMeta{Name: "INBOX", UidValidity: 1}
+	received := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	sent := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		msg  *imap.Message
+		from string
+		date time.Time
+	}{
+		{"no envelope", &imap.Message{Uid: 1, InternalDate: received}, "", received},
+		{"no sender", &imap.Message{Uid: 2, InternalDate: received, Envelope: &imap.Envelope{Date: sent}}, "", received},
+		{"empty sender", &imap.Message{Uid: 3, InternalDate: received, Envelope: &imap.Envelope{From: []*imap.Address{{}}}}, "", received},
+		{"no internal date", &imap.Message{Uid: 4, Envelope: &imap.Envelope{Date: sent,
+			From: []*imap.Address{{MailboxName: "a", HostName: "b.c"}}}}, "a@b.c", sent},
+		{"neither", &imap.Message{Uid: 5}, "", time.Time{}},
+	} {
+		mm, from, date := f.storedMessageMeta(tc.msg)
+		if mm.Uid != tc.msg.Uid || from != tc.from {
+			t.Errorf("%s: got uid %d and sender %q, want %d and %q", tc.name, mm.Uid, from, tc.msg.Uid, tc.from)
+		}
+		if tc.date.IsZero() && time.Since(date) > time.Minute || !tc.date.IsZero() && !date.Equal(tc.date) {
+			t.Errorf("%s: got date %s, want %s", tc.name, date, tc.date)
+		}
+	}
+}
+
+func TestBackupStoresPlaceholderSender(t *testing.T) {
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	received := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	appendTestMessage(t, c, "Spam", nil, received, "Subject: no sender or date\r\n\r\nbody\r\n")
+	if err := cmdBackup(c, []string{"Spam"}); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(mboxFileName(localStoragePath, "Spam"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "From MAILER-DAEMON Sat Feb  3 04:05:06 2024\n"; !strings.HasPrefix(string(bs), want) {
+		t.Errorf("got %q, want it to start with %q", bs, want)
+	}
+}
+
+func TestUnicodeFolderNamesRoundTrip(t *testing.T) {
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	// sent as modified UTF-7 on the wire, e.g. Entw&APw-rfe
+	names := []string{"Café", "Café/Crème brûlée", "Entwürfe", "受信トレイ", "受信トレイ/日本語"}
+	for _, name := range names {
+		appendTestMessage(t, c, name, nil, time.Now(), "From: a@b.c\r\nSubject: "+name+"\r\n\r\nbody\r\n")
+	}
+	if err := cmdBackup(c, names); err != nil {
+		t.Fatal(err)
+	}
+
+	// local files are named like the folders, and map back to their exact names
+	for _, file := range []string{"Café.mbox", "Café/Crème brûlée.mbox", "受信トレイ/日本語.idx"} {
+		if _, err := os.Stat(localStoragePath + "/" + file); err != nil {
+			t.Error(err)
+		}
+	}
+	local, err := GetLocalFolderNames(localStoragePath)
+	if err != nil || fmt.Sprintf("%q", local) != fmt.Sprintf("%q", names) {
+		t.Errorf("got local folders %q, %v, want %q", local, err, names)
+	}
+
+	// restore recreates the folders with their names
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := c.Delete(names[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := ListFolders(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"INBOX"}, names...)
+	sort.Strings(want)
+	if got := fmt.Sprintf("%q", remote); got != fmt.Sprintf("%q", want) {
+		t.Errorf("got server folders %s", got)
+	}
+	for _, name := range names {
+		if got := fetchTestSubjects(t, c, name); len(got) != 1 || got[0] != name {
+			t.Errorf("%s: got messages %q", name, got)
+		}
+	}
+}
+
+// A listener whose connections hide MOVE from the capabilities the server announces
+type noMoveListener struct{ net.Listener }
+
+type noMoveConn struct{ net.Conn }
+
+func (l noMoveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return noMoveConn{conn}, nil
+}
+
+func (c noMoveConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(bytes.ReplaceAll(b, []byte(" MOVE"), nil)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// A server extension announcing UIDPLUS, with UID EXPUNGE removing only the given messages
+type uidPlusExtension struct{}
+
+func (uidPlusExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (uidPlusExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "EXPUNGE" {
+		return nil
+	}
+	return func() imapserver.Handler { return &uidExpunge{} }
+}
+
+type uidExpunge struct {
+	imapserver.Expunge
+	seqSet *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Parse(fields []interface{}) (err error) {
+	if len(fields) > 0 {
+		cmd.seqSet, err = imap.ParseSeqSet(fmt.Sprint(fields[0]))
+	}
+	return err
+}
+
+// Clears the deleted flag of other messages while expunging, and restores it afterwards
+func (cmd *uidExpunge) UidHandle(conn imapserver.Conn) error {
+	mbox := conn.Context().Mailbox
+	if mbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	deleted, err := mbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+	if err != nil {
+		return err
+	}
+	others := new(imap.SeqSet)
+	for _, uid := range deleted {
+		if !cmd.seqSet.Contains(uid) {
+			others.AddNum(uid)
+		}
+	}
+	if !others.Empty() {
+		if err := mbox.UpdateMessagesFlags(true, others, imap.RemoveFlags, []string{imap.DeletedFlag}); err != nil {
+			return err
+		}
+		defer mbox.UpdateMessagesFlags(true, others, imap.AddFlags, []string{imap.DeletedFlag})
+	}
+	return cmd.Expunge.Handle(conn)
+}
+
+func TestTrashWithoutMoveKeepsMessagesDeletedByOthers(t *testing.T) {
+	s := imapserver.New(memory.New())
+	s.Enable(uidPlusExtension{})
+	c := startTestServer(t, s, func(l net.Listener) net.Listener { return noMoveListener{l} })
+	if ok, _ := c.Support("MOVE"); ok {
+		t.Fatal("server announces MOVE")
+	}
+	before := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	appendTestMessage(t, c, "Trash", nil, before, "Subject: trash\r\n\r\nbody\r\n")
+	appendTestMessage(t, c, "Old", nil, before.AddDate(-1, 0, 0), "Subject: old\r\n\r\nbody\r\n")
+	appendTestMessage(t, c, "Old", []string{imap.DeletedFlag}, before.AddDate(1, 0, 0), "Subject: other\r\n\r\nbody\r\n")
+	appendTestMessage(t, c, "Old", nil, before.AddDate(1, 0, 0), "Subject: new\r\n\r\nbody\r\n")
+
+	// the old message is copied and expunged, the one another client flagged stays
+	n, err := DeleteMessagesBefore(context.Background(), c, "Old", before, "Trash")
+	if err != nil || n != 1 {
+		t.Fatalf("moved %d messages, %v, want 1", n, err)
+	}
+	if got := fmt.Sprint(fetchTestSubjects(t, c, "Old")); got != "[other new]" {
+		t.Errorf("got messages %s in Old, want [other new]", got)
+	}
+	if got := fmt.Sprint(fetchTestSubjects(t, c, "Trash")); got != "[trash old]" {
+		t.Errorf("got messages %s in Trash, want [trash old]", got)
+	}
+}
+
+func TestRestoreFlags(t *testing.T) {
+	defer func(u bool) { restoreUnread = u }(restoreUnread)
+	flags := []string{imap.SeenFlag, imap.RecentFlag, imap.FlaggedFlag, "$Label1"}
+	for _, tc := range []struct {
+		level  int
+		unread bool
+		want   string
+	}{
+		{flagsAll, false, `[\Seen \Flagged $Label1]`},
+		{flagsSystem, false, `[\Seen \Flagged]`},
+		{flagsNone, false, `[]`},
+		{flagsAll, true, `[\Flagged $Label1]`},
+		{flagsSystem, true, `[\Flagged]`},
+	} {
+		restoreUnread = tc.unread
+		if got := fmt.Sprint(restoreFlags(flags, tc.level)); got != tc.want {
+			t.Errorf("%s, unread %t: got %s, want %s", flagLevelNames[tc.level], tc.unread, got, tc.want)
+		}
+	}
+}
+
+func TestRestoreKeepsSeenWithoutRecent(t *testing.T) {
+	defer func(m map[string]string, u bool) { folderMap, restoreUnread = m, u }(folderMap, restoreUnread)
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	want := map[string][]string{"read": {`\Seen`}, "unread": {}, "flagged": {`\Flagged`, `\Seen`}}
+	for subject, flags := range want {
+		appendTestMessage(t, c, "Mail", flags, time.Now(), "From: a@b.c\r\nSubject: "+subject+"\r\n\r\nbody\r\n")
+	}
+	if err := cmdBackup(c, []string{"Mail"}); err != nil {
+		t.Fatal(err)
+	}
+	// an index of an older version, which stored \Recent
+	storeTestMessages(t, "Old", MessageMeta{Flags: []string{imap.RecentFlag, imap.SeenFlag}},
+		"From: a@b.c\r\nSubject: old\r\n\r\nbody\r\n")
+
+	folderMap = map[string]string{"Mail": "Restored", "Old": "Restored"}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	want["old"] = []string{`\Seen`}
+	if got := fetchTestFlags(t, c, "Restored"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got flags %v, want %v", got, want)
+	}
+
+	restoreUnread = true
+	folderMap = map[string]string{"Mail": "Unread"}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	unread := map[string][]string{"read": {}, "unread": {}, "flagged": {`\Flagged`}}
+	if got := fetchTestFlags(t, c, "Unread"); fmt.Sprint(got) != fmt.Sprint(unread) {
+		t.Errorf("with -restore-unread got flags %v, want %v", got, unread)
+	}
+}
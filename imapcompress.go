@@ -0,0 +1,153 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Capability of the COMPRESS=DEFLATE extension of RFC 4978
+const compressDeflateCapability = "COMPRESS=DEFLATE"
+
+// The COMPRESS command, which go-imap does not provide
+type compressCmd struct{}
+
+func (cmd *compressCmd) Command() *imap.Command {
+	return &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+}
+
+// The connection directly below the IMAP client, which can switch to DEFLATE
+// compression. go-imap's own connection upgrade loses data here, as its reader
+// goroutine is already waiting for the next response on the uncompressed
+// connection. The server sends nothing after accepting COMPRESS until the next
+// command, so data arriving after the switch is compressed, even if the read
+// started before.
+type compressConn struct {
+	net.Conn
+	mutex sync.Mutex
+	r     io.Reader     // decompressing reader once compressed, else nil
+	w     *flate.Writer // compressing writer once compressed, else nil
+	early []byte        // compressed data read by a read started before the switch
+}
+
+func (cc *compressConn) Read(b []byte) (int, error) {
+	cc.mutex.Lock()
+	r := cc.r
+	cc.mutex.Unlock()
+	if r == nil {
+		n, err := cc.Conn.Read(b)
+		cc.mutex.Lock()
+		r = cc.r
+		if r != nil {
+			cc.early = append(cc.early, b[:n]...)
+		}
+		cc.mutex.Unlock()
+		if r == nil || err != nil {
+			return n, err
+		}
+	}
+	return r.Read(b)
+}
+
+func (cc *compressConn) Write(b []byte) (int, error) {
+	if cc.w == nil {
+		return cc.Conn.Write(b)
+	}
+	return cc.w.Write(b)
+}
+
+// Flushes compressed data to the server. go-imap calls this after each command.
+func (cc *compressConn) Flush() error {
+	if cc.w == nil {
+		return nil
+	}
+	return cc.w.Flush()
+}
+
+// Reads the compressed data read early, then from the connection
+func (cc *compressConn) readCompressed(b []byte) (int, error) {
+	cc.mutex.Lock()
+	if len(cc.early) > 0 {
+		n := copy(b, cc.early)
+		cc.early = cc.early[n:]
+		cc.mutex.Unlock()
+		return n, nil
+	}
+	cc.mutex.Unlock()
+	return cc.Conn.Read(b)
+}
+
+// Switches to compression in both directions
+func (cc *compressConn) compress() error {
+	w, err := flate.NewWriter(cc.Conn, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	cc.w = w
+	cc.mutex.Lock()
+	cc.r = flate.NewReader(readerFunc(cc.readCompressed))
+	cc.mutex.Unlock()
+	return nil
+}
+
+// Adapts a function to io.Reader
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// Enables COMPRESS=DEFLATE on the given authenticated connection as selected with
+// -compress-imap. cc is the connection below the client. Compression runs inside
+// TLS, so -limit and the connection health statistics see the compressed traffic.
+func enableCompression(c *client.Client, cc *compressConn) error {
+	if compressImap == compressOff {
+		return nil
+	}
+	ok, err := c.Support(compressDeflateCapability)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if compressImap == compressOn {
+			return &fatalError{fmt.Errorf("server %s does not support %s", server, compressDeflateCapability)}
+		}
+		return nil
+	}
+	status, err := c.Execute(&compressCmd{}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if err := cc.compress(); err != nil {
+		return err
+	}
+	if verbose {
+		slog.Debug("Compressing IMAP traffic with DEFLATE")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// A server extension providing COMPRESS=DEFLATE, counting the connections compressed
+type deflateExtension struct {
+	upgrades atomic.Int32
+}
+
+func (ext *deflateExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{compressDeflateCapability}
+}
+
+func (ext *deflateExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "COMPRESS" {
+		return nil
+	}
+	return func() imapserver.Handler { return &deflateHandler{ext: ext} }
+}
+
+type deflateHandler struct {
+	ext       *deflateExtension
+	mechanism string
+}
+
+func (h *deflateHandler) Parse(fields []interface{}) error {
+	if len(fields) > 0 {
+		h.mechanism = strings.ToUpper(fmt.Sprint(fields[0]))
+	}
+	return nil
+}
+
+func (h *deflateHandler) Handle(conn imapserver.Conn) error {
+	if h.mechanism != "DEFLATE" {
+		return errors.New("unsupported compression mechanism")
+	}
+	return nil
+}
+
+func (h *deflateHandler) Upgrade(conn imapserver.Conn) error {
+	h.ext.upgrades.Add(1)
+	return conn.Upgrade(func(c net.Conn) (net.Conn, error) {
+		conn.WaitReady() // as STARTTLS does, keeps the server from writing while switching
+		w, err := flate.NewWriter(c, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &deflateServerConn{Conn: c, r: flate.NewReader(c), w: w}, nil
+	})
+}
+
+// The server side of a compressed connection. The server flushes after each response.
+type deflateServerConn struct {
+	net.Conn
+	r io.Reader
+	w *flate.Writer
+}
+
+func (c *deflateServerConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *deflateServerConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *deflateServerConn) Flush() error                { return c.w.Flush() }
+
+func TestBackupWithCompressionMatchesUncompressed(t *testing.T) {
+	defer func(mode string, batch int, sum bool) { compressImap, batchSize, checksum = mode, batch, sum }(compressImap, batchSize, checksum)
+	ext := &deflateExtension{}
+	s := imapserver.New(memory.New())
+	s.Enable(ext)
+	c := startTestServer(t, s, nil) // uncompressed, for adding messages
+	for i := 0; i < 10; i++ {
+		appendTestMessage(t, c, "Work", nil, time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC),
+			fmt.Sprintf("Subject: %d\r\n\r\n%s\r\n", i, strings.Repeat(fmt.Sprintf("line %d of a longer body\r\n", i), 50*i)))
+	}
+
+	// back up one message per fetch over a compressed connection, reconnect, then back up new messages
+	batchSize, checksum, compressImap = 1, true, compressOn
+	newTestStorage(t, formatMbox)
+	cc, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdBackup(cc, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	cc.Terminate()
+	if cc, err = reconnect(cc); err != nil {
+		t.Fatal(err)
+	}
+	defer logout(cc)
+	appendTestMessage(t, c, "Work", nil, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), "Subject: new\r\n\r\nafter reconnecting\r\n")
+	if err := cmdBackup(cc, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := ext.upgrades.Load(); n != 2 {
+		t.Errorf("compressed %d connections, want 2", n)
+	}
+	compressed, err := os.ReadFile(mboxFileName(localStoragePath, "Work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedIdx, err := readLocalIndex("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an uncompressed backup stores the same
+	compressImap = compressOff
+	newTestStorage(t, formatMbox)
+	if err := cmdBackup(c, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := os.ReadFile(mboxFileName(localStoragePath, "Work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(compressed, plain) {
+		t.Errorf("compressed backup stored %d bytes, uncompressed %d", len(compressed), len(plain))
+	}
+	plainIdx, err := readLocalIndex("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressedIdx.Messages) != 11 || len(plainIdx.Messages) != 11 {
+		t.Fatalf("got %d and %d messages, want 11", len(compressedIdx.Messages), len(plainIdx.Messages))
+	}
+	for i, mm := range compressedIdx.Messages {
+		if mm.Sha256 == "" || mm.Sha256 != plainIdx.Messages[i].Sha256 {
+			t.Errorf("message %d: checksum %q, want %q", i, mm.Sha256, plainIdx.Messages[i].Sha256)
+		}
+	}
+}
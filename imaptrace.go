@@ -0,0 +1,110 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+)
+
+// Destination of the IMAP protocol trace written with -debug-imap, or nil for none
+var imapTraceOut io.Writer
+
+// Guards imapTraceOut and the redaction state of all traces, as the reading and
+// writing goroutines of several connections trace concurrently
+var imapTraceMutex sync.Mutex
+
+// Number of connections traced so far, numbering their lines in the trace
+var imapTraceConns int32
+
+// Opens the destination of the IMAP protocol trace given by -debug-imap,
+// appending to a file, or writing to stderr for -
+func openImapTrace(name string) error {
+	if name == "-" {
+		imapTraceOut = os.Stderr
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("-debug-imap: %w", err)
+	}
+	imapTraceOut = f
+	return nil
+}
+
+// The protocol trace of a single connection. Lines sent by the client while it
+// authenticates are redacted, up to the tagged response of the server.
+type imapTrace struct {
+	id        int32
+	redacting string // tag of the authentication command in progress, if any
+}
+
+// Returns a debug writer for the go-imap client, tracing the lines it
+// sends with C: and the lines the server sends with S:
+func newImapTrace() io.Writer {
+	t := &imapTrace{id: atomic.AddInt32(&imapTraceConns, 1)}
+	return imap.NewDebugWriter(&traceWriter{t: t, client: true}, &traceWriter{t: t})
+}
+
+// Writes a complete line to the trace, redacting credentials
+func (t *imapTrace) line(client bool, line string) {
+	imapTraceMutex.Lock()
+	defer imapTraceMutex.Unlock()
+	dir := "S:"
+	if client {
+		dir = "C:"
+		if t.redacting != "" {
+			line = "***"
+		} else if fields := strings.Fields(line); len(fields) >= 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "LOGIN":
+				t.redacting, line = fields[0], fields[0]+" "+fields[1]+" ***"
+			case "AUTHENTICATE":
+				t.redacting, line = fields[0], strings.Join(fields[:min(len(fields), 3)], " ")+" ***"
+			}
+		}
+	} else if t.redacting != "" && strings.HasPrefix(line, t.redacting+" ") {
+		t.redacting = ""
+	}
+	fmt.Fprintf(imapTraceOut, "%d %s %s\n", t.id, dir, line)
+}
+
+// Splits one direction of the traffic of a connection into lines for its trace
+type traceWriter struct {
+	t       *imapTrace
+	client  bool
+	partial []byte
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		w.t.line(w.client, string(bytes.TrimRight(w.partial[:i], "\r")))
+		w.partial = w.partial[i+1:]
+	}
+}
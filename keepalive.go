@@ -0,0 +1,108 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Keeps a connection alive while it waits, e.g. for other workers of a pool or
+// for the user to confirm, by sending NOOP once no data was received for
+// -keepalive. IMAP clients process one command at a time, so commands must only
+// be sent between busy and idle, which keeps NOOP from overlapping them.
+type keepalive struct {
+	mutex sync.Mutex // held while the connection is busy or sending NOOP
+	c     *client.Client
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Starts keeping the given connection alive if -keepalive is set. The connection
+// starts out idle.
+func startKeepalive(c *client.Client) *keepalive {
+	k := &keepalive{c: c, done: make(chan struct{})}
+	if keepaliveInterval > 0 {
+		k.wg.Add(1)
+		go k.run()
+	}
+	return k
+}
+
+// Marks the connection busy with commands, waiting for a NOOP in flight to complete
+func (k *keepalive) busy() {
+	k.mutex.Lock()
+}
+
+// Marks the connection idle again. c is the connection to keep alive from now
+// on, which differs from the previous one after reconnecting.
+func (k *keepalive) idle(c *client.Client) {
+	k.c = c
+	k.mutex.Unlock()
+}
+
+// Stops keeping the connection alive. The connection must be idle.
+func (k *keepalive) stop() {
+	close(k.done)
+	k.wg.Wait()
+}
+
+func (k *keepalive) run() {
+	defer k.wg.Done()
+	ticker := time.NewTicker(keepaliveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			k.ping()
+		}
+	}
+}
+
+// Sends NOOP if the connection is idle and received no data for -keepalive.
+// Errors are logged only, the next command on the connection will notice them.
+func (k *keepalive) ping() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if isDisconnected(k.c) {
+		return
+	}
+	mc := getMonitoredConn(k.c)
+	if mc == nil {
+		return
+	}
+	if _, lastRead := mc.Stats(); time.Since(lastRead) < keepaliveInterval {
+		return
+	}
+
+	// Don't wait forever on a dead connection. The client sets the deadline for
+	// this NOOP, it is cleared again so it doesn't hit the idle connection.
+	k.c.Timeout = keepaliveInterval
+	err := k.c.Noop()
+	k.c.Timeout = 0
+	if derr := mc.SetDeadline(time.Time{}); err == nil {
+		err = derr
+	}
+	if err != nil {
+		slog.Warn("Keepalive failed", "err", err)
+	}
+}
@@ -19,69 +19,216 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 )
 
-// A local mail folder, consisting of an .mbox file and its corresponding index .idx
+// A local mail folder, consisting of an .mbox file and its corresponding index .idx.
+// In blob format, the .mbox file is replaced by a .blob file of length-prefixed messages.
+// With -compress gzip, it is replaced by an .mbox.gz file with one gzip member per message.
 type LocalFolder struct {
 	Name       string
-	Mbox       *os.File
+	Blob       bool     // whether Mbox is a .blob file
+	Gzip       bool     // whether Mbox is an .mbox.gz file
+	Variant    string   // mbox variant, determining how messages are stored
+	Mbox       *os.File // .mbox, .mbox.gz or .blob file holding the messages
 	Idx        *os.File
 	IdxWriter  *bufio.Writer  // for writing to the index line by line, in append mode
 	IdxScanner *bufio.Scanner // for reading the index line by line, in readonly mode
 	IdxLineNo  int
+	appended   int // messages appended since opening, for -checkpoint
 
 	err     error         // stores mbox error
 	mm      MessageMeta   // message
 	message *bytes.Buffer // stores Text() of message
 }
 
-func GetLocalFolderNames(path string) (folderNames []string, err error) {
-	dirInfos, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
+// Returns the name of the mailbox file of a local folder, with the extension given by -mbox-ext
+func mboxFileName(path, folderName string) string {
+	return localFileName(path, folderName) + mboxExt
+}
+
+// File extension of blob files holding length-prefixed messages
+const blobExt = ".blob"
+
+// File extension appended to compressed mailbox files
+const gzipExt = ".gz"
+
+// Returns the name of the file holding the messages of a local folder, either
+// the mailbox file, the compressed mailbox file or the blob file
+func dataFileName(path, folderName string, blob, gz bool) string {
+	if blob {
+		return localFileName(path, folderName) + blobExt
+	} else if gz {
+		return mboxFileName(path, folderName) + gzipExt
 	}
-	for _, dirInfo := range dirInfos {
-		if dirInfo.IsDir() {
-			continue
+	return mboxFileName(path, folderName)
+}
+
+// Returns whether the mailbox file of a local folder is compressed. Existing
+// folders keep their compression, new ones are compressed as given by -compress.
+func isFolderCompressed(path, folderName string) bool {
+	if s3Store != nil {
+		return false
+	}
+	if _, err := os.Stat(mboxFileName(path, folderName) + gzipExt); err == nil {
+		return true
+	}
+	if _, err := os.Stat(mboxFileName(path, folderName)); err == nil {
+		return false
+	}
+	return compress == compressGzip
+}
+
+// Returns the name of the index file of a local folder, with the extension given by -idx-ext
+func idxFileName(path, folderName string) string {
+	return localFileName(path, folderName) + idxExt
+}
+
+// Returns the sorted names of all mbox folders in the given path, derived from their index files
+func getMboxFolderNames(path string) (folderNames []string, err error) {
+	return findLocalFolders(path, []string{idxExt})
+}
+
+// Returns the sorted names of all mbox or blob folders in the given path, derived
+// from their mailbox or blob files, so folders with a missing index are included
+func getDataFolderNames(path string, blob bool) (folderNames []string, err error) {
+	if blob {
+		return findLocalFolders(path, []string{blobExt})
+	}
+	return findLocalFolders(path, []string{mboxExt, mboxExt + gzipExt})
+}
+
+// Returns the sorted names of the local folders in the given path and its
+// subdirectories, derived from the files with one of the given extensions.
+// Skips hidden directories, such as temporary ones.
+func findLocalFolders(path string, exts []string) (folderNames []string, err error) {
+	if s3Store != nil {
+		return s3Store.findFolders(path, exts)
+	}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != path && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		name := dirInfo.Name()
-		if strings.HasSuffix(name, ".idx") {
-			folderName := name[0 : len(name)-4]
-			folderNames = append(folderNames, folderName)
+		for _, ext := range exts {
+			if strings.HasSuffix(p, ext) {
+				rel, err := filepath.Rel(path, p[0:len(p)-len(ext)])
+				if err != nil {
+					return err
+				}
+				folderNames = append(folderNames, folderNameFromFile(filepath.ToSlash(rel)))
+				break
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	sort.Strings(folderNames)
 	return folderNames, nil
 }
 
+// Returns the local file name of a folder without extension. Hierarchical folder
+// names such as INBOX/Work map to subdirectories. On Windows, characters it does
+// not allow in file names are escaped.
+func localFileName(path, folderName string) string {
+	return path + "/" + folderFileName(folderName)
+}
+
+// Characters Windows does not allow in file names, escaped there as %XX along with % itself
+const windowsForbidden = `<>:"\|?*%`
+
+// Returns the folder name escaped for use in file names on Windows, and unchanged elsewhere
+func folderFileName(folderName string) string {
+	if runtime.GOOS != "windows" {
+		return folderName
+	}
+	var sb strings.Builder
+	for _, r := range folderName {
+		if r < 0x20 || strings.ContainsRune(windowsForbidden, r) {
+			fmt.Fprintf(&sb, "%%%02X", r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Returns the folder name for a file name relative to the local storage path,
+// reversing folderFileName
+func folderNameFromFile(name string) string {
+	if runtime.GOOS != "windows" {
+		return name
+	}
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
+
 // Open local mail folder message and index file for reading
-func OpenLocalFolderReadOnly(path, folderName string) (lf *LocalFolder, err error) {
-	lf = &LocalFolder{Name: folderName}
+func OpenLocalFolderReadOnly(path, folderName string, blob bool) (lf *LocalFolder, err error) {
+	lf = &LocalFolder{Name: folderName, Blob: blob, Gzip: !blob && isFolderCompressed(path, folderName), Variant: mboxVariant}
 
 	// open mailbox file readonly
-	lf.Mbox, err = os.Open(path + "/" + folderName + ".mbox")
+	lf.Mbox, err = os.Open(dataFileName(path, folderName, blob, lf.Gzip))
 	if err != nil {
 		return nil, err
 	}
 
 	// open index file readonly
-	lf.Idx, err = os.Open(path + "/" + folderName + ".idx")
+	lf.Idx, err = os.Open(idxFileName(path, folderName))
 	if err != nil {
 		lf.Mbox.Close()
 		return nil, err
 	}
 	lf.IdxScanner = bufio.NewScanner(lf.Idx)
+	lf.IdxScanner.Split(scanCompleteLines)
 	lf.IdxLineNo = 1
 
 	return lf, nil
 }
 
+// Splits index files into lines like bufio.ScanLines, but ignores an incomplete
+// last line without newline, as left behind by an interrupted backup
+func scanCompleteLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return bufio.ScanLines(data, atEOF)
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
 // Reads the entire index from a local mail folder, and returns it as folder metadata
 func (lf *LocalFolder) ReadAllIndex() (f *ImapFolderMeta, err error) {
 	f = &ImapFolderMeta{Name: lf.Name}
@@ -110,15 +257,110 @@ func (lf *LocalFolder) IdxScan() bool {
 	}
 
 	line := lf.IdxScanner.Text() // without terminating newline
-	_, err := fmt.Sscanf(line, "%d\t%d\t%d\t%d", &lf.mm.UidValidity, &lf.mm.Uid, &lf.mm.Size, &lf.mm.Offset)
+	mm, err := parseIndexLine(line)
 	if err != nil {
 		lf.err = fmt.Errorf("%s:%d: %s", lf.Idx.Name(), lf.IdxLineNo, err.Error())
 		return false
 	}
+	lf.mm = mm
 
 	return true
 }
 
+// Parses an index line into message metadata. The first four tab-separated columns
+// UidValidity, Uid, Size and Offset are required. Later columns were added over time,
+// and default to zero values if missing, so older indexes remain readable.
+func parseIndexLine(line string) (mm MessageMeta, err error) {
+	cols := strings.Split(line, "\t")
+	if len(cols) < 4 {
+		return MessageMeta{}, fmt.Errorf("expected at least 4 columns, got %d", len(cols))
+	}
+	if _, err := fmt.Sscanf(strings.Join(cols[:4], "\t"), "%d\t%d\t%d\t%d", &mm.UidValidity, &mm.Uid, &mm.Size, &mm.Offset); err != nil {
+		return MessageMeta{}, err
+	}
+	if len(cols) > 4 && cols[4] != "" {
+		if _, err := fmt.Sscanf(cols[4], "%d", &mm.SeqNum); err != nil {
+			return MessageMeta{}, err
+		}
+	}
+	if len(cols) > 5 {
+		mm.Flags = strings.Fields(cols[5])
+	}
+	if len(cols) > 6 {
+		mm.Sha256 = cols[6]
+	}
+	if len(cols) > 10 && strings.Join(cols[7:11], "") != "" {
+		env := &MessageEnvelope{MessageId: cols[7], Subject: cols[9], From: cols[10]}
+		if cols[8] != "" {
+			if env.Date, err = time.Parse(time.RFC3339, cols[8]); err != nil {
+				return MessageMeta{}, err
+			}
+		}
+		mm.Envelope = env
+	}
+	if len(cols) > 11 && cols[11] != "" {
+		if err := json.Unmarshal([]byte(cols[11]), &mm.Labels); err != nil {
+			return MessageMeta{}, fmt.Errorf("labels: %w", err)
+		}
+	}
+	if len(cols) > 12 && cols[12] != "" {
+		if mm.InternalDate, err = time.Parse(time.RFC3339, cols[12]); err != nil {
+			return MessageMeta{}, err
+		}
+	}
+	if len(cols) > 13 && cols[13] != "" {
+		if mm.ModSeq, err = strconv.ParseUint(cols[13], 10, 64); err != nil {
+			return MessageMeta{}, err
+		}
+	}
+	return mm, nil
+}
+
+// Formats message metadata as an index line, without terminating newline.
+// Flags are separated by spaces, which IMAP does not allow inside flags.
+// Optional columns are only written if they or later columns have a value. Labels
+// are written as JSON array, as they may contain spaces.
+func formatIndexLine(mm MessageMeta) string {
+	line := fmt.Sprintf("%d\t%d\t%d\t%d\t%d\t%s", mm.UidValidity, mm.Uid, mm.Size, mm.Offset, mm.SeqNum,
+		strings.Join(mm.Flags, " "))
+	env := &MessageEnvelope{}
+	if mm.Envelope != nil {
+		env = mm.Envelope
+	}
+	date, labels, internalDate, modSeq := "", "", "", ""
+	if !env.Date.IsZero() {
+		date = env.Date.Format(time.RFC3339)
+	}
+	if len(mm.Labels) > 0 {
+		bs, _ := json.Marshal(mm.Labels)
+		labels = string(bs)
+	}
+	if !mm.InternalDate.IsZero() {
+		internalDate = mm.InternalDate.Format(time.RFC3339)
+	}
+	if mm.ModSeq != 0 {
+		modSeq = strconv.FormatUint(mm.ModSeq, 10)
+	}
+	optional := []string{mm.Sha256, indexField(env.MessageId), date, indexField(env.Subject), indexField(env.From), labels, internalDate, modSeq}
+	for len(optional) > 0 && optional[len(optional)-1] == "" {
+		optional = optional[:len(optional)-1]
+	}
+	for _, col := range optional {
+		line += "\t" + col
+	}
+	return line
+}
+
+// Returns the given text for an index column, with tabs and line breaks replaced by spaces
+func indexField(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
 // Returns error from last index file line scan, behaves like bufio.Err()
 func (lf *LocalFolder) IdxErr() error {
 	return lf.err
@@ -129,22 +371,147 @@ func (lf *LocalFolder) IdxText() MessageMeta {
 	return lf.mm
 }
 
-// Reads given message with random access from the local folder into the provided buffer
+// Reads given message with random access from the local folder into the provided buffer.
+// Reads the full size given by the index, and reports a message ending early as truncated.
 func (lf *LocalFolder) ReadMessage(mm MessageMeta, buf *bytes.Buffer) error {
-	if _, err := lf.Mbox.Seek(int64(mm.Offset), io.SeekStart); err != nil {
+	r, err := lf.messageReader(mm)
+	if err != nil {
 		lf.err = err
 		return err
 	}
 
 	buf.Reset()
-	if _, err := io.CopyN(buf, lf.Mbox, int64(mm.Size)); err != nil {
+	if n, err := io.CopyN(buf, r, int64(mm.Size)); err == io.EOF || err == io.ErrUnexpectedEOF {
+		lf.err = fmt.Errorf("message uid %d at offset %d is truncated, read %d of %d bytes", mm.Uid, mm.Offset, n, mm.Size)
+		return lf.err
+	} else if err != nil {
 		lf.err = err
 		return err
 	}
+	if !lf.Blob {
+		if bs := mboxDecode(lf.Variant, buf.Bytes()); len(bs) != buf.Len() {
+			buf.Reset()
+			buf.Write(bs)
+		}
+	}
 
 	return nil
 }
 
+// Returns a reader for the given message. In a compressed mailbox file, the offset
+// points at the gzip member holding the From line and the message, so the member
+// is decompressed and the From line skipped.
+func (lf *LocalFolder) messageReader(mm MessageMeta) (io.Reader, error) {
+	if !lf.Gzip {
+		return io.NewSectionReader(lf.Mbox, int64(mm.Offset), int64(mm.Size)), nil
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(lf.Mbox, int64(mm.Offset), math.MaxInt64-int64(mm.Offset))))
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	r := bufio.NewReader(zr)
+	if _, err := r.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, int64(mm.Size)), nil
+}
+
+// Checks that the given message is framed as expected in the mailbox file: in mbox
+// format preceded by a From line and followed by a blank line and the next From line
+// or the end of the file, in blob format preceded by its length.
+func (lf *LocalFolder) checkFraming(mm MessageMeta) error {
+	switch {
+	case lf.Blob:
+		if mm.Offset < 8 {
+			return fmt.Errorf("offset %d leaves no room for the length", mm.Offset)
+		}
+		var length uint64
+		if err := binary.Read(io.NewSectionReader(lf.Mbox, int64(mm.Offset)-8, 8), binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length != uint64(mm.Size) {
+			return fmt.Errorf("stored length %d differs from size %d in index", length, mm.Size)
+		}
+		return nil
+
+	case lf.Gzip:
+		zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(lf.Mbox, int64(mm.Offset), math.MaxInt64-int64(mm.Offset))))
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		bs, err := io.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+		i := bytes.IndexByte(bs, '\n') + 1
+		if !bytes.HasPrefix(bs, []byte("From ")) || i == 0 {
+			return fmt.Errorf("gzip member does not start with a From line")
+		}
+		if len(bs)-i != int(mm.Size)+1 || bs[len(bs)-1] != '\n' {
+			return fmt.Errorf("gzip member holds %d bytes after the From line, expected %d", len(bs)-i, mm.Size+1)
+		}
+		return nil
+	}
+
+	before := make([]byte, 1024)
+	if mm.Offset < uint64(len(before)) {
+		before = before[:mm.Offset]
+	}
+	if _, err := lf.Mbox.ReadAt(before, int64(mm.Offset)-int64(len(before))); err != nil {
+		return err
+	}
+	if len(before) == 0 || before[len(before)-1] != '\n' {
+		return fmt.Errorf("not preceded by a From line")
+	}
+	line := before[bytes.LastIndexByte(before[:len(before)-1], '\n')+1:]
+	if !bytes.HasPrefix(line, []byte("From ")) {
+		return fmt.Errorf("not preceded by a From line")
+	}
+	after := make([]byte, 6)
+	n, err := lf.Mbox.ReadAt(after, int64(mm.Offset)+int64(mm.Size))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !(n == 1 && after[0] == '\n') && !(n == 6 && string(after) == "\nFrom ") {
+		return fmt.Errorf("not followed by a blank line and the next From line")
+	}
+	return nil
+}
+
+// Returns the envelope of the given message from the index, if stored there. Else
+// reads it with random access, by parsing only the message header from the mbox file.
+// Decodes the fields for display.
+func (lf *LocalFolder) ReadEnvelope(mm MessageMeta) (env MessageEnvelope, err error) {
+	if mm.Envelope != nil {
+		return *mm.Envelope, nil
+	}
+	r, err := lf.messageReader(mm)
+	if err != nil {
+		return env, fmt.Errorf("reading message %d in %s: %w", mm.Uid, lf.Name, err)
+	}
+	env, err = readEnvelope(bufio.NewReader(r))
+	if err != nil {
+		return env, fmt.Errorf("reading header of message %d in %s: %w", mm.Uid, lf.Name, err)
+	}
+	return env, nil
+}
+
+// Parses the envelope fields from a message header, decoding them for display
+func readEnvelope(r *bufio.Reader) (env MessageEnvelope, err error) {
+	h, err := textproto.ReadHeader(r)
+	if err != nil {
+		return env, err
+	}
+	mh := mail.Header{Header: message.Header{Header: h}}
+	env.Date, _ = mh.Date() // leave zero if missing or malformed
+	env.From = displayText(mh.Get("From"))
+	env.Subject = displayText(mh.Get("Subject"))
+	env.MessageId = strings.TrimSpace(mh.Get("Message-Id"))
+	return env, nil
+}
+
 // Scan the next message from mbox/idx, behaves like bufio.Scan().
 func (lf *LocalFolder) MboxScan() bool {
 	idxScan := lf.IdxScan()
@@ -176,24 +543,142 @@ func (lf *LocalFolder) MboxText() *bytes.Buffer {
 	return lf.message
 }
 
-// Open a local mail folder for appending messages
-func OpenLocalFolderAppend(path, folderName string) (lf *LocalFolder, err error) {
-	// Ensure path exists
-	if err := os.MkdirAll(path, 0700); err != nil {
+// Open a local mail folder for appending messages, keeping the compression of an existing folder.
+// Discards any incomplete messages left behind by an interrupted backup first.
+func OpenLocalFolderAppend(path, folderName string, blob bool) (lf *LocalFolder, err error) {
+	gz := !blob && isFolderCompressed(path, folderName)
+	if err := repairLocalFolder(path, folderName, blob, gz); err != nil {
 		return nil, err
 	}
+	return openLocalFolderWrite(path, folderName, blob, gz, 0)
+}
+
+// Truncates the index of a local folder after its last complete line, and the
+// mailbox file after the last message in the index. Both may have incomplete tails
+// if a backup was interrupted, as messages are written before their index records.
+func repairLocalFolder(path, folderName string, blob, gz bool) error {
+	idxName := idxFileName(path, folderName)
+	idx, err := os.ReadFile(idxName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	complete := bytes.LastIndexByte(idx, '\n') + 1
+	if complete < len(idx) {
+		slog.Warn("Discarding incomplete index line", "folder", folderName, "line", string(idx[complete:]))
+		if err := os.Truncate(idxName, int64(complete)); err != nil {
+			return err
+		}
+	}
+
+	// determine the end of the last message in the index
+	end := int64(0)
+	dataName := dataFileName(path, folderName, blob, gz)
+	if lines := bytes.Split(idx[:complete], []byte("\n")); len(lines) > 1 {
+		mm, err := parseIndexLine(string(lines[len(lines)-2]))
+		if err != nil {
+			return fmt.Errorf("%s: last line: %w", idxName, err)
+		}
+		switch {
+		case blob:
+			end = int64(mm.Offset) + int64(mm.Size)
+		case gz:
+			if end, err = gzipMemberEnd(dataName, int64(mm.Offset)); err != nil {
+				return fmt.Errorf("%s: reading last message: %w", dataName, err)
+			}
+		default:
+			end = int64(mm.Offset) + int64(mm.Size) + 1 // blank separator line
+		}
+	}
+
+	info, err := os.Stat(dataName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() < end {
+		return fmt.Errorf("%s is shorter than its index %s, use forget or -overwrite to rebuild the folder", dataName, idxName)
+	} else if info.Size() > end {
+		slog.Warn("Discarding incomplete messages from an interrupted backup", "folder", folderName, "bytes", info.Size()-end)
+		return os.Truncate(dataName, end)
+	}
+	return nil
+}
+
+// A reader counting the bytes consumed. Implements io.ByteReader, so the gzip
+// reader does not buffer and read ahead.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// Returns the offset after the end of the gzip member starting at the given offset
+func gzipMemberEnd(fileName string, offset int64) (int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	cr := &countingReader{r: bufio.NewReader(file)}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return 0, err
+	}
+	zr.Multistream(false)
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return 0, err
+	}
+	return offset + cr.n, nil
+}
+
+// Open a local mail folder for writing messages, discarding its previous contents.
+// Compresses the mailbox file as given by -compress.
+func OpenLocalFolderOverwrite(path, folderName string, blob bool) (lf *LocalFolder, err error) {
+	gz := !blob && compress == compressGzip
+	if !blob {
+		// remove the mailbox file with the other compression, if any
+		if err := os.Remove(dataFileName(path, folderName, false, !gz)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return openLocalFolderWrite(path, folderName, blob, gz, os.O_TRUNC)
+}
 
-	lf = &LocalFolder{}
+// Open a local mail folder for appending messages, with additional flags for os.OpenFile
+func openLocalFolderWrite(path, folderName string, blob, gz bool, flags int) (lf *LocalFolder, err error) {
+	// Ensure path exists, including the parents of hierarchical folders
+	if err := os.MkdirAll(filepath.Dir(idxFileName(path, folderName)), 0700); err != nil {
+		return nil, err
+	}
+
+	lf = &LocalFolder{Name: folderName, Blob: blob, Gzip: gz, Variant: mboxVariant}
 	// open mailbox file for appending
-	mboxName := path + "/" + folderName + ".mbox"
-	lf.Mbox, err = os.OpenFile(mboxName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	mboxName := dataFileName(path, folderName, blob, gz)
+	lf.Mbox, err = os.OpenFile(mboxName, os.O_APPEND|os.O_CREATE|os.O_WRONLY|flags, 0600)
 	if err != nil {
 		return nil, err
 	}
 
 	// open mailbox index file for appending
-	idxName := path + "/" + folderName + ".idx"
-	lf.Idx, err = os.OpenFile(idxName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	idxName := idxFileName(path, folderName)
+	lf.Idx, err = os.OpenFile(idxName, os.O_APPEND|os.O_CREATE|os.O_WRONLY|flags, 0600)
 	if err != nil {
 		lf.Mbox.Close()
 		return nil, err
@@ -202,38 +687,161 @@ func OpenLocalFolderAppend(path, folderName string) (lf *LocalFolder, err error)
 	return lf, nil
 }
 
-// Appends a message to a local mail folder
-func (lf *LocalFolder) Append(uidValidity, uid uint32, from string, when time.Time, bs []byte) error {
-	// write header into mbox file
-	header := fmt.Sprintf("From %s %s\n", from, when.UTC().Format(time.ANSIC))
-	_, err := fmt.Fprintf(lf.Mbox, "%s", header)
+// Sender written to the From line of messages without sender, as customary for mbox files
+const mboxPlaceholderSender = "MAILER-DAEMON"
+
+// Appends a message read from r to a local mail folder. Takes UidValidity, Uid, SeqNum,
+// Flags and checksum from the given metadata, and determines size and offset from the
+// written message. With -checksum, computes the checksum over the message as given.
+// The size is that of the message as stored in the mbox variant, e.g. with quoted From lines.
+// In blob format, the message is preceded by its length as 8-byte big-endian integer
+// instead of a From line, and not followed by a blank line. Messages without sender
+// get mboxPlaceholderSender in their From line. The message is copied to the file
+// in pieces, so its size does not matter as long as r knows it, see sizedReader.
+// If writing fails, the file is truncated to before the message.
+func (lf *LocalFolder) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	if from == "" {
+		from = mboxPlaceholderSender
+	}
+	r, size, err := sizedReader(r)
 	if err != nil {
 		return err
 	}
+	var sum hash.Hash
+	if checksum {
+		sum = sha256.New()
+		r = io.TeeReader(r, sum)
+	}
 
-	// retrieve current mbox file size in bytes, for storing in index file
-	pos, err := lf.Mbox.Seek(0, io.SeekCurrent)
+	// a message failing midway, e.g. on a dropped connection, is cut off again,
+	// so a resumed download appends behind the last complete message
+	start, err := lf.Mbox.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
-
-	// write message body into mbox file
-	_, err = lf.Mbox.Write(bs)
+	var pos, n int64
+	if lf.Gzip {
+		pos, n, err = lf.writeGzip(from, when, r, size)
+	} else {
+		pos, n, err = lf.write(from, when, r, size)
+	}
 	if err != nil {
+		if terr := lf.Mbox.Truncate(start); terr != nil {
+			slog.Warn("Cannot remove incomplete message", "folder", lf.Name, "uid", mm.Uid, "error", terr)
+		} else {
+			lf.Mbox.Seek(start, io.SeekStart)
+		}
 		return err
 	}
 
-	// write separating blank line into mbox file
-	_, err = fmt.Fprintf(lf.Mbox, "\n")
+	// write corresponding index record to idx file
+	if sum != nil {
+		mm.Sha256 = hex.EncodeToString(sum.Sum(nil))
+	}
+	mm.Size = uint32(n)
+	mm.Offset = uint64(pos)
+	slog.Debug("Stored message", "folder", lf.Name, "uid", mm.Uid, "offset", mm.Offset, "size", mm.Size)
+	return lf.appendIndex(mm)
+}
+
+// Writes a message of the given size to the mailbox or blob file, preceded by its
+// From line or length and followed by a blank line in mailbox files. Returns the
+// offset of the message in the file and its size as stored.
+func (lf *LocalFolder) write(from string, when time.Time, r io.Reader, size int64) (pos, n int64, err error) {
+	// write header into mbox file
+	if lf.Blob {
+		err = binary.Write(lf.Mbox, binary.BigEndian, uint64(size))
+	} else {
+		_, err = fmt.Fprintf(lf.Mbox, "From %s %s\n", from, when.UTC().Format(time.ANSIC))
+	}
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	// write corresponding index record to idx file
-	fmt.Fprintf(lf.IdxWriter, "%d\t%d\t%d\t%d\n", uidValidity, uid, len(bs), pos)
+	// retrieve current mbox file size in bytes, for storing in index file
+	pos, err = lf.Mbox.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// write message body and separating blank line into mbox file
+	w := bufio.NewWriterSize(lf.Mbox, 64*1024)
+	if lf.Blob {
+		n, err = io.Copy(w, r)
+		if err == nil && n != size {
+			err = fmt.Errorf("message has %d bytes, expected %d", n, size)
+		}
+	} else {
+		if n, err = mboxEncodeTo(w, lf.Variant, r, size); err == nil {
+			_, err = w.WriteString("\n")
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return pos, n, w.Flush()
+}
+
+// Writes a message to a compressed mailbox file as a gzip member of its own,
+// holding the From line, the message and the separating blank line. The index
+// records the offset of the member, so messages can be read with random access,
+// while the file as a whole decompresses to a regular mbox file. Returns the
+// offset of the member and the size of the message as stored.
+func (lf *LocalFolder) writeGzip(from string, when time.Time, r io.Reader, size int64) (pos, n int64, err error) {
+	pos, err = lf.Mbox.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	bw := bufio.NewWriterSize(lf.Mbox, 64*1024)
+	zw := gzip.NewWriter(bw)
+	if _, err := fmt.Fprintf(zw, "From %s %s\n", from, when.UTC().Format(time.ANSIC)); err != nil {
+		return 0, 0, err
+	}
+	if n, err = mboxEncodeTo(zw, lf.Variant, r, size); err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Fprintf(zw, "\n"); err != nil {
+		return 0, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, 0, err
+	}
+	return pos, n, bw.Flush()
+}
+
+// Writes the index record of an appended message. Every -checkpoint messages,
+// commits the folder to stable storage, so an interrupted backup loses at most
+// that many messages, and resumes after them.
+func (lf *LocalFolder) appendIndex(mm MessageMeta) error {
+	if _, err := fmt.Fprintf(lf.IdxWriter, "%s\n", formatIndexLine(mm)); err != nil {
+		return err
+	}
+	lf.appended++
+	if checkpoint > 0 && lf.appended%checkpoint == 0 {
+		return lf.Sync()
+	}
 	return nil
 }
 
+// Flushes the index writer, so readers of the index see all appended messages
+func (lf *LocalFolder) Flush() error {
+	return lf.IdxWriter.Flush()
+}
+
+// Flushes the index writer and commits both mbox and index file to stable storage
+// The mbox file goes first, so the index never points at messages not on disk.
+func (lf *LocalFolder) Sync() error {
+	if err := lf.Mbox.Sync(); err != nil {
+		return err
+	}
+	if lf.IdxWriter != nil {
+		if err := lf.IdxWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	return lf.Idx.Sync()
+}
+
 // Close a local mail folder
 func (lf *LocalFolder) Close() {
 	lf.Mbox.Close()
@@ -0,0 +1,180 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads all messages of a local folder with ReadMessage and with MboxScan
+func readTestMessages(t *testing.T, folder string) (read, scanned []string) {
+	t.Helper()
+	lf, err := OpenLocalFolderReadOnly(localStoragePath, folder, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	for _, mm := range f.Messages {
+		if err := lf.ReadMessage(mm, buf); err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, buf.String())
+	}
+
+	if lf, err = OpenLocalFolderReadOnly(localStoragePath, folder, false); err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	for lf.MboxScan() {
+		scanned = append(scanned, lf.MboxText().String())
+	}
+	if err := lf.MboxErr(); err != nil {
+		t.Fatal(err)
+	}
+	return read, scanned
+}
+
+func TestMboxRoundTripsFromLines(t *testing.T) {
+	msgs := []string{
+		"Subject: 1\r\n\r\nFrom the beginning\r\n>From quoted\r\n>>From twice\r\nFrom",
+		"Subject: 2\r\n\r\nFrom here\r\n",
+	}
+	for _, tc := range []struct {
+		variant string
+		stored  []string // lines expected in the mailbox file
+	}{
+		{mboxRd, []string{"\n>From the beginning\r\n", "\n>>From quoted\r\n", "\n>>>From twice\r\n", "\n>From here\r\n"}},
+		{mboxCl2, []string{"Content-Length: 52\r\n", "\nFrom the beginning\r\n", "\n>From quoted\r\n", "Content-Length: 11\r\n"}},
+	} {
+		newTestStorage(t, formatMbox)
+		mboxVariant = tc.variant
+		storeTestMessages(t, "INBOX", MessageMeta{}, msgs...)
+
+		bs, err := os.ReadFile(mboxFileName(localStoragePath, "INBOX"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range tc.stored {
+			if !bytes.Contains(bs, []byte(line)) {
+				t.Errorf("%s: %q not stored in %q", tc.variant, line, bs)
+			}
+		}
+		if scanned, err := scanMboxFile(mboxFileName(localStoragePath, "INBOX"), tc.variant); err != nil || len(scanned) != len(msgs) {
+			t.Errorf("%s: mailbox file splits into %d messages, want %d, %v", tc.variant, len(scanned), len(msgs), err)
+		}
+
+		read, scanned := readTestMessages(t, "INBOX")
+		if strings.Join(read, "|") != strings.Join(msgs, "|") {
+			t.Errorf("%s: ReadMessage got %q, want %q", tc.variant, read, msgs)
+		}
+		if strings.Join(scanned, "|") != strings.Join(msgs, "|") {
+			t.Errorf("%s: MboxScan got %q, want %q", tc.variant, scanned, msgs)
+		}
+	}
+}
+
+func TestReadMessageReadsLargeMessagesFully(t *testing.T) {
+	newTestStorage(t, formatMbox)
+	large := "Subject: large\r\n\r\n" + strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz\r\n", 200000)
+	small := "Subject: small\r\n\r\nsmall\r\n"
+	stored := storeTestMessages(t, "INBOX", MessageMeta{}, large, small)
+
+	read, scanned := readTestMessages(t, "INBOX")
+	for i, got := range [][]string{read, scanned} {
+		if len(got) != 2 || got[0] != large || got[1] != small {
+			t.Errorf("read %d: got %d messages, first of %d bytes, want %d bytes", i, len(got), len(got[0]), len(large))
+		}
+	}
+
+	// cut off the file in the middle of the large message
+	name := mboxFileName(localStoragePath, "INBOX")
+	if err := os.Truncate(name, int64(stored[0].Offset)+int64(stored[0].Size)/2); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := OpenLocalFolderReadOnly(localStoragePath, "INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	err = lf.ReadMessage(stored[0], &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "uid 1 at offset "+strconv.FormatUint(stored[0].Offset, 10)+" is truncated") {
+		t.Errorf("got %v, want the uid and offset of the truncated message", err)
+	}
+	if lf.MboxScan() || lf.MboxErr() == nil {
+		t.Errorf("MboxScan reads a truncated message")
+	}
+}
+
+func TestIndexKeepsSeqNum(t *testing.T) {
+	mm := MessageMeta{UidValidity: 5, Uid: 7, Size: 100, Offset: 40, SeqNum: 3}
+	got, err := parseIndexLine(formatIndexLine(mm))
+	if err != nil || got.SeqNum != 3 || got.Uid != 7 {
+		t.Errorf("got %+v, %v, want sequence number 3", got, err)
+	}
+
+	// indexes of older versions end after the offset
+	got, err = parseIndexLine("5\t7\t100\t40")
+	if err != nil || got.SeqNum != 0 || got.Offset != 40 {
+		t.Errorf("got %+v, %v, want sequence number 0", got, err)
+	}
+}
+
+func TestRestoreKeepsOrderOfSeqNum(t *testing.T) {
+	defer func(path string) { localStoragePath = path }(localStoragePath)
+	c := newTestServer(t)
+	localStoragePath = t.TempDir()
+
+	// stored out of order, as by a backup resumed after a message was skipped,
+	// and after a message of an older index without sequence number
+	lf, err := OpenStorageAppend(localStoragePath, "Mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, seqNum := range []uint32{0, 3, 1, 4, 2} {
+		mm := MessageMeta{UidValidity: 1, Uid: uint32(i + 1), SeqNum: seqNum}
+		msg := fmt.Sprintf("From: a@b.c\r\nSubject: %d\r\n\r\nbody\r\n", seqNum)
+		if err := lf.Append(mm, "a@b.c", time.Now(), strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = lf.Sync()
+	lf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Create("Mail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdRestore(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(fetchTestSubjects(t, c, "Mail")); got != "[0 1 2 3 4]" {
+		t.Errorf("restored in order %s, want [0 1 2 3 4]", got)
+	}
+}
@@ -0,0 +1,138 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// Lists the messages in the local folders, or those given with -r, which match the
+// -search expression, as a table or as JSON with -json. Reads one message at a time.
+// The dates of before: and since: refer to the Date header, as local storage has no
+// INTERNALDATE. With -export-dir, also exports the matches to mbox files there.
+func cmdSearch() error {
+	if searchExpr == "" {
+		return fmt.Errorf("search needs a search expression, given with -search")
+	}
+	criteria := imap.NewSearchCriteria()
+	if err := parseSearch(searchExpr, criteria); err != nil {
+		return err
+	}
+	if exportDir != "" && filepath.Clean(exportDir) == filepath.Clean(localStoragePath) {
+		return fmt.Errorf("export directory must differ from the local storage path %s", localStoragePath)
+	}
+	folderNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Search"), pb.OptionSetVisibility(showProgress && !jsonOutput))
+	details := []messageDetails{}
+	exported := 0
+	buf := &bytes.Buffer{}
+	for _, folderName := range folderNames {
+		bar.Describe("Search " + folderName)
+		d, err := searchFolder(folderName, criteria, buf)
+		if err != nil {
+			return fmt.Errorf("folder %s: %w", folderName, err)
+		}
+		details = append(details, d...)
+		if exportDir != "" && len(d) > 0 {
+			exported++
+		}
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		return printDetails(details)
+	}
+	fmt.Println()
+	if len(details) > 0 {
+		printDetails(details)
+		fmt.Println()
+	}
+	fmt.Printf("Found %d messages matching %s in %d folders\n", len(details), searchExpr, len(folderNames))
+	if exportDir != "" {
+		fmt.Printf("Exported the matches of %d folders to %s\n", exported, exportDir)
+	}
+	return nil
+}
+
+// Returns the messages of a local folder which match the given criteria. With
+// -export-dir, exports them to an mbox file there, replacing a previous export.
+func searchFolder(folderName string, criteria *imap.SearchCriteria, buf *bytes.Buffer) (details []messageDetails, err error) {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var out *LocalFolder
+	for _, mm := range f.Messages {
+		if err := lf.ReadMessage(mm, buf); err != nil {
+			return details, fmt.Errorf("uid %d: %w", mm.Uid, err)
+		}
+		e, err := message.Read(bytes.NewReader(buf.Bytes()))
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			slog.Warn("Skipping message", "folder", folderName, "uid", mm.Uid, "err", err)
+			continue
+		}
+		env, err := lf.ReadEnvelope(mm)
+		if err != nil {
+			return details, err
+		}
+		ok, err := backendutil.Match(e, mm.SeqNum, mm.Uid, env.Date, mm.Flags, criteria)
+		if err != nil || !ok {
+			continue // e.g. a malformed Date header
+		}
+		details = append(details, messageDetails{Folder: folderName, Uid: mm.Uid, Size: mm.Size, MessageEnvelope: env})
+
+		if exportDir == "" {
+			continue
+		}
+		if out == nil {
+			if out, err = OpenLocalFolderOverwrite(exportDir, folderName, false); err != nil {
+				return details, err
+			}
+			defer out.Close()
+			out.Variant = exportMboxVariant()
+		}
+		from, date := messageSender(buf.Bytes())
+		if err := out.Append(mm, from, date, bytes.NewReader(buf.Bytes())); err != nil {
+			return details, err
+		}
+	}
+	if out != nil {
+		return details, out.Sync()
+	}
+	return details, nil
+}
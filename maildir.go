@@ -0,0 +1,373 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subdirectories of a Maildir folder
+var maildirSubdirs = []string{"cur", "new", "tmp"}
+
+// Maildir info letters for IMAP system flags, in the ASCII order required in file names
+var maildirFlagLetters = []struct {
+	Letter byte
+	Flag   string
+}{
+	{'D', `\Draft`},
+	{'F', `\Flagged`},
+	{'R', `\Answered`},
+	{'S', `\Seen`},
+	{'T', `\Deleted`},
+}
+
+// A local mail folder in Maildir format, i.e. a directory with subdirectories
+// cur, new and tmp holding one file per message. Message metadata is encoded
+// in the file names, so no separate index is needed.
+type MaildirFolder struct {
+	Name    string
+	Dir     string
+	files   map[uint64]string // file names in cur or new by message Uuid, relative to Dir
+	pending []string          // files written since the last Sync
+}
+
+// Returns the directory of a Maildir folder
+func maildirDir(path, folderName string) string {
+	return localFileName(path, folderName)
+}
+
+// Returns the Maildir file name for a message, encoding its metadata. For example,
+// 1700000000.1_42,S=1234,N=7:2,FS is the message with UIDVALIDITY 1, UID 42, size 1234
+// and sequence number 7, stored at the given Unix time and flagged as \Flagged and \Seen.
+// Keywords cannot be expressed in Maildir info and are not stored.
+func maildirFileName(mm MessageMeta, stored time.Time) string {
+	letters := []byte{}
+	for _, fl := range maildirFlagLetters {
+		for _, f := range mm.Flags {
+			if f == fl.Flag {
+				letters = append(letters, fl.Letter)
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%d.%d_%d,S=%d,N=%d:2,%s", stored.Unix(), mm.UidValidity, mm.Uid, mm.Size, mm.SeqNum, letters)
+}
+
+// Parses message metadata from a Maildir file name written by maildirFileName.
+// Sets the offset to unknown, as it is meaningless for Maildir.
+func parseMaildirFileName(name string) (mm MessageMeta, err error) {
+	base, info := name, ""
+	if i := strings.Index(name, ":2,"); i >= 0 {
+		base, info = name[:i], name[i+3:]
+	}
+	fields := strings.Split(base, ",")
+	var stored int64
+	if _, err := fmt.Sscanf(fields[0], "%d.%d_%d", &stored, &mm.UidValidity, &mm.Uid); err != nil {
+		return MessageMeta{}, fmt.Errorf("file name %q not written by go-imap-backup", name)
+	}
+	for _, field := range fields[1:] {
+		var err error
+		switch {
+		case strings.HasPrefix(field, "S="):
+			_, err = fmt.Sscanf(field[2:], "%d", &mm.Size)
+		case strings.HasPrefix(field, "N="):
+			_, err = fmt.Sscanf(field[2:], "%d", &mm.SeqNum)
+		}
+		if err != nil {
+			return MessageMeta{}, fmt.Errorf("file name %q: %w", name, err)
+		}
+	}
+	mm.Flags = maildirInfoFlags(info)
+	mm.Offset = math.MaxUint64
+	return mm, nil
+}
+
+// Returns the IMAP system flags given by the letters of a Maildir info. Letters
+// without IMAP counterpart, such as P for passed, and keywords are ignored.
+func maildirInfoFlags(info string) []string {
+	flags := []string{}
+	for _, fl := range maildirFlagLetters {
+		if strings.IndexByte(info, fl.Letter) >= 0 {
+			flags = append(flags, fl.Flag)
+		}
+	}
+	return flags
+}
+
+// Returns metadata for a message file written by other mail software, given by its
+// path relative to the folder directory. The message gets a surrogate UID derived
+// from the unique part of its name, with UIDVALIDITY 0 as in reindex, its flags
+// from the Maildir info, and its delivery time from the name, else the file time.
+func (mf *MaildirFolder) foreignMessageMeta(rel string) (mm MessageMeta, err error) {
+	fi, err := os.Stat(mf.Dir + "/" + rel)
+	if err != nil {
+		return mm, err
+	}
+	base, info := filepath.Base(rel), ""
+	if i := strings.Index(base, ":2,"); i >= 0 {
+		base, info = base[:i], base[i+3:]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(base))
+	mm = MessageMeta{Uid: hash.Sum32(), Size: uint32(fi.Size()), Flags: maildirInfoFlags(info), Offset: math.MaxUint64}
+	if secs, err := strconv.ParseInt(strings.SplitN(base, ".", 2)[0], 10, 64); err == nil && secs > 0 {
+		mm.InternalDate = time.Unix(secs, 0).UTC()
+	} else {
+		mm.InternalDate = fi.ModTime().UTC()
+	}
+	return mm, nil
+}
+
+// Returns the sorted names of all Maildir folders in the given path, i.e. of
+// directories with a cur subdirectory. Nested folders are nested directories.
+func getMaildirFolderNames(path string) (folderNames []string, err error) {
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == path {
+			return nil
+		}
+		for _, sub := range maildirSubdirs {
+			if d.Name() == sub {
+				return filepath.SkipDir
+			}
+		}
+		if info, err := os.Stat(filepath.Join(p, "cur")); err == nil && info.IsDir() {
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			folderNames = append(folderNames, folderNameFromFile(filepath.ToSlash(rel)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(folderNames)
+	return folderNames, nil
+}
+
+// Opens a Maildir folder for reading. Returns an error satisfying os.IsNotExist if there is none.
+func OpenMaildirFolderReadOnly(path, folderName string) (*MaildirFolder, error) {
+	mf := &MaildirFolder{Name: folderName, Dir: maildirDir(path, folderName)}
+	if _, err := os.Stat(mf.Dir + "/cur"); err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
+
+// Opens a Maildir folder for appending messages, creating it if necessary
+func OpenMaildirFolderAppend(path, folderName string) (*MaildirFolder, error) {
+	mf := &MaildirFolder{Name: folderName, Dir: maildirDir(path, folderName)}
+	for _, sub := range maildirSubdirs {
+		if err := os.MkdirAll(mf.Dir+"/"+sub, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return mf, nil
+}
+
+// Opens a Maildir folder for writing messages, discarding its previous messages.
+// Leaves nested folders alone.
+func OpenMaildirFolderOverwrite(path, folderName string) (*MaildirFolder, error) {
+	for _, sub := range maildirSubdirs {
+		if err := os.RemoveAll(maildirDir(path, folderName) + "/" + sub); err != nil {
+			return nil, err
+		}
+	}
+	return OpenMaildirFolderAppend(path, folderName)
+}
+
+// Removes the messages of a Maildir folder, and its directory if nothing else is left in it
+func removeMaildirFolder(path, folderName string) (removed []string, err error) {
+	dir := maildirDir(path, folderName)
+	for _, sub := range maildirSubdirs {
+		if err := os.RemoveAll(dir + "/" + sub); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir+"/"+sub)
+	}
+	if err := os.Remove(dir); err == nil {
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// Reads the metadata of all messages from the file names in cur and new,
+// sorted by UIDVALIDITY and UID. Files written by other mail software get
+// surrogate UIDs, see foreignMessageMeta, numbered in the order of their names.
+func (mf *MaildirFolder) ReadAllIndex() (f *ImapFolderMeta, err error) {
+	f = &ImapFolderMeta{Name: mf.Name}
+	mf.files = map[uint64]string{}
+	foreign := []string{}
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(mf.Dir + "/" + sub)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			mm, err := parseMaildirFileName(e.Name())
+			if err != nil {
+				foreign = append(foreign, sub+"/"+e.Name())
+				continue
+			}
+			f.Messages = append(f.Messages, mm)
+			mf.files[mm.GetUuid()] = sub + "/" + e.Name()
+		}
+	}
+	sort.Slice(foreign, func(i, j int) bool { return filepath.Base(foreign[i]) < filepath.Base(foreign[j]) })
+	for i, rel := range foreign {
+		mm, err := mf.foreignMessageMeta(rel)
+		if err != nil {
+			slog.Warn("Skipping file", "folder", mf.Name, "file", rel, "err", err)
+			continue
+		}
+		for mm.Uid == 0 || mf.files[mm.GetUuid()] != "" {
+			mm.Uid++
+		}
+		mm.SeqNum = uint32(i + 1)
+		f.Messages = append(f.Messages, mm)
+		mf.files[mm.GetUuid()] = rel
+	}
+	sort.Slice(f.Messages, func(i, j int) bool {
+		return f.Messages[i].GetUuid() < f.Messages[j].GetUuid()
+	})
+	for _, mm := range f.Messages {
+		f.UidValidity = mm.UidValidity
+		f.Size += uint64(mm.Size)
+	}
+	return f, nil
+}
+
+// Returns the path of the file holding the given message
+func (mf *MaildirFolder) fileName(mm MessageMeta) (string, error) {
+	if mf.files == nil {
+		if _, err := mf.ReadAllIndex(); err != nil {
+			return "", err
+		}
+	}
+	name, ok := mf.files[mm.GetUuid()]
+	if !ok {
+		return "", fmt.Errorf("folder %s: no file for uid %d", mf.Name, mm.Uid)
+	}
+	return mf.Dir + "/" + name, nil
+}
+
+// Reads the given message into the provided buffer
+func (mf *MaildirFolder) ReadMessage(mm MessageMeta, buf *bytes.Buffer) error {
+	name, err := mf.fileName(mm)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf.Reset()
+	_, err = buf.ReadFrom(file)
+	return err
+}
+
+// Reads the envelope of the given message by parsing only its header
+func (mf *MaildirFolder) ReadEnvelope(mm MessageMeta) (env MessageEnvelope, err error) {
+	name, err := mf.fileName(mm)
+	if err != nil {
+		return env, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return env, err
+	}
+	defer file.Close()
+	env, err = readEnvelope(bufio.NewReader(file))
+	if err != nil {
+		return env, fmt.Errorf("reading header of message %d in %s: %w", mm.Uid, mf.Name, err)
+	}
+	return env, nil
+}
+
+// Appends a message to the Maildir folder. Writes it to tmp first and then
+// moves it to cur, so readers never see partial messages.
+func (mf *MaildirFolder) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	r, size, err := sizedReader(r)
+	if err != nil {
+		return err
+	}
+	mm.Size = uint32(size)
+	name := maildirFileName(mm, time.Now())
+	tmpName := mf.Dir + "/tmp/" + name
+	if n, _, err := writeMessageFile(tmpName, r); err != nil {
+		return err
+	} else if n != size {
+		return fmt.Errorf("message uid %d has %d bytes, expected %d", mm.Uid, n, size)
+	}
+	if err := os.Rename(tmpName, mf.Dir+"/cur/"+name); err != nil {
+		return err
+	}
+	if mf.files != nil {
+		mf.files[mm.GetUuid()] = "cur/" + name
+	}
+	mf.pending = append(mf.pending, mf.Dir+"/cur/"+name)
+	return nil
+}
+
+// Messages are visible as soon as they are appended, so there is nothing to flush
+func (mf *MaildirFolder) Flush() error {
+	return nil
+}
+
+// Commits the messages appended since the last call and the cur directory to stable storage
+func (mf *MaildirFolder) Sync() error {
+	for _, name := range append(mf.pending, mf.Dir+"/cur") {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	mf.pending = nil
+	return nil
+}
+
+// Closes a Maildir folder. Files are opened per message, so there is nothing to release
+func (mf *MaildirFolder) Close() {
+	mf.files = nil
+	mf.pending = nil
+}
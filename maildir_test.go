@@ -0,0 +1,100 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRestoreKeepsFlagsStoredInMaildirAndEml(t *testing.T) {
+	defer func(m map[string]string) { folderMap = m }(folderMap)
+	want := map[string][]string{
+		"1": {`\Flagged`, `\Seen`},
+		"2": {},
+		"3": {`\Answered`, `\Draft`},
+	}
+	for _, format := range []string{formatMaildir, formatEml} {
+		c := newTestServer(t)
+		newTestStorage(t, format)
+		for _, subject := range []string{"1", "2", "3"} {
+			appendTestMessage(t, c, "Flags", want[subject], time.Now(), fmt.Sprintf("From: a@b.c\r\nSubject: %s\r\n\r\nbody\r\n", subject))
+		}
+		if err := cmdBackup(c, []string{"Flags"}); err != nil {
+			t.Fatal(err)
+		}
+		folderMap = map[string]string{"Flags": "Restored"}
+		if err := cmdRestore(c); err != nil {
+			t.Fatal(err)
+		}
+		folderMap = nil
+		if got := fetchTestFlags(t, c, "Restored"); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: got flags %v, want %v", format, got, want)
+		}
+	}
+}
+
+func TestMaildirReadsFilesOfOtherSoftware(t *testing.T) {
+	newTestStorage(t, formatMaildir)
+	mf, err := OpenMaildirFolderAppend(localStoragePath, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cur/1700000000.M1P2.host:2,PRS": "Subject: replied\r\n\r\none\r\n",
+		"cur/1700000001.M2P2.host:2,":    "Subject: unread\r\n\r\ntwo\r\n",
+		"new/1700000002.M3P2.host":       "Subject: new\r\n\r\nthree\r\n",
+	}
+	for name, msg := range files {
+		if err := os.WriteFile(mf.Dir+"/"+name, []byte(msg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeTestMessages(t, "INBOX", MessageMeta{Flags: []string{`\Seen`}}, "Subject: own\r\n\r\nfour\r\n")
+
+	mf, err = OpenMaildirFolderReadOnly(localStoragePath, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mf.ReadAllIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	buf := &bytes.Buffer{}
+	for _, mm := range f.Messages {
+		if err := mf.ReadMessage(mm, buf); err != nil {
+			t.Fatal(err)
+		}
+		if int(mm.Size) != buf.Len() {
+			t.Errorf("uid %d: size %d, read %d bytes", mm.Uid, mm.Size, buf.Len())
+		}
+		got[buf.String()] = fmt.Sprintf("%d %v %d", mm.UidValidity, mm.Flags, mm.InternalDate.Unix())
+	}
+	want := map[string]string{
+		"Subject: replied\r\n\r\none\r\n": "0 [\\Answered \\Seen] 1700000000",
+		"Subject: unread\r\n\r\ntwo\r\n":  "0 [] 1700000001",
+		"Subject: new\r\n\r\nthree\r\n":   "0 [] 1700000002",
+		"Subject: own\r\n\r\nfour\r\n":    "1 [\\Seen] -62135596800",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Name of the manifest file inside a local storage path
+const manifestFileName = "manifest.json"
+
+// Manifest of a local storage path, recording which account it backs up
+type Manifest struct {
+	Server     string                 `json:"server"`
+	User       string                 `json:"user"`
+	Delimiter  string                 `json:"delimiter,omitempty"`  // hierarchy delimiter of the server, missing in older manifests
+	Format     string                 `json:"format,omitempty"`     // storage format, missing in older manifests, which use mbox
+	Mbox       string                 `json:"mbox,omitempty"`       // mbox variant, missing in older manifests, which use raw
+	Folders    map[string]FolderState `json:"folders,omitempty"`    // state of completely backed up folders
+	Subscribed []string               `json:"subscribed,omitempty"` // sorted folders subscribed on the server, missing in older manifests
+	Removed    map[string][]uint64    `json:"removed,omitempty"`    // GetUuid() of messages removed by dedup, by folder
+
+	foreign bool // of another account, used by a forced backup without recording changes
+}
+
+// Reads the manifest from the given local storage path.
+// Returns an error satisfying os.IsNotExist if there is none.
+func ReadManifest(path string) (m *Manifest, err error) {
+	var bs []byte
+	if s3Store != nil {
+		bs, err = s3Store.get(s3Key(path+"/"+manifestFileName), 0, 0)
+	} else {
+		bs, err = os.ReadFile(path + "/" + manifestFileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m = &Manifest{}
+	if err := json.Unmarshal(bs, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Writes the manifest to the given local storage path, creating it if necessary.
+// Writes to a temporary file first, so an existing manifest is replaced atomically.
+// With -store, writes the manifest object, which object storage replaces atomically.
+// Does nothing for the manifest of another account.
+func (m *Manifest) Write(path string) error {
+	if m.foreign {
+		return nil
+	}
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s3Store != nil {
+		return s3Store.put(s3Key(path+"/"+manifestFileName), bs)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	tmpName := path + "/" + manifestFileName + ".tmp"
+	if err := os.WriteFile(tmpName, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path+"/"+manifestFileName)
+}
@@ -0,0 +1,253 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Variants of the mbox format, differing in how lines starting with "From " in
+// a message are protected from being taken for the separator of the next one
+const (
+	mboxRaw  = "raw"     // no quoting, as written by older versions
+	mboxRd   = "mboxrd"  // lines matching ^>*From  get another >, which readers remove
+	mboxO    = "mboxo"   // lines matching ^From  get a >, which is ambiguous for lines which had one
+	mboxCl2  = "mboxcl2" // no quoting, a Content-Length header gives the length of the body
+	mboxAuto = ""        // the variant of existing local storage, else mboxrd
+)
+
+// The mbox variant of the local storage path, resolved by resolveFormat
+var mboxVariant = mboxRd
+
+// Validates the -mbox-variant flag
+func validateMboxVariant(variant string) error {
+	switch variant {
+	case mboxAuto, mboxRd, mboxO, mboxCl2:
+		return nil
+	}
+	return fmt.Errorf("unknown mbox variant %q, expected %s, %s or %s", variant, mboxRd, mboxO, mboxCl2)
+}
+
+// Copies a message of the given size from r to w as stored in a mailbox file of the
+// given variant. Works line by line, so messages of any size are stored without
+// holding them in memory. Returns the size of the message as stored.
+func mboxEncodeTo(w io.Writer, variant string, r io.Reader, size int64) (int64, error) {
+	cw := &countingWriter{w: w}
+	var err error
+	switch variant {
+	case mboxRd:
+		err = quoteLines(cw, r, func(line []byte) bool { return isQuotedFromLine(line, 0) })
+	case mboxO:
+		err = quoteLines(cw, r, func(line []byte) bool { return bytes.HasPrefix(line, []byte("From ")) })
+	case mboxCl2:
+		err = copyWithContentLength(cw, r, size)
+	default:
+		_, err = io.Copy(cw, r)
+	}
+	return cw.n, err
+}
+
+// Counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Copies r to w, prepending a > to every line for which quote returns true. Lines
+// longer than the read buffer are passed through in pieces.
+func quoteLines(w io.Writer, r io.Reader, quote func(line []byte) bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	lineStart := true
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if lineStart && quote(chunk) {
+				if _, err := w.Write([]byte{'>'}); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			lineStart = chunk[len(chunk)-1] == '\n'
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// Copies a message of the given size from r to w for mboxcl2, with a Content-Length
+// header giving the length of the body added as last header line. Only the header is
+// held in memory. Copies messages without body as they are.
+func copyWithContentLength(w io.Writer, r io.Reader, size int64) error {
+	br := bufio.NewReader(r)
+	header := &bytes.Buffer{}
+	for {
+		line, err := br.ReadBytes('\n')
+		header.Write(line)
+		if err == io.EOF {
+			_, err = w.Write(header.Bytes())
+			return err
+		} else if err != nil {
+			return err
+		}
+		if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
+			eol := string(line)
+			header.Truncate(header.Len() - len(eol))
+			fmt.Fprintf(header, "Content-Length: %d%s%s", size-int64(header.Len())-int64(len(eol)), eol, eol)
+			if _, err := w.Write(header.Bytes()); err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+// Returns a reader for the message in r along with its size. Takes the size from r
+// if it has a Len method like literals fetched from the server, else reads the
+// message into memory to determine it.
+func sizedReader(r io.Reader) (io.Reader, int64, error) {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return r, int64(l.Len()), nil
+	}
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// Returns the original message from one stored in a mailbox file of the given variant
+func mboxDecode(variant string, bs []byte) []byte {
+	switch variant {
+	case mboxRd:
+		return mboxrdUnquote(bs)
+	case mboxO:
+		return mboxoUnquote(bs)
+	case mboxCl2:
+		return removeContentLength(bs)
+	}
+	return bs
+}
+
+// Returns the message with the mboxrd quoting removed, taking a > from every line
+// matching ^>+From. Returns bs itself if no line is quoted.
+func mboxrdUnquote(bs []byte) []byte {
+	if !bytes.Contains(bs, []byte(">From ")) {
+		return bs
+	}
+	res := make([]byte, 0, len(bs))
+	for line := 0; line < len(bs); {
+		end := bytes.IndexByte(bs[line:], '\n') + 1
+		if end == 0 {
+			end = len(bs) - line
+		}
+		if isQuotedFromLine(bs[line:line+end], 1) {
+			res = append(res, bs[line+1:line+end]...)
+		} else {
+			res = append(res, bs[line:line+end]...)
+		}
+		line += end
+	}
+	return res
+}
+
+// Returns true if the line consists of at least min > characters followed by "From "
+func isQuotedFromLine(line []byte, min int) bool {
+	i := 0
+	for i < len(line) && line[i] == '>' {
+		i++
+	}
+	return i >= min && bytes.HasPrefix(line[i:], []byte("From "))
+}
+
+// Returns the message with the mboxo quoting removed, taking the > from every line
+// starting with ">From ". Lines which had it before quoting lose it too.
+func mboxoUnquote(bs []byte) []byte {
+	return mapLines(bs, []byte(">From "), func(line []byte) []byte {
+		return line[1:]
+	})
+}
+
+// Returns bs with every line starting with prefix replaced by the result of fn.
+// Returns bs itself if no line starts with prefix.
+func mapLines(bs, prefix []byte, fn func(line []byte) []byte) []byte {
+	if !bytes.Contains(bs, prefix) {
+		return bs
+	}
+	res := make([]byte, 0, len(bs)+16)
+	for line := 0; line < len(bs); {
+		end := bytes.IndexByte(bs[line:], '\n') + 1
+		if end == 0 {
+			end = len(bs) - line
+		}
+		if bytes.HasPrefix(bs[line:line+end], prefix) {
+			res = append(res, fn(bs[line:line+end])...)
+		} else {
+			res = append(res, bs[line:line+end]...)
+		}
+		line += end
+	}
+	return res
+}
+
+// Returns the offset of the blank line ending the header of a message, and its
+// line ending, or -1 if the message has no such line
+func headerEnd(bs []byte) (int, string) {
+	for line := 0; line < len(bs); {
+		end := bytes.IndexByte(bs[line:], '\n')
+		if end < 0 {
+			return -1, ""
+		}
+		switch {
+		case end == 0:
+			return line, "\n"
+		case end == 1 && bs[line] == '\r':
+			return line, "\r\n"
+		}
+		line += end + 1
+	}
+	return -1, ""
+}
+
+// Returns the message without the Content-Length header added for mboxcl2
+func removeContentLength(bs []byte) []byte {
+	end, _ := headerEnd(bs)
+	if end <= 0 {
+		return bs
+	}
+	last := bytes.LastIndexByte(bs[:end-1], '\n') + 1
+	if !bytes.HasPrefix(bs[last:end], []byte("Content-Length: ")) {
+		return bs
+	}
+	res := make([]byte, 0, len(bs))
+	res = append(res, bs[:last]...)
+	return append(res, bs[end:]...)
+}
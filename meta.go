@@ -16,21 +16,77 @@
 
 package main
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
 // Metadata for a folder and its messages on an IMAP server or in a local file
 type ImapFolderMeta struct {
-	Name        string
-	UidValidity uint32
-	Messages    []MessageMeta
-	Size        uint64 // total size of all messages in bytes
+	Name          string        `json:"name"`
+	UidValidity   uint32        `json:"uidValidity"`
+	UidNext       uint32        `json:"uidNext,omitempty"`       // next UID on the server when listing, or 0 if unknown
+	HighestModSeq uint64        `json:"highestModSeq,omitempty"` // HIGHESTMODSEQ before listing with CONDSTORE, or 0 if unknown
+	ChangedSince  uint64        `json:"changedSince,omitempty"`  // if nonzero, only messages with a higher MODSEQ are listed
+	Messages      []MessageMeta `json:"messages"`
+	Size          uint64        `json:"size"` // total size of all messages in bytes
 }
 
 // Metadata for an email message on an IMAP server or in a local file
 type MessageMeta struct {
-	SeqNum      uint32 // sequence number >=1 on IMAP server, or 0 if unknown
-	UidValidity uint32
-	Uid         uint32
-	Size        uint32
-	Offset      uint64 // offset in bytes in local .mbox file, or math.MaxUint64 if unknown
+	SeqNum       uint32           `json:"seqNum,omitempty"` // sequence number >=1 on IMAP server, or 0 if unknown
+	UidValidity  uint32           `json:"uidValidity"`
+	Uid          uint32           `json:"uid"`
+	Size         uint32           `json:"size"`
+	Offset       uint64           `json:"offset"`             // offset in bytes in local .mbox file, or math.MaxUint64 if unknown
+	Flags        []string         `json:"flags,omitempty"`    // IMAP flags such as \Seen, without the session flag \Recent
+	Sha256       string           `json:"sha256,omitempty"`   // hex SHA-256 of the message as downloaded, if stored with -checksum
+	Envelope     *MessageEnvelope `json:"envelope,omitempty"` // envelope fetched with the message, if stored in the index
+	Labels       []string         `json:"labels,omitempty"`   // Gmail labels, if stored with -gmail-labels
+	InternalDate time.Time        `json:"internalDate"`       // INTERNALDATE on the server, i.e. when it received the message, or zero if unknown
+	ModSeq       uint64           `json:"modSeq,omitempty"`   // MODSEQ on servers with CONDSTORE, or 0 if unknown
+}
+
+// Returns the hex SHA-256 checksum of a message, as stored in the index with -checksum
+func messageChecksum(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// Envelope fields of an email message, as shown by lquery -details
+type MessageEnvelope struct {
+	Date      time.Time `json:"date"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	MessageId string    `json:"messageId,omitempty"`
+}
+
+// Returns the envelope fields of a fetched message, decoded for display, or nil if
+// the server returned no envelope
+func newMessageEnvelope(e *imap.Envelope) *MessageEnvelope {
+	if e == nil {
+		return nil
+	}
+	env := &MessageEnvelope{Date: e.Date, Subject: displayText(e.Subject), MessageId: e.MessageId}
+	if len(e.From) > 0 {
+		env.From = formatAddress(e.From[0])
+	}
+	return env
+}
+
+// Returns the given IMAP flags without the session flag \Recent, which cannot be stored
+func storableFlags(flags []string) []string {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			res = append(res, f)
+		}
+	}
+	return res
 }
 
 // Create an 64-bit unique identifier from the folder Uid validity and the message Uid
@@ -62,3 +118,42 @@ func (f *ImapFolderMeta) GetMap() map[uint64]MessageMeta {
 	}
 	return res
 }
+
+// Returns the first of the given folders which has the same UIDVALIDITY and the
+// same non-empty set of messages as this folder, and may thus be an alias of it.
+// Returns nil if there is none.
+func (f *ImapFolderMeta) FindAlias(others []*ImapFolderMeta) *ImapFolderMeta {
+	if len(f.Messages) == 0 {
+		return nil
+	}
+	var fMap map[uint64]MessageMeta
+	for _, g := range others {
+		// compare cheap aggregates first, build the map only if necessary
+		if g.UidValidity != f.UidValidity || len(g.Messages) != len(f.Messages) || g.Size != f.Size {
+			continue
+		}
+		if fMap == nil {
+			fMap = f.GetMap()
+		}
+		same := true
+		for _, m := range g.Messages {
+			if _, ok := fMap[m.GetUuid()]; !ok {
+				same = false
+				break
+			}
+		}
+		if same {
+			return g
+		}
+	}
+	return nil
+}
+
+// Sorts the messages of this folder by their original sequence number on the server.
+// Messages with unknown sequence number, e.g. from older indexes, come first in
+// their original order.
+func (f *ImapFolderMeta) SortBySeqNum() {
+	sort.SliceStable(f.Messages, func(i, j int) bool {
+		return f.Messages[i].SeqNum < f.Messages[j].SeqNum
+	})
+}
@@ -0,0 +1,164 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// Copies the given folders from the account c is logged into to the destination
+// account given by -s2, -u2 and so on, creating folders as needed and renaming them
+// with -map. Messages are passed from one server to the other without storing them
+// locally, and keep their flags and internal dates. Messages whose Message-ID is
+// already in the destination folder are skipped, so an interrupted migration
+// continues where it stopped when run again.
+func cmdMigrate(c *client.Client, folderNames []string) error {
+	d, err := connectAccount(destAccount)
+	if err != nil {
+		return err
+	}
+	defer logout(d)
+
+	srcDelim, err := GetDelimiter(c)
+	if err != nil {
+		return err
+	}
+	dstDelim, err := GetDelimiter(d)
+	if err != nil {
+		return err
+	}
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
+	folders := make([]*ImapFolderMeta, len(folderNames))
+	remNames := make([]string, len(folderNames))
+	totalMsgs, totalSize := uint32(0), uint64(0)
+	filteredMsgs, filteredSize := uint32(0), uint64(0)
+
+	// Find messages in source folders which are not in the destination folders
+	for i, folderName := range folderNames {
+		bar.Describe("List " + folderName)
+		ctx, cancel := newOpContext()
+		folders[i], err = NewImapFolderMeta(ctx, c, folderName)
+		cancel()
+		if err != nil {
+			return err
+		}
+		totalMsgs += uint32(len(folders[i].Messages))
+		totalSize += folders[i].Size
+
+		remNames[i] = restoreTargetName(folderName, srcDelim, dstDelim)
+		if _, err := openRestoreTarget(d, folderName, remNames[i], dstDelim); err != nil {
+			return err
+		}
+		folders[i].Messages, folders[i].Size, err = filterMigrateMessages(c, d, folders[i], remNames[i])
+		if err != nil {
+			return err
+		}
+		filteredMsgs += uint32(len(folders[i].Messages))
+		filteredSize += folders[i].Size
+
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	// Print overall message summary and folder details
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s@%s to %s@%s (%d/%d messages, %s/%s)\n", user, server, user2, server2,
+		filteredMsgs, totalMsgs, humanReadableSize(filteredSize), humanReadableSize(totalSize))
+	for i, f := range folders {
+		if remNames[i] != f.Name {
+			fmt.Fprintf(out, "|- %s as %s (%d, %s)\n", f.Name, remNames[i], len(f.Messages), humanReadableSize(f.Size))
+		} else {
+			fmt.Fprintf(out, "|- %s (%d, %s)\n", f.Name, len(f.Messages), humanReadableSize(f.Size))
+		}
+	}
+	fmt.Fprintln(out)
+
+	// Copy the missing messages
+	bar = pb.NewOptions64(int64(filteredSize), pb.OptionSetDescription("Migrate"), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
+	for i, f := range folders {
+		if len(f.Messages) == 0 {
+			continue
+		}
+		bar.Describe("Migrate " + f.Name)
+		a := &migrateAppender{c: d, folder: remNames[i], level: flagsAll}
+		if noFlags {
+			a.level = flagsNone
+		}
+		ctx, cancel := newOpContext()
+		skipped, err := f.DownloadTo(ctx, c, a, bar)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(skipped) > 0 {
+			fmt.Fprintf(out, "Skipped messages without body in %s: uids %v\n", f.Name, skipped)
+		}
+	}
+	return nil
+}
+
+// Returns the messages of a source folder whose Message-ID is not in the given
+// destination folder, along with their total size. UIDs of different servers cannot
+// be compared as FilterOut does, so this matches by Message-ID. Messages without
+// Message-ID are always returned.
+func filterMigrateMessages(c, d *client.Client, f *ImapFolderMeta, remName string) (res []MessageMeta, size uint64, err error) {
+	srcIds, err := fetchMessageIdsByUid(c, f.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	dstIds, err := fetchMessageIds(d, remName)
+	if err != nil {
+		return nil, 0, err
+	}
+	res = []MessageMeta{}
+	for _, mm := range f.Messages {
+		if id := srcIds[mm.Uid]; id == "" || !dstIds[id] {
+			res = append(res, mm)
+			size += uint64(mm.Size)
+		}
+	}
+	return res, size, nil
+}
+
+// A message destination which appends messages to a folder on another server
+type migrateAppender struct {
+	c      *client.Client
+	folder string
+	level  int // flags kept on append, lowered if the server rejects them
+	buf    bytes.Buffer
+}
+
+// Appends the message with its flags and the given internal date
+func (a *migrateAppender) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	a.buf.Reset()
+	if _, err := a.buf.ReadFrom(r); err != nil {
+		return err
+	}
+	if err := appendMessage(a.c, a.folder, mm, when, a.buf.Bytes(), &a.level); err != nil {
+		return err
+	}
+	addTransferred(uint64(a.buf.Len()))
+	return nil
+}
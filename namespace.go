@@ -0,0 +1,216 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// A namespace as defined in RFC 2342, i.e. a mailbox name prefix and its hierarchy delimiter
+type Namespace struct {
+	Prefix    string
+	Delimiter string
+}
+
+// The personal, other users' and shared namespaces of an IMAP server
+type Namespaces struct {
+	Personal   []Namespace
+	OtherUsers []Namespace
+	Shared     []Namespace
+}
+
+// The NAMESPACE command, which go-imap does not provide
+type namespaceCmd struct{}
+
+func (cmd *namespaceCmd) Command() *imap.Command {
+	return &imap.Command{Name: "NAMESPACE"}
+}
+
+// Queries the namespaces of the IMAP server. Returns client.ErrExtensionUnsupported
+// if the server does not advertise the NAMESPACE capability.
+func GetNamespaces(c *client.Client) (ns *Namespaces, err error) {
+	if ok, err := c.Support("NAMESPACE"); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, client.ErrExtensionUnsupported
+	}
+
+	ns = &Namespaces{}
+	var parseErr error
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != "NAMESPACE" {
+			return responses.ErrUnhandled
+		}
+		if len(fields) < 3 {
+			parseErr = fmt.Errorf("malformed NAMESPACE response: %v", fields)
+			return nil
+		}
+		lists := []*[]Namespace{&ns.Personal, &ns.OtherUsers, &ns.Shared}
+		for i, list := range lists {
+			if *list, err = parseNamespaceList(fields[i]); err != nil {
+				parseErr = err
+				return nil
+			}
+		}
+		return nil
+	})
+
+	status, err := c.Execute(&namespaceCmd{}, handler)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return ns, nil
+}
+
+// Parses a list of namespace descriptions from a NAMESPACE response, where NIL means none
+func parseNamespaceList(field interface{}) ([]Namespace, error) {
+	if field == nil {
+		return nil, nil
+	}
+	items, ok := field.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed namespace list: %v", field)
+	}
+
+	res := []Namespace{}
+	for _, item := range items {
+		desc, ok := item.([]interface{})
+		if !ok || len(desc) < 2 {
+			return nil, fmt.Errorf("malformed namespace description: %v", item)
+		}
+		prefix, err := imap.ParseString(desc[0])
+		if err != nil {
+			return nil, err
+		}
+		if prefix, err = utf7.Encoding.NewDecoder().String(prefix); err != nil {
+			return nil, err
+		}
+		delim := ""
+		if desc[1] != nil {
+			if delim, err = imap.ParseString(desc[1]); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, Namespace{Prefix: prefix, Delimiter: delim})
+	}
+	return res, nil
+}
+
+// Retrieves a list of the selectable folders of another user from an Imap server,
+// using the other users' namespaces. Requires the NAMESPACE extension, and rights
+// to look up the other user's mailboxes.
+func ListOtherUserFolders(ctx context.Context, c *client.Client, otherUser string) (folderNames []string, err error) {
+	defer watchContext(ctx, c, &err)()
+
+	ns, err := GetNamespaces(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(ns.OtherUsers) == 0 {
+		return nil, fmt.Errorf("server has no namespace for other users")
+	}
+
+	for _, n := range ns.OtherUsers {
+		root := n.Prefix + otherUser
+		patterns := []string{root}
+		if n.Delimiter != "" {
+			patterns = append(patterns, root+n.Delimiter+"*")
+		}
+		for _, pattern := range patterns {
+			names, err := listSelectableFolders(c, pattern)
+			if err != nil {
+				return nil, err
+			}
+			folderNames = append(folderNames, names...)
+		}
+	}
+	return folderNames, nil
+}
+
+// Namespaces selectable with -namespace
+const (
+	namespacePersonal = "personal"
+	namespaceShared   = "shared"
+	namespaceOther    = "other"
+	namespaceAll      = "all"
+)
+
+// Retrieves a sorted list of the folders in the namespaces selected by which, one of the
+// namespace constants. The personal namespace is listed as by ListFolders, the shared and
+// other users' namespaces need the NAMESPACE extension, and include only selectable folders.
+// Returns client.ErrExtensionUnsupported if the server does not advertise NAMESPACE.
+func ListNamespaceFolders(ctx context.Context, c *client.Client, which string) (folderNames []string, err error) {
+	if which == namespacePersonal {
+		return ListFolders(ctx, c)
+	}
+	defer watchContext(ctx, c, &err)()
+
+	ns, err := GetNamespaces(c)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	if which == namespaceShared || which == namespaceAll {
+		namespaces = append(namespaces, ns.Shared...)
+	}
+	if which == namespaceOther || which == namespaceAll {
+		namespaces = append(namespaces, ns.OtherUsers...)
+	}
+
+	seen := map[string]bool{}
+	if which == namespaceAll {
+		personal, err := ListFolders(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range personal {
+			seen[name] = true
+		}
+		folderNames = personal
+	}
+	for _, n := range namespaces {
+		if n.Prefix == "" {
+			continue // same as the personal namespace
+		}
+		names, err := listSelectableFolders(c, n.Prefix+"*")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				folderNames = append(folderNames, name)
+			}
+		}
+	}
+	sort.Strings(folderNames)
+	return folderNames, nil
+}
@@ -0,0 +1,84 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Folder processing orders selectable with -folder-order
+const (
+	orderAlpha      = "alpha"
+	orderInboxFirst = "inbox-first"
+	orderSizeAsc    = "size-asc"
+	orderSizeDesc   = "size-desc"
+	orderCustom     = "custom:"
+)
+
+// Checks that the given folder order is one of the supported ones
+func validateFolderOrder(order string) error {
+	switch order {
+	case orderAlpha, orderInboxFirst, orderSizeAsc, orderSizeDesc:
+		return nil
+	}
+	if strings.HasPrefix(order, orderCustom) && len(order) > len(orderCustom) {
+		return nil
+	}
+	return fmt.Errorf("unknown folder order %s, must be %s, %s, %s, %s or %s<list>", order,
+		orderAlpha, orderInboxFirst, orderSizeAsc, orderSizeDesc, orderCustom)
+}
+
+// Sorts the given folders in place according to the given order. Folders are
+// listed alphabetically, so the sort is stable to keep that as secondary order.
+// Sizes are those of the folders as given, e.g. of the messages still to download.
+// With a custom list, the listed folders come first in the given order, then all others.
+func sortFolders(folders []*ImapFolderMeta, order string) {
+	var rank func(f *ImapFolderMeta) int
+	switch {
+	case order == orderInboxFirst:
+		rank = func(f *ImapFolderMeta) int {
+			if strings.EqualFold(f.Name, "INBOX") {
+				return 0
+			}
+			return 1
+		}
+	case strings.HasPrefix(order, orderCustom):
+		ranks := make(map[string]int)
+		for i, name := range splitFolderNames(order[len(orderCustom):]) {
+			ranks[norm.NFC.String(name)] = i
+		}
+		rank = func(f *ImapFolderMeta) int {
+			if r, ok := ranks[norm.NFC.String(f.Name)]; ok {
+				return r
+			}
+			return len(ranks)
+		}
+	case order == orderSizeAsc:
+		sort.SliceStable(folders, func(i, j int) bool { return folders[i].Size < folders[j].Size })
+		return
+	case order == orderSizeDesc:
+		sort.SliceStable(folders, func(i, j int) bool { return folders[i].Size > folders[j].Size })
+		return
+	default:
+		return
+	}
+	sort.SliceStable(folders, func(i, j int) bool { return rank(folders[i]) < rank(folders[j]) })
+}
@@ -0,0 +1,58 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Returns the path of the cache file for message dates of the given folder
+// on the current server and user, inside the temp directory
+func planCachePath(folderName string) string {
+	h := sha256.Sum256([]byte(server + "\x00" + user + "\x00" + folderName))
+	return filepath.Join(os.TempDir(), "go-imap-backup", hex.EncodeToString(h[:16])+".json")
+}
+
+// Loads cached message dates for the given folder, or returns nil if there are none
+func loadCachedFolderDates(folderName string) *FolderDates {
+	bs, err := os.ReadFile(planCachePath(folderName))
+	if err != nil {
+		return nil
+	}
+	fd := &FolderDates{}
+	if err := json.Unmarshal(bs, fd); err != nil || fd.Name != folderName {
+		return nil
+	}
+	return fd
+}
+
+// Saves message dates for a folder to the cache
+func saveCachedFolderDates(fd *FolderDates) error {
+	name := planCachePath(fd.Name)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(fd)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, bs, 0600)
+}
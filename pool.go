@@ -0,0 +1,101 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/emersion/go-imap/client"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// A pool of connections for processing folders in parallel, as given by -j.
+// IMAP clients process one command at a time, so each worker has its own.
+type connPool struct {
+	orig       *client.Client   // connection the pool was opened with, owned by the caller
+	clients    []*client.Client // current connection of each worker
+	keepalives []*keepalive     // keeping each worker's connection alive while it waits
+}
+
+// Opens a pool with the given connection and up to -j - 1 additional ones,
+// but no more than needed for n folders. If the server refuses additional
+// connections, continues with those opened so far.
+func newConnPool(c *client.Client, n int) *connPool {
+	p := &connPool{orig: c, clients: []*client.Client{c}}
+	for len(p.clients) < jobs && len(p.clients) < n {
+		nc, err := connect()
+		if err != nil {
+			slog.Warn("Unable to open additional connection", "err", err, "connections", len(p.clients))
+			break
+		}
+		p.clients = append(p.clients, nc)
+	}
+	for _, c := range p.clients {
+		p.keepalives = append(p.keepalives, startKeepalive(c))
+	}
+	return p
+}
+
+// Calls fn for each index in [0, n) on one of the pool's connections, with one
+// call running per connection at a time. fn returns the connection to continue
+// with, which differs from the given one after reconnecting. Stops handing out
+// indices once stop returns true. Returns when all calls are done.
+func (p *connPool) forEach(n int, stop func() bool, fn func(c *client.Client, i int) *client.Client) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := range p.clients {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range indices {
+				p.keepalives[w].busy()
+				p.clients[w] = fn(p.clients[w], i)
+				p.keepalives[w].idle(p.clients[w])
+			}
+		}(w)
+	}
+	for i := 0; i < n && !stop(); i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// Logs out of the connections opened by the pool, including replacements
+// of the original connection after reconnecting
+func (p *connPool) close() {
+	for _, k := range p.keepalives {
+		k.stop()
+	}
+	for _, c := range p.clients {
+		if c != p.orig {
+			logout(c)
+		}
+	}
+	p.clients, p.keepalives = nil, nil
+}
+
+// Guards progress bar descriptions, which are not safe for concurrent updates
+var barMutex sync.Mutex
+
+// Sets the description of a progress bar shared by the workers of a pool
+func describeBar(bar *pb.ProgressBar, description string) {
+	barMutex.Lock()
+	defer barMutex.Unlock()
+	bar.Describe(description)
+}
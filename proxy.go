@@ -0,0 +1,165 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Value of -proxy which connects directly, ignoring proxies from the environment
+const proxyNone = "none"
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// Returns the URL of the proxy to reach the server at addr through, as given with -proxy,
+// else from $ALL_PROXY or $HTTPS_PROXY unless $NO_PROXY excludes the server,
+// or nil to connect directly
+func proxyURL(addr string) (*url.URL, error) {
+	if proxyFlag == proxyNone {
+		return nil, nil
+	}
+	if proxyFlag != "" {
+		return parseProxyURL(proxyFlag)
+	}
+
+	// httpproxy handles $HTTPS_PROXY and $NO_PROXY, but not $ALL_PROXY
+	env := httpproxy.FromEnvironment()
+	if all := getenvAny("ALL_PROXY", "all_proxy"); all != "" {
+		env.HTTPSProxy = all
+	}
+	u, err := env.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return parseProxyURL(u.String())
+}
+
+// Parses a proxy URL, checking that its scheme is supported
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", s, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy %s, expected a socks5:// or http:// URL", s)
+}
+
+// Returns the value of the first of the given environment variables which is set
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Opens a TCP connection to the given address, through the proxy if there is one.
+// TLS is layered on top by the caller, so it verifies the server, not the proxy.
+func dialServer(addr string) (net.Conn, error) {
+	u, err := proxyURL(addr)
+	if err != nil {
+		return nil, &fatalError{err}
+	}
+	if u == nil {
+		return net.Dial("tcp", addr)
+	}
+	if verbose {
+		slog.Info("Connecting via proxy", "addr", addr, "proxy", u.Redacted())
+	}
+	dialer, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, &fatalError{err}
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// Dials through an HTTP proxy with the CONNECT method, as used for $HTTPS_PROXY
+type httpConnectDialer struct {
+	proxyAddr string
+	auth      string // value of the Proxy-Authorization header, or ""
+	forward   proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{proxyAddr: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s refused: %s", addr, resp.Status)
+	}
+	// the server may have sent its greeting along with the response
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// A connection whose first bytes were already read into a buffered reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
@@ -0,0 +1,135 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Capability of the QUOTA extension of RFC 2087
+const quotaCapability = "QUOTA"
+
+// Usage and limit of a resource under a quota, e.g. STORAGE in units of 1024 bytes
+type QuotaResource struct {
+	Name  string `json:"name"`
+	Usage uint64 `json:"usage"`
+	Limit uint64 `json:"limit"`
+}
+
+// A quota root of the server and its resources
+type Quota struct {
+	Root      string          `json:"root"`
+	Resources []QuotaResource `json:"resources"`
+}
+
+// The GETQUOTAROOT command, which go-imap does not provide
+type getQuotaRootCmd struct {
+	Mailbox string
+}
+
+func (cmd *getQuotaRootCmd) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	return &imap.Command{Name: "GETQUOTAROOT", Arguments: []interface{}{imap.FormatMailboxName(mailbox)}}
+}
+
+// Queries the quotas applying to the given mailbox. Returns client.ErrExtensionUnsupported
+// if the server does not advertise the QUOTA capability.
+func GetQuotaRoot(c *client.Client, mailbox string) (quotas []Quota, err error) {
+	if ok, err := c.Support(quotaCapability); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, client.ErrExtensionUnsupported
+	}
+
+	var parseErr error
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || (name != "QUOTA" && name != "QUOTAROOT") {
+			return responses.ErrUnhandled
+		}
+		if name == "QUOTAROOT" {
+			return nil // the roots are repeated in the QUOTA responses
+		}
+		q, err := parseQuota(fields)
+		if err != nil {
+			parseErr = err
+			return nil
+		}
+		quotas = append(quotas, *q)
+		return nil
+	})
+
+	status, err := c.Execute(&getQuotaRootCmd{mailbox}, handler)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return quotas, nil
+}
+
+// Parses the fields of a QUOTA response, i.e. the quota root followed by
+// a list of resource names, usages and limits
+func parseQuota(fields []interface{}) (*Quota, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed QUOTA response: %v", fields)
+	}
+	root, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list)%3 != 0 {
+		return nil, fmt.Errorf("malformed QUOTA resource list: %v", fields[1])
+	}
+	q := &Quota{Root: root}
+	for i := 0; i < len(list); i += 3 {
+		name, err := imap.ParseString(list[i])
+		if err != nil {
+			return nil, err
+		}
+		usage, err := parseQuotaNumber(list[i+1])
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseQuotaNumber(list[i+2])
+		if err != nil {
+			return nil, err
+		}
+		q.Resources = append(q.Resources, QuotaResource{Name: name, Usage: usage, Limit: limit})
+	}
+	return q, nil
+}
+
+// Parses a usage or limit of a QUOTA response, which may exceed 32 bits
+func parseQuotaNumber(f interface{}) (uint64, error) {
+	n, err := strconv.ParseUint(fmt.Sprint(f), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed QUOTA number %v", f)
+	}
+	return n, nil
+}
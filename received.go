@@ -17,8 +17,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -26,6 +28,20 @@ import (
 	_ "github.com/emersion/go-message/charset"
 )
 
+// Returns the date to upload a stored message with: its INTERNALDATE if stored in
+// the index, else the time of its first Received header, else the zero time,
+// which lets the server use the current time
+func restoreDate(mm MessageMeta, bs []byte) time.Time {
+	if !mm.InternalDate.IsZero() {
+		return mm.InternalDate
+	}
+	t, err := GetMessageReceived(bytes.NewReader(bs))
+	if err != nil {
+		slog.Warn("Unable to parse received time, using dummy", "uidValidity", mm.UidValidity, "uid", mm.Uid)
+	}
+	return t
+}
+
 // Parses given bytes as an email message, and returns the timestamp
 // at the end of the first "Received" header as a go time.Time value.
 // Returns empty time value time.Time{} if err is non-nil.
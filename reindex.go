@@ -0,0 +1,481 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// A message found by scanning a mailbox or blob file
+type scannedMessage struct {
+	offset uint64 // offset as recorded in the index
+	size   uint32 // size as stored, in the mbox variant of the folder
+}
+
+// Rebuilds the index of the local folders, or those given with -r, from their
+// mailbox or blob files. Keeps the records of an existing index which match a
+// message found, recovers uids of other messages from X-UID headers, and assigns
+// surrogate uids to messages without. The previous index is kept with suffix .bak.
+// Scans mailbox files in the variant given with -mbox-variant, else the recorded one.
+func cmdReindex() (err error) {
+	if storageFormat != formatMbox && storageFormat != formatBlob {
+		return fmt.Errorf("reindex supports the mbox and blob formats only, not %s", storageFormat)
+	}
+	folderNames, err := getDataFolderNames(localStoragePath, storageFormat == formatBlob)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+	if len(folderNames) == 0 {
+		fmt.Println("No folders to reindex")
+		return nil
+	}
+
+	// the manifest records the UIDVALIDITY of completely backed up folders
+	var folderStates map[string]FolderState
+	m, err := ReadManifest(localStoragePath)
+	if err == nil {
+		folderStates = m.Folders
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// an explicit -mbox-variant overrides the recorded one, e.g. for mailbox files
+	// written by other tools, and is recorded for reading them afterwards
+	if storageFormat == formatMbox && mboxVariantFlag != mboxAuto && mboxVariantFlag != mboxVariant {
+		mboxVariant = mboxVariantFlag
+		if m == nil {
+			m = &Manifest{Format: storageFormat} // checkManifest adds the account on backup
+		}
+		m.Mbox = mboxVariant
+		defer func() {
+			if err == nil {
+				err = m.Write(localStoragePath)
+			}
+		}()
+	}
+
+	totalMsgs, totalSurrogates := 0, 0
+	for _, folderName := range folderNames {
+		n, surrogates, err := reindexFolder(localStoragePath, folderName, folderStates[folderName].UidValidity)
+		if err != nil {
+			return fmt.Errorf("folder %s: %w", folderName, err)
+		}
+		fmt.Printf("Folder %s: %d messages, %d with surrogate uids\n", folderName, n, surrogates)
+		totalMsgs += n
+		totalSurrogates += surrogates
+	}
+
+	fmt.Printf("Reindexed %d folders with %d messages in %s\n", len(folderNames), totalMsgs, localStoragePath)
+	if totalSurrogates > 0 {
+		fmt.Printf("%d messages have surrogate uids, and will be downloaded again by the next backup of a changed folder\n", totalSurrogates)
+	}
+	return nil
+}
+
+// Rebuilds the index of a local folder from its mailbox or blob file. Uses the given
+// UIDVALIDITY for X-UID headers if the folder has no X-IMAPbase header and no usable
+// index records. Returns the number of messages indexed and of surrogate uids assigned.
+func reindexFolder(path, folderName string, uidValidity uint32) (n, surrogates int, err error) {
+	blob := storageFormat == formatBlob
+	gz := !blob && isFolderCompressed(path, folderName)
+	dataName := dataFileName(path, folderName, blob, gz)
+	var msgs []scannedMessage
+	switch {
+	case blob:
+		msgs, err = scanBlobFile(dataName)
+	case gz:
+		msgs, err = scanGzipMboxFile(dataName)
+	default:
+		msgs, err = scanMboxFile(dataName, mboxVariant)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// messages are read one at a time where needed, instead of the whole file
+	data, err := os.Open(dataName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer data.Close()
+	buf := &bytes.Buffer{}
+
+	// keep records of an existing index for messages at the same offset with the same size
+	idxName := idxFileName(path, folderName)
+	old := map[uint64]MessageMeta{}
+	if bs, err := os.ReadFile(idxName); err == nil {
+		complete := bytes.LastIndexByte(bs, '\n') + 1
+		for _, line := range strings.Split(string(bs[:complete]), "\n") {
+			if mm, err := parseIndexLine(line); err == nil {
+				old[mm.Offset] = mm
+				if uidValidity == 0 {
+					uidValidity = mm.UidValidity
+				}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+
+	// recover known uids first, so surrogates avoid them
+	mms := make([]MessageMeta, len(msgs))
+	used := map[uint64]bool{}
+	for i, sm := range msgs {
+		mm, ok := old[sm.offset]
+		known := ok && mm.Size == sm.size
+		if !known || (checksum && mm.Sha256 == "") {
+			if err := readScannedMessage(data, sm, gz, buf); err != nil {
+				return 0, 0, err
+			}
+		}
+		if !known {
+			mm = MessageMeta{}
+			h, _ := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(buf.Bytes()))) // partial header on error
+			if i == 0 {
+				if base := strings.Fields(h.Get("X-IMAPbase")); len(base) > 0 {
+					if uv, err := strconv.ParseUint(base[0], 10, 32); err == nil {
+						uidValidity = uint32(uv)
+					}
+				}
+			}
+			if uid, err := strconv.ParseUint(strings.TrimSpace(h.Get("X-UID")), 10, 32); err == nil && uid > 0 {
+				mm.Uid = uint32(uid)
+			}
+		}
+		mm.Size, mm.Offset, mm.SeqNum = sm.size, sm.offset, uint32(i+1)
+		if checksum && mm.Sha256 == "" {
+			if blob {
+				mm.Sha256 = messageChecksum(buf.Bytes())
+			} else {
+				mm.Sha256 = messageChecksum(mboxDecode(mboxVariant, buf.Bytes()))
+			}
+		}
+		mms[i] = mm
+	}
+	for i := range mms {
+		if mms[i].Uid != 0 && mms[i].UidValidity == 0 {
+			mms[i].UidValidity = uidValidity
+		}
+		if mms[i].Uid != 0 && mms[i].UidValidity != 0 {
+			used[mms[i].GetUuid()] = true
+		}
+	}
+
+	// assign surrogate uids with UIDVALIDITY 0, which no server uses. They are derived
+	// from the Message-ID or the message, so they are stable across reindexing.
+	for i, sm := range msgs {
+		mm := &mms[i]
+		if mm.Uid != 0 && mm.UidValidity != 0 {
+			continue
+		}
+		if err := readScannedMessage(data, sm, gz, buf); err != nil {
+			return 0, 0, err
+		}
+		h, _ := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+		hash := fnv.New32a()
+		if id := strings.TrimSpace(h.Get("Message-Id")); id != "" {
+			hash.Write([]byte(id))
+		} else {
+			hash.Write(buf.Bytes())
+		}
+		mm.UidValidity, mm.Uid = 0, hash.Sum32()
+		for mm.Uid == 0 || used[mm.GetUuid()] {
+			mm.Uid++
+		}
+		used[mm.GetUuid()] = true
+		surrogates++
+	}
+
+	// write the new index next to the old one, then replace it
+	tmpName := idxName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := bufio.NewWriter(file)
+	for _, mm := range mms {
+		fmt.Fprintf(w, "%s\n", formatIndexLine(mm))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return 0, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(idxName, idxName+".bak"); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmpName, idxName); err != nil {
+		return 0, 0, err
+	}
+	return len(mms), surrogates, nil
+}
+
+// Reads a message found by scanning a mailbox or blob file into buf, as stored.
+// In a compressed mailbox file, skips the From line of the gzip member at its offset.
+func readScannedMessage(file *os.File, sm scannedMessage, gz bool, buf *bytes.Buffer) error {
+	var r io.Reader = io.NewSectionReader(file, int64(sm.offset), int64(sm.size))
+	if gz {
+		zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(file, int64(sm.offset), math.MaxInt64-int64(sm.offset))))
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		br := bufio.NewReader(zr)
+		if _, err := br.ReadString('\n'); err != nil {
+			return err
+		}
+		r = io.LimitReader(br, int64(sm.size))
+	}
+	buf.Reset()
+	_, err := io.Copy(buf, r)
+	return err
+}
+
+// Scans a mailbox file of the given variant for messages. Messages start after a
+// From line, see isSeparatorLine, and end before the newline preceding the next one.
+// In mboxcl2, the Content-Length header gives the length of the body instead.
+// Reads the file line by line, and discards an incomplete message at the end left
+// by an interrupted backup.
+func scanMboxFile(fileName, variant string) (msgs []scannedMessage, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	br := bufio.NewReaderSize(file, 64*1024)
+	pos, start := int64(0), int64(-1) // offsets of the next line and the current message
+	lineStart := true                 // long lines are read in pieces
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			// a From line right after the previous one belongs to the message
+			if lineStart && pos > start && isSeparatorLine(chunk, variant) {
+				if start >= 0 {
+					msgs = append(msgs, scannedMessage{offset: uint64(start), size: uint32(pos - 1 - start)})
+				}
+				start = pos + int64(len(chunk))
+				if end := int64(-1); variant == mboxCl2 {
+					if end, err = contentLengthEnd(file, start, size, variant); err != nil {
+						return nil, err
+					} else if end >= 0 {
+						msgs = append(msgs, scannedMessage{offset: uint64(start), size: uint32(end - start)})
+						if _, err := file.Seek(end+1, io.SeekStart); err != nil {
+							return nil, err
+						}
+						br.Reset(file)
+						pos, start, lineStart = end+1, -1, true
+						continue
+					}
+				}
+			} else if pos == 0 {
+				return nil, fmt.Errorf("%s does not start with a From line", fileName)
+			}
+			pos += int64(len(chunk))
+			lineStart = chunk[len(chunk)-1] == '\n'
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	if start >= 0 && pos > start && lineStart {
+		msgs = append(msgs, scannedMessage{offset: uint64(start), size: uint32(pos - 1 - start)})
+	}
+	if end := mboxEnd(msgs); end < size {
+		slog.Warn("Ignoring incomplete message at the end", "file", fileName, "bytes", size-end)
+	}
+	return msgs, nil
+}
+
+// From line with a sender without spaces and a date in ANSI C format, as written by
+// backup and most other tools, optionally with seconds, time zone or trailing text
+var separatorLineRegexp = regexp.MustCompile(`^From \S+ +[A-Z][a-z]{2} [A-Z][a-z]{2} +\d{1,2} \d{1,2}:\d{2}(:\d{2})?( [A-Za-z]{3,5}| [+-]\d{4})? \d{4}\b`)
+
+// Returns whether the given data starts with the From line of a message in a mailbox
+// file of the given variant. In mboxrd, every line starting with "From " inside a
+// message is quoted, so every such line is one. Other variants leave lines unquoted,
+// or quote them ambiguously, so a line must carry sender and date to count.
+func isSeparatorLine(data []byte, variant string) bool {
+	eol := bytes.IndexByte(data, '\n')
+	if eol < 0 || !bytes.HasPrefix(data, []byte("From ")) {
+		return false
+	}
+	return variant == mboxRd || separatorLineRegexp.Match(data[:eol])
+}
+
+// Returns the end of the message starting at the given offset in a file of the
+// given size, as given by its Content-Length header, or -1 if it has none or it
+// does not end before a newline followed by a From line or the end of the file
+func contentLengthEnd(r io.ReaderAt, start, size int64, variant string) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, start, size-start))
+	header := &bytes.Buffer{}
+	for {
+		line, err := br.ReadSlice('\n')
+		header.Write(line)
+		if err == io.EOF {
+			return -1, nil
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return -1, err
+		}
+		if string(line) == "\n" || string(line) == "\r\n" {
+			break
+		}
+	}
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(header.Bytes())))
+	if err != nil {
+		return -1, nil
+	}
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return -1, nil
+	}
+	end := start + int64(header.Len()) + length
+	if end >= size {
+		return -1, nil
+	}
+	next := make([]byte, 1024) // the newline and the following From line
+	n, err := r.ReadAt(next[:min(int64(len(next)), size-end)], end)
+	if err != nil && err != io.EOF {
+		return -1, err
+	}
+	if next[0] != '\n' || (end+1 < size && !isSeparatorLine(next[1:n], variant)) {
+		return -1, nil
+	}
+	return end, nil
+}
+
+// Returns the offset after the newline following the last of the given messages
+func mboxEnd(msgs []scannedMessage) int64 {
+	if len(msgs) == 0 {
+		return 0
+	}
+	last := msgs[len(msgs)-1]
+	return int64(last.offset) + int64(last.size) + 1
+}
+
+// Scans a compressed mailbox file for messages, one per gzip member. Discards an
+// incomplete member at the end left by an interrupted backup.
+func scanGzipMboxFile(fileName string) (msgs []scannedMessage, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cr := &countingReader{r: bufio.NewReader(file)}
+	for {
+		offset := cr.n
+		zr, err := gzip.NewReader(cr)
+		if err == io.EOF {
+			return msgs, nil
+		} else if err != nil {
+			slog.Warn("Ignoring incomplete message", "file", fileName, "offset", offset, "err", err)
+			return msgs, nil
+		}
+		zr.Multistream(false)
+		br := bufio.NewReader(zr)
+		line, err := br.ReadSlice('\n')
+		if err == nil && !bytes.HasPrefix(line, []byte("From ")) {
+			return nil, fmt.Errorf("%s: gzip member at offset %d is not a From line and message", fileName, offset)
+		}
+		tail := &tailWriter{}
+		if err == nil {
+			_, err = io.Copy(tail, br)
+		}
+		if err != nil {
+			slog.Warn("Ignoring incomplete message", "file", fileName, "offset", offset, "err", err)
+			return msgs, nil
+		}
+		if tail.n == 0 || tail.last != '\n' {
+			return nil, fmt.Errorf("%s: gzip member at offset %d is not a From line and message", fileName, offset)
+		}
+		msgs = append(msgs, scannedMessage{offset: uint64(offset), size: uint32(tail.n - 1)})
+	}
+}
+
+// Counts the bytes written to it and keeps the last one
+type tailWriter struct {
+	n    int64
+	last byte
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		tw.n += int64(len(p))
+		tw.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
+
+// Scans a blob file for length-prefixed messages. Reads only the lengths, and
+// discards an incomplete message at the end left by an interrupted backup.
+func scanBlobFile(fileName string) (msgs []scannedMessage, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	pos := uint64(0)
+	prefix := make([]byte, 8)
+	for pos+8 <= size {
+		if _, err := file.ReadAt(prefix, int64(pos)); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint64(prefix)
+		if length > size-pos-8 {
+			break
+		}
+		msgs = append(msgs, scannedMessage{offset: pos + 8, size: uint32(length)})
+		pos += 8 + length
+	}
+	if pos < size {
+		slog.Warn("Ignoring incomplete message at the end", "file", fileName, "bytes", size-pos)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,173 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScanMboxFileSeparatorsByVariant(t *testing.T) {
+	// mailbox file of another tool, with a From line of an unusual date format,
+	// and a message line only the lax mboxo variant leaves unquoted
+	data := "From - Sat Jan  1 00:00:00 2000\n" +
+		"Subject: 1\n\nFrom the beginning\n" +
+		"\nFrom a@b.c Thu, 22 Feb 2024 17:06:01 +0100\n" +
+		"Subject: 2\n\n>From quoted\n" +
+		"\nFrom a@b.c Thu Feb 22 17:06 +0100 2024 remote from x\n" +
+		"Subject: 3\n\nthree\n" +
+		"\nFrom a@b.c Thu Feb 22 17:06:01 PST 2024\n" +
+		"Subject: 4\nContent-Length: 41\n\nFrom b@c.d Thu Feb 22 17:06:01 2024\nfour\n\n"
+	name := t.TempDir() + "/folder.mbox"
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		variant string
+		want    []string
+	}{
+		{mboxRd, []string{ // every From line separates, even the unquoted one
+			"Subject: 1\n",
+			"",
+			"Subject: 2\n\n>From quoted\n",
+			"Subject: 3\n\nthree\n",
+			"Subject: 4\nContent-Length: 41\n",
+			"four\n",
+		}},
+		{mboxO, []string{
+			"Subject: 1\n\nFrom the beginning\n\nFrom a@b.c Thu, 22 Feb 2024 17:06:01 +0100\nSubject: 2\n\n>From quoted\n",
+			"Subject: 3\n\nthree\n",
+			"Subject: 4\nContent-Length: 41\n",
+			"four\n",
+		}},
+		{mboxRaw, []string{
+			"Subject: 1\n\nFrom the beginning\n\nFrom a@b.c Thu, 22 Feb 2024 17:06:01 +0100\nSubject: 2\n\n>From quoted\n",
+			"Subject: 3\n\nthree\n",
+			"Subject: 4\nContent-Length: 41\n",
+			"four\n",
+		}},
+		{mboxCl2, []string{ // Content-Length covers a line which looks like a separator
+			"Subject: 1\n\nFrom the beginning\n\nFrom a@b.c Thu, 22 Feb 2024 17:06:01 +0100\nSubject: 2\n\n>From quoted\n",
+			"Subject: 3\n\nthree\n",
+			"Subject: 4\nContent-Length: 41\n\nFrom b@c.d Thu Feb 22 17:06:01 2024\nfour\n",
+		}},
+	} {
+		msgs, err := scanMboxFile(name, tc.variant)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.variant, err)
+		}
+		got := []string{}
+		for _, sm := range msgs {
+			got = append(got, data[sm.offset:sm.offset+uint64(sm.size)])
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", tc.variant, got, tc.want)
+		}
+	}
+}
+
+func TestReindexHonoursMboxVariantFlag(t *testing.T) {
+	newTestStorage(t, formatMbox)
+	defer func(flag string) { mboxVariantFlag = flag }(mboxVariantFlag)
+	if err := (&Manifest{Server: "imap.example.com", User: "user", Mbox: mboxRd}).Write(localStoragePath); err != nil {
+		t.Fatal(err)
+	}
+	data := "From a@b.c Thu Feb 22 17:06:01 2024\nSubject: 1\n\n>From here\nFrom there\n\n" +
+		"From a@b.c Thu Feb 22 17:06:02 2024\nSubject: 2\n\ntwo\n\n"
+	if err := os.WriteFile(mboxFileName(localStoragePath, "INBOX"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mboxVariantFlag = mboxO
+	if err := cmdReindex(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(localStoragePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mbox != mboxO || m.Server != "imap.example.com" {
+		t.Errorf("manifest records %s for %s, want %s for imap.example.com", m.Mbox, m.Server, mboxO)
+	}
+
+	lf, err := OpenStorageReadOnly(localStoragePath, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(f.Messages))
+	}
+}
+
+func TestReindexRebuildsIndexOfEachFormat(t *testing.T) {
+	defer func(c string, sum bool) { compress, checksum = c, sum }(compress, checksum)
+	checksum = true
+	long := strings.Repeat("x", 100*1024) // longer than the read buffer
+	msgs := []string{
+		"Message-ID: <1@x>\r\nSubject: 1\r\n\r\n" + long + "\r\nFrom here\r\n",
+		"Subject: 2\r\n\r\ntwo\r\n",
+	}
+	for _, tc := range []struct{ format, compress, variant string }{
+		{formatMbox, compressNone, mboxRd},
+		{formatMbox, compressNone, mboxCl2},
+		{formatMbox, compressGzip, mboxRd},
+		{formatBlob, compressNone, mboxRd},
+	} {
+		newTestStorage(t, tc.format)
+		compress, mboxVariant = tc.compress, tc.variant
+		stored := storeTestMessages(t, "INBOX", MessageMeta{}, msgs...)
+		if err := os.Remove(idxFileName(localStoragePath, "INBOX")); err != nil {
+			t.Fatal(err)
+		}
+
+		n, surrogates, err := reindexFolder(localStoragePath, "INBOX", 0)
+		if err != nil || n != 2 || surrogates != 2 {
+			t.Errorf("%s %s %s: got %d messages, %d surrogates, %v, want 2 and 2", tc.format, tc.compress, tc.variant, n, surrogates, err)
+			continue
+		}
+		local, err := readLocalIndex("INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, mm := range local.Messages {
+			if mm.Offset != stored[i].Offset || mm.Size != stored[i].Size || mm.Sha256 != stored[i].Sha256 {
+				t.Errorf("%s %s %s: message %d at %d with %d bytes and checksum %s, want %d, %d and %s", tc.format, tc.compress, tc.variant,
+					i, mm.Offset, mm.Size, mm.Sha256, stored[i].Offset, stored[i].Size, stored[i].Sha256)
+			}
+		}
+		lf, err := OpenStorageReadOnly(localStoragePath, "INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		for i, mm := range local.Messages {
+			if err := lf.ReadMessage(mm, buf); err != nil || buf.String() != msgs[i] {
+				t.Errorf("%s %s %s: message %d reads %.40q, %v after reindex", tc.format, tc.compress, tc.variant, i, buf.String(), err)
+			}
+		}
+		lf.Close()
+	}
+}
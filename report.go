@@ -0,0 +1,85 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Writer for command summaries. Goes to stdout, and into the report if one is configured.
+var out io.Writer = os.Stdout
+
+// Summaries and errors of the current run, collected for the report file
+var reportBuf bytes.Buffer
+
+// Total number of message bytes and messages downloaded from or uploaded to the server in this run
+var transferredBytes uint64
+var transferredMessages uint64
+
+// Adds a message with the given number of bytes to the transfer totals
+func addTransferred(n uint64) {
+	atomic.AddUint64(&transferredBytes, n)
+	atomic.AddUint64(&transferredMessages, 1)
+}
+
+// Starts collecting command summaries for the report file, if one is configured
+func startReport() {
+	if reportFile != "" {
+		out = io.MultiWriter(os.Stdout, &reportBuf)
+	}
+}
+
+// Records an error in the report
+func reportError(attempt int, err error) {
+	if reportFile != "" {
+		fmt.Fprintf(&reportBuf, "Error on %d. attempt: %s\n", attempt, err)
+	}
+}
+
+// Appends the collected summaries of this run to the report file, with a timestamp
+// header and a result line. runErr is nil for success. Logs errors instead of
+// returning them, as the run is over anyway.
+func writeReport(cmd string, start time.Time, runErr error) {
+	if reportFile == "" {
+		return
+	}
+	f, err := os.OpenFile(reportFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write report: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	result := "success"
+	var ffe *folderFailuresError
+	if errors.Is(runErr, errTimeLimit) || errors.As(runErr, &ffe) {
+		result = "partial, " + runErr.Error()
+	} else if runErr != nil {
+		result = "failure, " + runErr.Error()
+	}
+	fmt.Fprintf(f, "=== %s %s %s/%s ===\n", start.Format(time.RFC3339), cmd, server, user)
+	f.Write(reportBuf.Bytes())
+	fmt.Fprintf(f, "Result: %s, elapsed %s, transferred %d messages, %s\n\n", result,
+		time.Since(start).Round(time.Second), atomic.LoadUint64(&transferredMessages),
+		humanReadableSize(atomic.LoadUint64(&transferredBytes)))
+}
@@ -0,0 +1,107 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Retry settings for folders whose names match a glob pattern
+type folderRetryRule struct {
+	Glob         string
+	Retries      int
+	DelaySeconds int
+}
+
+// Per-folder retry rules, in order of precedence
+var folderRetryRules []folderRetryRule
+
+// Reads per-folder retry rules from the given file. Each line consists of a
+// glob pattern as understood by path.Match, the number of retries and the delay
+// in seconds between retries, separated by whitespace. Blank lines and lines
+// starting with # are ignored.
+func readFolderRetryRules(fileName string) (rules []folderRetryRule, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule folderRetryRule
+		if _, err := fmt.Sscan(line, &rule.Glob, &rule.Retries, &rule.DelaySeconds); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fileName, lineNo, err)
+		}
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fileName, lineNo, err)
+		}
+		if rule.Retries < 0 || rule.DelaySeconds < 0 {
+			return nil, fmt.Errorf("%s:%d: retries and delay must be non-negative", fileName, lineNo)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Returns the first retry rule matching the given folder name, or nil if none matches
+func findFolderRetryRule(folderName string) *folderRetryRule {
+	for i, rule := range folderRetryRules {
+		if ok, _ := path.Match(rule.Glob, folderName); ok {
+			return &folderRetryRules[i]
+		}
+	}
+	return nil
+}
+
+// Sleeps for the given duration. A variable so the wait between retries can be replaced
+var sleep = time.Sleep
+
+// Returns the delay before the given 1-based retry attempt: the base delay,
+// doubling with each attempt up to -retry-max-delay, with random jitter
+// spreading it over the upper half of that range. The jitter avoids scheduled
+// runs on many machines retrying in lockstep.
+func retryDelay(baseSeconds, attempt int) time.Duration {
+	d := time.Duration(baseSeconds) * time.Second
+	max := time.Duration(retryMaxDelaySeconds) * time.Second
+	if max < d {
+		max = d
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,143 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Replaces sleep for the duration of a test, recording the delays instead of waiting
+func stubSleep(t *testing.T) *[]time.Duration {
+	slept := &[]time.Duration{}
+	defer func(s func(time.Duration)) { t.Cleanup(func() { sleep = s }) }(sleep)
+	sleep = func(d time.Duration) { *slept = append(*slept, d) }
+	return slept
+}
+
+func TestRunRemoteCommandsRetriesUntilSuccess(t *testing.T) {
+	defer func(r, d, m int) { retries, retryDelaySeconds, retryMaxDelaySeconds = r, d, m }(retries, retryDelaySeconds, retryMaxDelaySeconds)
+	retries, retryDelaySeconds, retryMaxDelaySeconds = 4, 10, 15
+	slept := stubSleep(t)
+
+	// backup completes before the connection drops, delete fails twice, then succeeds
+	var runs []string
+	failures := 2
+	run := func(cmds []string) (int, error) {
+		runs = append(runs, fmt.Sprint(cmds))
+		if len(cmds) == 2 {
+			return 1, io.ErrUnexpectedEOF
+		}
+		if failures > 0 {
+			failures--
+			return 0, io.EOF
+		}
+		return len(cmds), nil
+	}
+	out := &bytes.Buffer{}
+	if status := runRemoteCommands([]string{"backup", "delete"}, run, out); status != 0 {
+		t.Errorf("got exit status %d, want 0", status)
+	}
+	if got := fmt.Sprint(runs); got != "[[backup delete] [delete] [delete] [delete]]" {
+		t.Errorf("got runs %s", got)
+	}
+	if out.String() != "Done, exiting.\n" {
+		t.Errorf("got output %q", out.String())
+	}
+
+	// delays double from 10s and are capped at 15s, with jitter over their upper half
+	if len(*slept) != 3 {
+		t.Fatalf("slept %v, want 3 delays", *slept)
+	}
+	for i, want := range []time.Duration{10 * time.Second, 15 * time.Second, 15 * time.Second} {
+		if d := (*slept)[i]; d < want/2 || d > want {
+			t.Errorf("delay %d: got %s, want between %s and %s", i+1, d, want/2, want)
+		}
+	}
+}
+
+func TestRunRemoteCommandsGivesUp(t *testing.T) {
+	defer func(r int) { retries = r }(retries)
+	retries = 3
+	for _, tc := range []struct {
+		name   string
+		err    error
+		runs   int
+		sleeps int
+		status int
+		out    string
+	}{
+		{"network", io.EOF, 4, 3, exitNetwork, "Too many errors, exiting.\n"},
+		{"retried in place", &retriedError{io.EOF}, 1, 0, exitNetwork, "Too many errors, exiting.\n"},
+		{"auth", &authError{errors.New("invalid credentials")}, 1, 0, exitAuth, ""},
+		{"time limit", errTimeLimit, 1, 0, exitPartial, "Partial, time limit reached, exiting.\n"},
+	} {
+		slept := stubSleep(t)
+		runs := 0
+		out := &bytes.Buffer{}
+		status := runRemoteCommands([]string{"backup"}, func([]string) (int, error) { runs++; return 0, tc.err }, out)
+		if status != tc.status || runs != tc.runs || len(*slept) != tc.sleeps || out.String() != tc.out {
+			t.Errorf("%s: got status %d after %d runs and %d sleeps, output %q, want %d, %d, %d, %q",
+				tc.name, status, runs, len(*slept), out.String(), tc.status, tc.runs, tc.sleeps, tc.out)
+		}
+	}
+}
+
+func TestRetryDelayIsCapped(t *testing.T) {
+	defer func(m int) { retryMaxDelaySeconds = m }(retryMaxDelaySeconds)
+	retryMaxDelaySeconds = 300
+	for attempt := 1; attempt <= 12; attempt++ {
+		want := 10 * time.Second << (attempt - 1)
+		if want > 300*time.Second {
+			want = 300 * time.Second
+		}
+		if d := retryDelay(10, attempt); d < want/2 || d > want {
+			t.Errorf("attempt %d: got %s, want between %s and %s", attempt, d, want/2, want)
+		}
+	}
+	if d := retryDelay(0, 3); d != 0 {
+		t.Errorf("got %s without base delay, want 0", d)
+	}
+}
+
+func TestAppendRetriesUpToRetries(t *testing.T) {
+	defer func(r int) { retries = r }(retries)
+	retries = 2
+	s := imapserver.New(memory.New())
+	c := startTestServer(t, s, nil)
+	s.Close()
+	c.Terminate()
+	slept := stubSleep(t)
+
+	// with the server gone, each attempt fails to reconnect
+	level := flagsAll
+	_, err := appendWithReconnect(c, "INBOX", MessageMeta{Uid: 1}, time.Now(), []byte("Subject: s\r\n\r\nbody\r\n"), &level)
+	var re *retriedError
+	if !errors.As(err, &re) || !isNetworkError(err) {
+		t.Errorf("got %v, want a network error retried in place", err)
+	}
+	if len(*slept) != retries {
+		t.Errorf("slept %d times, want %d", len(*slept), retries)
+	}
+}
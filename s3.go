@@ -0,0 +1,432 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client of S3-compatible object storage, such as AWS S3 or MinIO, speaking the
+// REST API with path-style requests signed with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+// Object storage given with -store, or nil if local storage is on disk
+var s3Store *s3Client
+
+// Minimum size of all but the last part of a multipart upload, as required by S3
+var s3MinPartSize int64 = 5 * 1024 * 1024
+
+// Maximum size of a part, and of the range copied into one. At least twice the
+// minimum part size, so that splitting a copy in equal parts keeps them above it.
+var s3MaxPartSize int64 = 5 * 1024 * 1024 * 1024
+
+// Parses a store URL of the form s3://bucket/prefix. Takes credentials from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region from
+// AWS_REGION or AWS_DEFAULT_REGION, else us-east-1, and the endpoint from
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, else that of AWS S3 in the region.
+func newS3Client(store string) (s3 *s3Client, prefix string, err error) {
+	u, err := url.Parse(store)
+	if err != nil {
+		return nil, "", fmt.Errorf("-store: %w", err)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, "", fmt.Errorf("-store: %q is not of the form s3://bucket/prefix", store)
+	}
+	s3 = &s3Client{
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		bucket:       u.Host,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		http:         &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s3.accessKey == "" || s3.secretKey == "" {
+		return nil, "", fmt.Errorf("-store: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s3.region == "" {
+		s3.region = "us-east-1"
+	}
+	endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + s3.region + ".amazonaws.com"
+	}
+	if s3.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, "", fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+	return s3, strings.Trim(u.Path, "/"), nil
+}
+
+// Returns the value of the first of the given environment variables which is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Error response of S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Sends a request for the given object, or for the bucket if key is "". Returns
+// the response if its status is one of the given ones, else an error, which
+// satisfies os.IsNotExist for missing objects.
+func (s3 *s3Client) do(method, key string, query url.Values, header http.Header, body []byte, status ...int) (*http.Response, error) {
+	u := *s3.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s3.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s3.sign(req, body, time.Now())
+
+	resp, err := s3.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range status {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: "s3://" + s3.bucket + "/" + key, Err: fs.ErrNotExist}
+	}
+	var e s3Error
+	bs, _ := io.ReadAll(resp.Body)
+	if xml.Unmarshal(bs, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s s3://%s/%s: %s %s", method, s3.bucket, key, e.Code, e.Message)
+}
+
+// Signs a request with AWS Signature Version 4 at the given time. Signs the host,
+// Range and all x-amz- headers, and the SHA-256 of the body.
+func (s3 *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s3.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := amzDate[:8] + "/" + s3.region + "/s3/aws4_request"
+	crSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crSum[:])
+
+	key := []byte("AWS4" + s3.secretKey)
+	for _, part := range []string{amzDate[:8], s3.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escapes a path as required by S3 for signing, i.e. all bytes except unreserved
+// characters and slashes
+func s3EscapePath(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// Returns the query sorted by key, with keys and values escaped as required by S3 for signing
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, strings.ReplaceAll(s3EscapePath(k), "/", "%2F")+"="+strings.ReplaceAll(s3EscapePath(v), "/", "%2F"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Reads an object, or with n > 0 the n bytes at the given offset
+func (s3 *s3Client) get(key string, offset, n int64) ([]byte, error) {
+	header := http.Header{}
+	if n > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	}
+	resp, err := s3.do(http.MethodGet, key, nil, header, nil, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Returns the size of an object
+func (s3 *s3Client) size(key string) (int64, error) {
+	resp, err := s3.do(http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+// Writes an object, replacing any previous one
+func (s3 *s3Client) put(key string, body []byte) error {
+	resp, err := s3.do(http.MethodPut, key, nil, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Removes an object. Removing a missing object succeeds.
+func (s3 *s3Client) remove(key string) error {
+	resp, err := s3.do(http.MethodDelete, key, nil, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Returns the keys of all objects starting with the given prefix
+func (s3 *s3Client) list(prefix string) (keys []string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s3.do(http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Contents              []struct{ Key string }
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// Appends data to an object of the given size, creating it if the size is 0. S3
+// objects cannot be appended to, so the object is replaced by a multipart upload
+// copying its previous contents on the server side, or, while smaller than the
+// minimum part size, downloaded and uploaded again along with the data.
+func (s3 *s3Client) appendTo(key string, size int64, data []byte) error {
+	if size < s3MinPartSize {
+		old := []byte{}
+		if size > 0 {
+			var err error
+			if old, err = s3.get(key, 0, size); err != nil {
+				return err
+			}
+		}
+		return s3.put(key, append(old[:size:size], data...))
+	}
+
+	resp, err := s3.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var initiated struct{ UploadId string }
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := s3.completeAppend(key, initiated.UploadId, size, data); err != nil {
+		if resp, aerr := s3.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadId}}, nil, nil, http.StatusNoContent); aerr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// Uploads the parts of a multipart upload appending data to an object of the
+// given size, and completes it
+func (s3 *s3Client) completeAppend(key, uploadId string, size int64, data []byte) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	parts := []part{}
+
+	// Copy the previous contents in parts of equal size, as few as the maximum allows
+	numCopies := (size + s3MaxPartSize - 1) / s3MaxPartSize
+	copySize := (size + numCopies - 1) / numCopies
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3EscapePath("/"+s3.bucket+"/"+key))
+	query := url.Values{"uploadId": {uploadId}}
+	for from := int64(0); from < size; from += copySize {
+		n := len(parts) + 1
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", from, min(from+copySize, size)-1))
+		query.Set("partNumber", strconv.Itoa(n))
+		resp, err := s3.do(http.MethodPut, key, query, header, nil, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var copied struct{ ETag string }
+		err = xml.NewDecoder(resp.Body).Decode(&copied)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part{n, copied.ETag})
+	}
+
+	n := len(parts) + 1
+	query.Set("partNumber", strconv.Itoa(n))
+	resp, err := s3.do(http.MethodPut, key, query, nil, data, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	parts = append(parts, part{n, resp.Header.Get("ETag")})
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []part
+	}{Part: parts})
+	if err != nil {
+		return err
+	}
+	if resp, err = s3.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, body, http.StatusOK); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 may report a failure with status 200 once it has started responding
+	var e s3Error
+	if bs, err := io.ReadAll(resp.Body); err != nil {
+		return err
+	} else if xml.Unmarshal(bs, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 completing upload of s3://%s/%s: %s %s", s3.bucket, key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// Commands which modify local storage in ways object storage does not support
+var storeUnsupported = map[string]bool{"sync": true, "reindex": true, "dedup": true}
+
+// Checks that the given commands support -store
+func checkStoreCommands(cmds []string) error {
+	if archiveFile != "" {
+		return fmt.Errorf("-store and -archive cannot be combined")
+	}
+	if isFlagSet("l") {
+		return fmt.Errorf("-store and -l cannot be combined, give the path as prefix of -store")
+	}
+	for _, cmd := range cmds {
+		if storeUnsupported[cmd] {
+			return fmt.Errorf("%s does not support -store", cmd)
+		}
+	}
+	return nil
+}
+
+// Connects to the object storage given with -store, and uses its prefix as local
+// storage path. Without prefix, keeps the path defaulted from server and user.
+func openStore() (err error) {
+	var prefix string
+	if s3Store, prefix, err = newS3Client(storeURL); err != nil {
+		return err
+	}
+	if prefix != "" {
+		localStoragePath = prefix
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A mail folder in object storage given with -store, consisting of an .mbox or .blob
+// object and its index object, laid out like a LocalFolder. Objects cannot be
+// appended to, so appended messages are buffered in memory and uploaded on Sync,
+// every -checkpoint messages, or once s3UploadSize bytes are pending. Messages are
+// read with ranged requests of s3BlockSize bytes, the last few of which are cached.
+type S3Folder struct {
+	Name     string
+	Blob     bool   // whether the data object holds length-prefixed messages
+	Variant  string // mbox variant, determining how messages are stored
+	dataKey  string
+	idxKey   string
+	size     int64 // size of the data object, up to the end of the last indexed message in append mode
+	idx      []byte
+	idxSize  int64        // size of the index object, up to the last complete line in append mode
+	pending  bytes.Buffer // messages appended since the last upload
+	lines    bytes.Buffer // index lines of the pending messages
+	appended int          // messages appended since opening, for -checkpoint
+	blocks   []s3Block    // most recently read blocks, most recent last
+}
+
+// A block of a data object, as read with one ranged request
+type s3Block struct {
+	offset int64
+	data   []byte
+}
+
+// Size of the ranged requests reading messages from object storage
+var s3BlockSize int64 = 4 * 1024 * 1024
+
+// Number of blocks kept in the cache of a folder in object storage
+const s3CachedBlocks = 4
+
+// Size of pending messages upon which they are uploaded to object storage,
+// regardless of -checkpoint, which bounds the memory they take
+var s3UploadSize = 64 * 1024 * 1024
+
+// Returns the object key of a local file name, which starts with a slash at the root of the bucket
+func s3Key(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// Returns the sorted names of the local folders in the given path of object storage,
+// derived from the objects with one of the given extensions. Skips objects in hidden
+// directories, such as temporary ones.
+func (s3 *s3Client) findFolders(path string, exts []string) (folderNames []string, err error) {
+	prefix := s3Key(path + "/")
+	keys, err := s3.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		rel := key[len(prefix):]
+		if strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.") {
+			continue
+		}
+		for _, ext := range exts {
+			if strings.HasSuffix(rel, ext) {
+				folderNames = append(folderNames, folderNameFromFile(rel[:len(rel)-len(ext)]))
+				break
+			}
+		}
+	}
+	sort.Strings(folderNames)
+	return folderNames, nil
+}
+
+// Removes the objects of a folder in object storage. Returns the names of the removed objects.
+func (s3 *s3Client) removeFolder(path, folderName string, blob bool) (removed []string, err error) {
+	for _, key := range []string{s3Key(dataFileName(path, folderName, blob, false)), s3Key(idxFileName(path, folderName))} {
+		if _, err := s3.size(key); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if err := s3.remove(key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, "s3://"+s3.bucket+"/"+key)
+	}
+	return removed, nil
+}
+
+func newS3Folder(path, folderName string, blob bool) *S3Folder {
+	return &S3Folder{Name: folderName, Blob: blob, Variant: mboxVariant,
+		dataKey: s3Key(dataFileName(path, folderName, blob, false)), idxKey: s3Key(idxFileName(path, folderName))}
+}
+
+// Opens a folder in object storage for reading. Returns an error satisfying os.IsNotExist if there is none.
+func OpenS3FolderReadOnly(path, folderName string, blob bool) (f *S3Folder, err error) {
+	f = newS3Folder(path, folderName, blob)
+	if f.size, err = s3Store.size(f.dataKey); err != nil {
+		return nil, err
+	}
+	if f.idx, err = s3Store.get(f.idxKey, 0, 0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Opens a folder in object storage for appending messages, creating it if necessary.
+// Discards any incomplete messages left behind by an interrupted backup with the next upload.
+func OpenS3FolderAppend(path, folderName string, blob bool) (f *S3Folder, err error) {
+	f = newS3Folder(path, folderName, blob)
+	if f.idx, err = s3Store.get(f.idxKey, 0, 0); os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f.idxSize = int64(bytes.LastIndexByte(f.idx, '\n') + 1)
+	local, err := f.ReadAllIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, mm := range local.Messages {
+		end := int64(mm.Offset) + int64(mm.Size)
+		if !blob {
+			end++ // separating blank line
+		}
+		if end > f.size {
+			f.size = end
+		}
+	}
+	f.idx = nil
+	return f, nil
+}
+
+// Opens a folder in object storage for writing messages, discarding its previous contents
+func OpenS3FolderOverwrite(path, folderName string, blob bool) (f *S3Folder, err error) {
+	f = newS3Folder(path, folderName, blob)
+	for _, key := range []string{f.dataKey, f.idxKey} {
+		if err := s3Store.put(key, nil); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Reads the entire index of the folder, ignoring an incomplete last line
+func (f *S3Folder) ReadAllIndex() (*ImapFolderMeta, error) {
+	meta := &ImapFolderMeta{Name: f.Name}
+	scanner := bufio.NewScanner(bytes.NewReader(f.idx))
+	scanner.Split(scanCompleteLines)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		mm, err := parseIndexLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("s3://%s/%s:%d: %s", s3Store.bucket, f.idxKey, lineNo, err.Error())
+		}
+		meta.Messages = append(meta.Messages, mm)
+		meta.UidValidity = mm.UidValidity
+		meta.Size += uint64(mm.Size)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Reads the data object at the given offset through the block cache, like io.ReaderAt
+func (f *S3Folder) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+		block, err := f.block(off / s3BlockSize * s3BlockSize)
+		if err != nil {
+			return n, err
+		}
+		if int(off-block.offset) >= len(block.data) {
+			return n, io.EOF
+		}
+		m := copy(p[n:], block.data[off-block.offset:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Returns the block at the given offset of the data object, from the cache if possible
+func (f *S3Folder) block(offset int64) (s3Block, error) {
+	for i, b := range f.blocks {
+		if b.offset == offset {
+			f.blocks = append(append(f.blocks[:i:i], f.blocks[i+1:]...), b)
+			return b, nil
+		}
+	}
+	n := s3BlockSize
+	if offset+n > f.size {
+		n = f.size - offset
+	}
+	data, err := s3Store.get(f.dataKey, offset, n)
+	if err != nil {
+		return s3Block{}, err
+	}
+	b := s3Block{offset, data}
+	if len(f.blocks) == s3CachedBlocks {
+		f.blocks = f.blocks[1:]
+	}
+	f.blocks = append(f.blocks, b)
+	return b, nil
+}
+
+// Reads the given message into the provided buffer. Reads the full size given
+// by the index, and reports a message ending early as truncated.
+func (f *S3Folder) ReadMessage(mm MessageMeta, buf *bytes.Buffer) error {
+	buf.Reset()
+	r := io.NewSectionReader(f, int64(mm.Offset), int64(mm.Size))
+	if n, err := io.CopyN(buf, r, int64(mm.Size)); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("message uid %d at offset %d is truncated, read %d of %d bytes", mm.Uid, mm.Offset, n, mm.Size)
+	} else if err != nil {
+		return err
+	}
+	if !f.Blob {
+		if bs := mboxDecode(f.Variant, buf.Bytes()); len(bs) != buf.Len() {
+			buf.Reset()
+			buf.Write(bs)
+		}
+	}
+	return nil
+}
+
+// Returns the envelope of the given message from the index, if stored there.
+// Else reads the message header from the data object.
+func (f *S3Folder) ReadEnvelope(mm MessageMeta) (env MessageEnvelope, err error) {
+	if mm.Envelope != nil {
+		return *mm.Envelope, nil
+	}
+	env, err = readEnvelope(bufio.NewReader(io.NewSectionReader(f, int64(mm.Offset), int64(mm.Size))))
+	if err != nil {
+		return env, fmt.Errorf("reading header of message %d in %s: %w", mm.Uid, f.Name, err)
+	}
+	return env, nil
+}
+
+// Appends a message read from r to the pending messages of the folder, framed
+// as in a LocalFolder. Uploads the pending messages every -checkpoint messages,
+// and once they exceed s3UploadSize.
+func (f *S3Folder) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	if from == "" {
+		from = mboxPlaceholderSender
+	}
+	r, size, err := sizedReader(r)
+	if err != nil {
+		return err
+	}
+	var sum hash.Hash
+	if checksum {
+		sum = sha256.New()
+		r = io.TeeReader(r, sum)
+	}
+
+	start := f.pending.Len()
+	var n int64
+	if f.Blob {
+		err = binary.Write(&f.pending, binary.BigEndian, uint64(size))
+	} else {
+		_, err = fmt.Fprintf(&f.pending, "From %s %s\n", from, when.UTC().Format(time.ANSIC))
+	}
+	pos := f.size + int64(f.pending.Len())
+	if err == nil && f.Blob {
+		if n, err = io.Copy(&f.pending, r); err == nil && n != size {
+			err = fmt.Errorf("message has %d bytes, expected %d", n, size)
+		}
+	} else if err == nil {
+		if n, err = mboxEncodeTo(&f.pending, f.Variant, r, size); err == nil {
+			f.pending.WriteString("\n")
+		}
+	}
+	if err != nil {
+		f.pending.Truncate(start)
+		return err
+	}
+
+	if sum != nil {
+		mm.Sha256 = hex.EncodeToString(sum.Sum(nil))
+	}
+	mm.Size = uint32(n)
+	mm.Offset = uint64(pos)
+	slog.Debug("Stored message", "folder", f.Name, "uid", mm.Uid, "offset", mm.Offset, "size", mm.Size)
+	fmt.Fprintf(&f.lines, "%s\n", formatIndexLine(mm))
+	f.appended++
+	if checkpoint > 0 && f.appended%checkpoint == 0 || f.pending.Len() >= s3UploadSize {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Uploads the pending messages, so readers of the folder see them
+func (f *S3Folder) Flush() error {
+	return f.Sync()
+}
+
+// Uploads the pending messages and their index lines. The data object goes
+// first, so the index never points at messages not stored.
+func (f *S3Folder) Sync() error {
+	if f.lines.Len() == 0 {
+		return nil
+	}
+	if err := s3Store.appendTo(f.dataKey, f.size, f.pending.Bytes()); err != nil {
+		return err
+	}
+	f.size += int64(f.pending.Len())
+	f.pending.Reset()
+	if err := s3Store.appendTo(f.idxKey, f.idxSize, f.lines.Bytes()); err != nil {
+		return err
+	}
+	f.idxSize += int64(f.lines.Len())
+	f.lines.Reset()
+	return nil
+}
+
+// Uploads any pending messages and closes the folder
+func (f *S3Folder) Close() {
+	if err := f.Sync(); err != nil {
+		slog.Error("Cannot upload messages", "folder", f.Name, "err", err)
+	}
+	f.blocks = nil
+}
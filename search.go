@@ -0,0 +1,166 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Flags selected by the keywords of a -search expression, and whether
+// messages must have the flag or not have it
+var searchFlagKeywords = map[string]struct {
+	flag string
+	with bool
+}{
+	"seen":       {imap.SeenFlag, true},
+	"unseen":     {imap.SeenFlag, false},
+	"flagged":    {imap.FlaggedFlag, true},
+	"unflagged":  {imap.FlaggedFlag, false},
+	"answered":   {imap.AnsweredFlag, true},
+	"unanswered": {imap.AnsweredFlag, false},
+	"draft":      {imap.DraftFlag, true},
+}
+
+// Header fields selected by the field:value terms of a -search expression
+var searchHeaderFields = map[string]string{
+	"from":    "From",
+	"to":      "To",
+	"cc":      "Cc",
+	"subject": "Subject",
+}
+
+// Adds the terms of a -search expression to the given criteria. Terms are
+// separated by whitespace and must all match. Values containing whitespace can
+// be quoted with double quotes, e.g. subject:"weekly report". Supported terms:
+// from:, to:, cc:, subject:, body:, text: for substrings, larger: and smaller:
+// for sizes with an optional K, M or G suffix, before: and since: for dates as
+// YYYY-MM-DD, and the keywords seen, unseen, flagged, unflagged, answered,
+// unanswered and draft.
+func parseSearch(expr string, criteria *imap.SearchCriteria) error {
+	terms, err := splitSearchTerms(expr)
+	if err != nil {
+		return err
+	}
+	for _, term := range terms {
+		key, value := strings.ToLower(term), ""
+		if i := strings.Index(term, ":"); i >= 0 {
+			key, value = strings.ToLower(term[:i]), term[i+1:]
+			if value == "" {
+				return fmt.Errorf("search term %q has no value", term)
+			}
+		} else if fk, ok := searchFlagKeywords[key]; ok {
+			if fk.with {
+				criteria.WithFlags = append(criteria.WithFlags, fk.flag)
+			} else {
+				criteria.WithoutFlags = append(criteria.WithoutFlags, fk.flag)
+			}
+			continue
+		} else {
+			return fmt.Errorf("unknown search term %q", term)
+		}
+
+		if field, ok := searchHeaderFields[key]; ok {
+			criteria.Header.Add(field, value)
+			continue
+		}
+		switch key {
+		case "body":
+			criteria.Body = append(criteria.Body, value)
+		case "text":
+			criteria.Text = append(criteria.Text, value)
+		case "larger", "smaller":
+			size, err := parseSearchSize(value)
+			if err != nil {
+				return fmt.Errorf("search term %q: %w", term, err)
+			}
+			if key == "larger" {
+				criteria.Larger = size
+			} else {
+				criteria.Smaller = size
+			}
+		case "before", "since":
+			date, err := time.Parse(ymd, value)
+			if err != nil {
+				return fmt.Errorf("search term %q: expected a date as YYYY-MM-DD", term)
+			}
+			if key == "before" {
+				criteria.Before = date
+			} else {
+				criteria.Since = date
+			}
+		default:
+			return fmt.Errorf("unknown search term %q", term)
+		}
+	}
+	return nil
+}
+
+// Splits a -search expression at whitespace outside of double quotes,
+// removing the quotes
+func splitSearchTerms(expr string) ([]string, error) {
+	terms := []string{}
+	var term strings.Builder
+	inQuotes, inTerm := false, false
+	for _, r := range expr {
+		switch {
+		case r == '"':
+			inQuotes, inTerm = !inQuotes, true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if inTerm {
+				terms = append(terms, term.String())
+				term.Reset()
+				inTerm = false
+			}
+		default:
+			term.WriteRune(r)
+			inTerm = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in search expression %q", expr)
+	}
+	if inTerm {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+// Parses a size in bytes with an optional K, M or G suffix for powers of 1024
+func parseSearchSize(s string) (uint32, error) {
+	mult := uint64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1024
+	case "M":
+		mult = 1024 * 1024
+	case "G":
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n*mult > 0xffffffff {
+		return 0, fmt.Errorf("expected a size below 4G, e.g. 500K or 10M")
+	}
+	return uint32(n * mult), nil
+}
@@ -0,0 +1,229 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Compression of mailbox files, selected with -compress
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+)
+
+// Formats of local storage, selected with -format
+const (
+	formatMbox    = "mbox"    // one .mbox file and one .idx index file per folder
+	formatMaildir = "maildir" // one directory per folder, with one file per message
+	formatBlob    = "blob"    // one .blob file of length-prefixed messages and one .idx index file per folder
+	formatEml     = "eml"     // one directory with one .eml file per message and one .idx index file per folder
+)
+
+// Local storage of a mail folder, in the format selected with -format
+type StorageBackend interface {
+	MessageAppender
+
+	// Reads the metadata of all messages in the folder
+	ReadAllIndex() (*ImapFolderMeta, error)
+	// Reads the given message into the provided buffer
+	ReadMessage(mm MessageMeta, buf *bytes.Buffer) error
+	// Reads date, sender and subject of the given message
+	ReadEnvelope(mm MessageMeta) (MessageEnvelope, error)
+	// Makes appended messages visible to readers of the same folder
+	Flush() error
+	// Commits appended messages to stable storage
+	Sync() error
+	Close()
+}
+
+// Returns the sorted names of all local folders in the given path. Folders in
+// mbox, blob and eml format are found by their index files.
+func GetLocalFolderNames(path string) ([]string, error) {
+	if storageFormat == formatMaildir {
+		return getMaildirFolderNames(path)
+	}
+	return getMboxFolderNames(path)
+}
+
+// Writes a message read from r to a file of its own, replacing any previous one.
+// Returns its size, and with -checksum its checksum, else "".
+func writeMessageFile(name string, r io.Reader) (n int64, sum string, err error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	var h hash.Hash
+	if checksum {
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+	n, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if h != nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+	return n, sum, nil
+}
+
+// Opens a local folder for reading. Returns an error satisfying os.IsNotExist if there is none.
+func OpenStorageReadOnly(path, folderName string) (StorageBackend, error) {
+	if s3Store != nil {
+		return OpenS3FolderReadOnly(path, folderName, storageFormat == formatBlob)
+	}
+	switch storageFormat {
+	case formatMaildir:
+		return OpenMaildirFolderReadOnly(path, folderName)
+	case formatEml:
+		return OpenEmlFolderReadOnly(path, folderName)
+	}
+	return OpenLocalFolderReadOnly(path, folderName, storageFormat == formatBlob)
+}
+
+// Opens a local folder for appending messages, creating it if necessary
+func OpenStorageAppend(path, folderName string) (StorageBackend, error) {
+	if s3Store != nil {
+		return OpenS3FolderAppend(path, folderName, storageFormat == formatBlob)
+	}
+	switch storageFormat {
+	case formatMaildir:
+		return OpenMaildirFolderAppend(path, folderName)
+	case formatEml:
+		return OpenEmlFolderAppend(path, folderName)
+	}
+	return OpenLocalFolderAppend(path, folderName, storageFormat == formatBlob)
+}
+
+// Opens a local folder for writing messages, discarding its previous contents
+func OpenStorageOverwrite(path, folderName string) (StorageBackend, error) {
+	if s3Store != nil {
+		return OpenS3FolderOverwrite(path, folderName, storageFormat == formatBlob)
+	}
+	switch storageFormat {
+	case formatMaildir:
+		return OpenMaildirFolderOverwrite(path, folderName)
+	case formatEml:
+		return OpenEmlFolderOverwrite(path, folderName)
+	}
+	return OpenLocalFolderOverwrite(path, folderName, storageFormat == formatBlob)
+}
+
+// Removes the local backup of a folder. Returns the names of the removed files and directories.
+func RemoveStorage(path, folderName string) (removed []string, err error) {
+	if s3Store != nil {
+		return s3Store.removeFolder(path, folderName, storageFormat == formatBlob)
+	}
+	switch storageFormat {
+	case formatMaildir:
+		return removeMaildirFolder(path, folderName)
+	case formatEml:
+		return removeEmlFolder(path, folderName)
+	}
+	blob := storageFormat == formatBlob
+	for _, fileName := range []string{dataFileName(path, folderName, blob, false), dataFileName(path, folderName, blob, true),
+		idxFileName(path, folderName)} {
+		if err := os.Remove(fileName); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed = append(removed, fileName)
+	}
+	return removed, nil
+}
+
+// Re-reads the last message of a local folder, to confirm the folder is
+// readable. Returns the metadata of the last message.
+func VerifyLastMessage(path, folderName string) (mm MessageMeta, err error) {
+	lf, err := OpenStorageReadOnly(path, folderName)
+	if err != nil {
+		return MessageMeta{}, err
+	}
+	defer lf.Close()
+
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return MessageMeta{}, err
+	}
+	if len(f.Messages) == 0 {
+		return MessageMeta{}, fmt.Errorf("local folder %s is empty", folderName)
+	}
+	mm = f.Messages[len(f.Messages)-1]
+	buf := &bytes.Buffer{}
+	if err := lf.ReadMessage(mm, buf); err != nil {
+		return MessageMeta{}, fmt.Errorf("local folder %s: reading uid %d: %w", folderName, mm.Uid, err)
+	}
+	return mm, nil
+}
+
+// Validates -format and -compress, and defaults -format to the format recorded in the
+// manifest of the local storage path. Refuses an explicit -format which differs from it.
+// Determines the mbox variant of existing local storage, new storage uses -mbox-variant.
+func resolveFormat() error {
+	switch storageFormat {
+	case formatMbox, formatMaildir, formatBlob, formatEml:
+	default:
+		return fmt.Errorf("unknown format %q, expected %s, %s, %s or %s", storageFormat,
+			formatMbox, formatMaildir, formatBlob, formatEml)
+	}
+	if err := validateMboxVariant(mboxVariantFlag); err != nil {
+		return err
+	}
+	m, err := ReadManifest(localStoragePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		recorded := m.Format
+		if recorded == "" {
+			recorded = formatMbox // older manifests predate -format
+		}
+		if recorded != storageFormat && isFlagSet("format") {
+			return fmt.Errorf("local storage %s is in %s format, not %s", localStoragePath, recorded, storageFormat)
+		}
+		storageFormat = recorded
+		mboxVariant = m.Mbox
+		if mboxVariant == "" {
+			mboxVariant = mboxRaw // older manifests predate quoting
+		}
+	} else if names, err := getMboxFolderNames(localStoragePath); err == nil && len(names) > 0 {
+		mboxVariant = mboxRaw // older backups predate manifests
+	} else if mboxVariantFlag != mboxAuto {
+		mboxVariant = mboxVariantFlag
+	}
+
+	if compress != compressNone && compress != compressGzip {
+		return fmt.Errorf("unknown compression %q, expected %s or %s", compress, compressNone, compressGzip)
+	}
+	if compress == compressGzip && storageFormat != formatMbox {
+		return fmt.Errorf("compression is only supported for the %s format", formatMbox)
+	}
+	if s3Store != nil && (storageFormat == formatMaildir || storageFormat == formatEml || compress == compressGzip) {
+		return fmt.Errorf("-store supports the %s and %s formats without compression", formatMbox, formatBlob)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// go-imap holds every fetched literal in memory as a whole. Messages of at least
+// largeMessageSize bytes are therefore fetched in partial chunks of largeMessageChunk
+// bytes each, which bounds memory use regardless of message size.
+var (
+	largeMessageSize  uint32 = 16 * 1024 * 1024
+	largeMessageChunk        = 4 * 1024 * 1024
+)
+
+// Downloads the message with the given UID from the selected mailbox in chunks,
+// and streams it to lf
+func (f *ImapFolderMeta) streamMessage(c *client.Client, uid uint32, lf MessageAppender, bar *pb.ProgressBar) error {
+	msg, err := fetchByUid(c, uid, messageItems(c))
+	if err != nil {
+		return err
+	}
+	mm, from, date := f.storedMessageMeta(msg)
+	r := &progressReader{Literal: &chunkReader{c: c, uid: uid, size: int(msg.Size)}, bar: bar}
+	if err := lf.Append(mm, from, date, r); err != nil {
+		return err
+	}
+	addTransferred(uint64(r.n))
+	slog.Debug("Downloaded message in chunks", "folder", f.Name, "uid", uid, "size", r.n)
+	return nil
+}
+
+// Fetches the given items of the message with the given UID from the selected mailbox
+func fetchByUid(c *client.Client, uid uint32, items []imap.FetchItem) (*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	messages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+
+	// the server may send unsolicited FETCH responses for other messages along the way
+	var msg *imap.Message
+	for m := range messages {
+		if m.Uid == uid {
+			msg = m
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("server returned no message for uid %d", uid)
+	}
+	return msg, nil
+}
+
+// Reads a message from the server in chunks, holding only one chunk in memory
+// at a time. Implements imap.Literal with the size reported by the server, so
+// the local storage can frame the message before it is read.
+type chunkReader struct {
+	c      *client.Client
+	uid    uint32
+	size   int // RFC822.SIZE of the message
+	offset int // of the next chunk on the server
+	buf    bytes.Reader
+}
+
+// Returns the size of the whole message
+func (r *chunkReader) Len() int {
+	return r.size
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.buf.Len() == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		if err := r.fetchChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// Fetches the next chunk into the buffer. Fails if the message turns out to
+// be shorter or longer than its reported size, as the local storage has
+// already framed it with that size.
+func (r *chunkReader) fetchChunk() error {
+	want := r.size - r.offset
+	if want > largeMessageChunk {
+		want = largeMessageChunk
+	}
+	// ask for one byte beyond the end with the last chunk, to catch longer messages
+	n := want
+	if r.offset+want == r.size {
+		n++
+	}
+	section := &imap.BodySectionName{Peek: true, Partial: []int{r.offset, n}}
+	msg, err := fetchByUid(r.c, r.uid, []imap.FetchItem{section.FetchItem()})
+	if err != nil {
+		return err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return fmt.Errorf("server returned no body for uid %d at offset %d", r.uid, r.offset)
+	}
+	chunk, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(chunk) < want {
+		return fmt.Errorf("message uid %d ended after %d of %d bytes", r.uid, r.offset+len(chunk), r.size)
+	}
+	if len(chunk) > want {
+		return fmt.Errorf("message uid %d is longer than the %d bytes reported by the server", r.uid, r.size)
+	}
+	r.offset += len(chunk)
+	r.buf.Reset(chunk)
+	return nil
+}
@@ -0,0 +1,108 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// A message destination which keeps the messages, checking their reported length
+type bodyAppender struct {
+	t      *testing.T
+	bodies []string
+}
+
+func (a *bodyAppender) Append(mm MessageMeta, from string, when time.Time, r io.Reader) error {
+	l, ok := r.(interface{ Len() int })
+	if !ok {
+		return fmt.Errorf("uid %d: reader does not report its length", mm.Uid)
+	}
+	size := l.Len()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size != len(bs) {
+		a.t.Errorf("uid %d: reader reports %d bytes, has %d", mm.Uid, size, len(bs))
+	}
+	a.bodies = append(a.bodies, string(bs))
+	return nil
+}
+
+func TestDownloadStreamsLargeMessages(t *testing.T) {
+	defer func(size uint32, chunk int, timeout time.Duration) {
+		largeMessageSize, largeMessageChunk, msgTimeout = size, chunk, timeout
+	}(largeMessageSize, largeMessageChunk, msgTimeout)
+	largeMessageSize, largeMessageChunk = 200, 64
+
+	c := newTestServer(t)
+	want := []string{}
+	for i, lines := range []int{1, 20, 2, 50, 13, 1} {
+		msg := fmt.Sprintf("From: a@b.c\r\nSubject: %d\r\n\r\n%s", i, strings.Repeat(fmt.Sprintf("line of message %d\r\n", i), lines))
+		appendTestMessage(t, c, "Large", nil, time.Now(), msg)
+		want = append(want, msg)
+	}
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		pipelineDepth, batchSize, msgTimeout = 2, 4, timeout
+		f, err := NewImapFolderMeta(context.Background(), c, "Large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &bodyAppender{t: t}
+		if _, err := f.DownloadTo(context.Background(), c, a, pb.NewOptions(0, pb.OptionSetVisibility(false))); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(a.bodies) != fmt.Sprint(want) {
+			t.Errorf("msg-timeout %v: got %q, want %q", timeout, a.bodies, want)
+		}
+	}
+}
+
+func TestChunkReaderDetectsSizeMismatch(t *testing.T) {
+	defer func(chunk int) { largeMessageChunk = chunk }(largeMessageChunk)
+	largeMessageChunk = 16
+
+	c := newTestServer(t)
+	msg := "Subject: x\r\n\r\n" + strings.Repeat("0123456789\r\n", 10)
+	appendTestMessage(t, c, "Mismatch", nil, time.Now(), msg)
+	f, err := NewImapFolderMeta(context.Background(), c, "Mismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := f.Messages[0].Uid
+
+	for _, tc := range []struct {
+		size int
+		err  string
+	}{
+		{len(msg), ""},
+		{len(msg) - 5, "is longer than"},
+		{len(msg) + 5, "ended after"},
+	} {
+		_, err := io.ReadAll(&chunkReader{c: c, uid: uid, size: tc.size})
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("size %d: got error %v, want %q", tc.size, err, tc.err)
+		}
+	}
+}
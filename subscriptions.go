@@ -0,0 +1,88 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Retrieves a sorted list of the folders the user has subscribed to, via LSUB
+func ListSubscribedFolders(ctx context.Context, c *client.Client) (folderNames []string, err error) {
+	defer watchContext(ctx, c, &err)()
+
+	mailboxesCh := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Lsub("", "*", mailboxesCh)
+	}()
+
+	mailboxes := []string{}
+	for m := range mailboxesCh {
+		mailboxes = append(mailboxes, m.Name)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	sort.Strings(mailboxes)
+	return mailboxes, nil
+}
+
+// Records the folders subscribed on the server in the manifest, if they changed
+func recordSubscriptions(c *client.Client, m *Manifest) error {
+	if m == nil {
+		return nil
+	}
+	ctx, cancel := newOpContext()
+	names, err := ListSubscribedFolders(ctx, c)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if slices.Equal(names, m.Subscribed) {
+		return nil
+	}
+	m.Subscribed = names
+	return m.Write(localStoragePath)
+}
+
+// Returns whether the local folder of the given name should be subscribed on restore.
+// Without recorded subscriptions, e.g. from older backups or servers which don't
+// track them, all folders are.
+func isSubscribed(m *Manifest, folderName string) bool {
+	if m == nil || len(m.Subscribed) == 0 {
+		return true
+	}
+	i := sort.SearchStrings(m.Subscribed, folderName)
+	return i < len(m.Subscribed) && m.Subscribed[i] == folderName
+}
+
+// Subscribes to the restored folder remName, if its local folder was subscribed.
+// Logs errors instead of returning them, as the messages are restored already.
+func subscribeRestored(c *client.Client, m *Manifest, localName, remName string) {
+	if !subscribe || !isSubscribed(m, localName) {
+		return
+	}
+	if err := c.Subscribe(remName); err != nil {
+		slog.Warn("Unable to subscribe to folder", "folder", remName, "err", err)
+	}
+}
@@ -0,0 +1,339 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/emersion/go-imap/client"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// Modes for -sync-mode
+const (
+	syncPull = "pull" // only download new server messages, like backup
+	syncPush = "push" // only upload local-only messages, like restore
+	syncBoth = "both" // both of the above
+)
+
+// Returns an error if the given sync mode is unknown
+func validateSyncMode(mode string) error {
+	switch mode {
+	case syncPull, syncPush, syncBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown sync mode %s, use %s, %s or %s", mode, syncPull, syncPush, syncBoth)
+}
+
+// A folder to synchronize, with the messages to download and to upload
+type syncFolder struct {
+	name   string
+	remote *ImapFolderMeta // nil if the folder does not exist on the server
+	pull   *ImapFolderMeta // server messages missing locally
+	push   *ImapFolderMeta // local messages missing on the server
+}
+
+// Synchronizes the folders with given names on the server, and the local folders,
+// in the direction given by -sync-mode. Lists each folder once on either side, and
+// compares them by UIDVALIDITY and UID. After uploading, records the UIDs the server
+// assigned in the local index, so uploaded messages are not downloaded again.
+func cmdSync(c *client.Client, folderNames []string) (err error) {
+	if overwrite {
+		return fmt.Errorf("sync does not support -overwrite")
+	}
+	push := syncMode == syncPush || syncMode == syncBoth
+	if push && storageFormat != formatMbox && storageFormat != formatBlob {
+		return fmt.Errorf("sync -sync-mode %s supports the mbox and blob formats only, not %s, use -sync-mode %s", syncMode, storageFormat, syncPull)
+	}
+	m, err := checkManifest(c)
+	if err != nil {
+		return err
+	}
+	if folderNames, err = gmailBackupFolders(c, folderNames); err != nil {
+		return err
+	}
+
+	// Log out of any connection replaced during transfers, the caller owns the original
+	orig := c
+	defer func() {
+		if c != orig {
+			logout(c)
+		}
+	}()
+
+	// Local-only folders are created on the server when pushing
+	names := append([]string{}, folderNames...)
+	if push {
+		localNames, err := GetLocalFolderNames(localStoragePath)
+		if err != nil {
+			return err
+		}
+		localNames = selectFolders(localNames)
+		names = union(names, localNames)
+	}
+
+	folders, err := listSyncFolders(c, m, names, folderNames)
+	if err != nil {
+		return err
+	}
+
+	// Print the messages to transfer per folder
+	pullMsgs, pullSize, pushMsgs, pushSize := 0, uint64(0), 0, uint64(0)
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s <-> %s/%s\n", localStoragePath, server, user)
+	for _, sf := range folders {
+		pullMsgs += len(sf.pull.Messages)
+		pullSize += sf.pull.Size
+		pushMsgs += len(sf.push.Messages)
+		pushSize += sf.push.Size
+		fmt.Fprintf(out, "|- %s (pull %d, %s; push %d, %s)\n", sf.name, len(sf.pull.Messages), humanReadableSize(sf.pull.Size),
+			len(sf.push.Messages), humanReadableSize(sf.push.Size))
+	}
+	fmt.Fprintln(out)
+
+	// Download new server messages
+	bar := pb.NewOptions64(int64(pullSize), pb.OptionSetDescription("Download"), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
+	for _, sf := range folders {
+		if len(sf.pull.Messages) == 0 {
+			continue
+		}
+		var skipped, timedOut []uint32
+		c, skipped, timedOut, err = backupFolder(c, sf.pull, bar)
+		if err != nil {
+			return fmt.Errorf("folder %s: %w", sf.name, err)
+		}
+		if n := len(skipped) + len(timedOut); n > 0 {
+			slog.Warn("Skipped messages, these will be retried on the next sync", "folder", sf.name, "messages", n)
+		}
+	}
+
+	// Upload local-only messages
+	bar = pb.NewOptions64(int64(pushSize), pb.OptionSetDescription("Upload"), pb.OptionShowBytes(true), pb.OptionSetVisibility(showProgress))
+	for _, sf := range folders {
+		if len(sf.push.Messages) == 0 {
+			continue
+		}
+		if c, err = pushFolder(c, sf, bar); err != nil {
+			return fmt.Errorf("folder %s: %w", sf.name, err)
+		}
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Pulled %d messages, %s, pushed %d messages, %s\n", pullMsgs, humanReadableSize(pullSize),
+		pushMsgs, humanReadableSize(pushSize))
+	return nil
+}
+
+// Lists the folders with given names on the server and locally, and returns the
+// messages to transfer in either direction as given by -sync-mode. Folders in
+// remoteNames exist on the server, others are created there by pushFolder.
+func listSyncFolders(c *client.Client, m *Manifest, names, remoteNames []string) ([]*syncFolder, error) {
+	onServer := map[string]bool{}
+	for _, name := range remoteNames {
+		onServer[name] = true
+	}
+
+	bar := pb.NewOptions64(int64(len(names)), pb.OptionSetDescription("List"), pb.OptionSetVisibility(showProgress))
+	folders := []*syncFolder{}
+	for _, name := range names {
+		describeBar(bar, "List "+name)
+		sf, err := listSyncFolder(c, m, name, onServer[name])
+		if err != nil {
+			return nil, err
+		}
+		if sf != nil {
+			folders = append(folders, sf)
+		}
+		bar.Add(1)
+	}
+	return folders, nil
+}
+
+// Lists a folder on the server, unless it does not exist there, and locally, and
+// returns the messages to transfer. Handles folders whose UIDVALIDITY changed since
+// their local backup as given with -on-uidvalidity-change, returning nil if skipped.
+func listSyncFolder(c *client.Client, m *Manifest, name string, onServer bool) (*syncFolder, error) {
+	sf := &syncFolder{name: name}
+	remote := &ImapFolderMeta{Name: name}
+	if onServer {
+		var err error
+		ctx, cancel := newOpContext()
+		sf.remote, err = NewImapFolderMeta(ctx, c, name)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", name, err)
+		}
+		remote = sf.remote
+	}
+
+	local := &ImapFolderMeta{Name: name}
+	lf, err := OpenStorageReadOnly(localStoragePath, name)
+	if err == nil {
+		defer lf.Close()
+		if local, err = lf.ReadAllIndex(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// After a UIDVALIDITY change, all server messages are pulled again, and local
+	// messages are pushed unless the server has one with the same Message-ID
+	if len(remote.Messages) > 0 && uidValidityChanged(local, remote) {
+		skip, err := handleUidValidityChange(name, local, remote, "pulling all messages again and comparing pushed ones by Message-ID")
+		if err != nil || skip {
+			return nil, err
+		}
+	}
+
+	sf.pull = &ImapFolderMeta{Name: name, UidValidity: remote.UidValidity, UidNext: remote.UidNext}
+	if syncMode != syncPush {
+		sf.pull.Messages, sf.pull.Size = remote.FilterOut(local)
+		sf.pull.Messages, sf.pull.Size = sf.pull.FilterOut(m.removedMessages(name))
+	}
+	sf.push = &ImapFolderMeta{Name: name, UidValidity: local.UidValidity}
+	if syncMode != syncPull {
+		sf.push.Messages, sf.push.Size, err = filterMissingMessages(c, lf, local, remote)
+		if err != nil {
+			return nil, err
+		}
+		sf.push.SortBySeqNum()
+	}
+	return sf, nil
+}
+
+// Uploads the local-only messages of a folder, creating it on the server if it does
+// not exist there, then records the UIDs the server assigned to them in the local
+// index. Returns the connection to continue with.
+func pushFolder(c *client.Client, sf *syncFolder, bar *pb.ProgressBar) (*client.Client, error) {
+	describeBar(bar, "Upload "+sf.name)
+	if sf.remote == nil {
+		delim, err := GetDelimiter(c)
+		if err != nil {
+			return c, err
+		}
+		if sf.remote, err = openRestoreTarget(c, sf.name, sf.name, delim); err != nil {
+			return c, err
+		}
+	}
+	lf, err := OpenStorageReadOnly(localStoragePath, sf.name)
+	if err != nil {
+		return c, err
+	}
+	defer lf.Close()
+
+	flagLevel := flagsAll
+	if noFlags {
+		flagLevel = flagsNone
+	}
+	buf := &bytes.Buffer{}
+	for _, mm := range sf.push.Messages {
+		if err := lf.ReadMessage(mm, buf); err != nil {
+			return c, err
+		}
+		l := buf.Len()
+		var err error
+		if c, err = appendWithReconnect(c, sf.name, mm, restoreDate(mm, buf.Bytes()), buf.Bytes(), &flagLevel); err != nil {
+			return c, err
+		}
+		addTransferred(uint64(l))
+		bar.Add64(int64(l))
+	}
+	return c, remapPushedUids(c, sf)
+}
+
+// Records the UIDs the server assigned to the pushed messages of a folder in the
+// local index. Assumes the server assigned UIDs from UIDNEXT in the order of upload,
+// and leaves the index unchanged with a warning if the number of new messages on
+// the server differs, e.g. because new mail arrived meanwhile.
+func remapPushedUids(c *client.Client, sf *syncFolder) error {
+	ctx, cancel := newOpContext()
+	after, err := NewImapFolderMeta(ctx, c, sf.name)
+	cancel()
+	if err != nil {
+		return err
+	}
+	added := []MessageMeta{}
+	for _, mm := range after.Messages {
+		if mm.Uid >= sf.remote.UidNext {
+			added = append(added, mm)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Uid < added[j].Uid })
+	if sf.remote.UidNext == 0 || after.UidValidity != sf.remote.UidValidity || len(added) != len(sf.push.Messages) {
+		slog.Warn("Unable to match pushed messages to new messages on the server, the next sync downloads them again",
+			"folder", sf.name, "pushed", len(sf.push.Messages), "new", len(added))
+		return nil
+	}
+
+	remap := map[uint64]MessageMeta{}
+	for i, mm := range sf.push.Messages {
+		remap[mm.GetUuid()] = added[i]
+	}
+	return rewriteIndexUids(localStoragePath, sf.name, remap)
+}
+
+// Rewrites the index of a local folder, replacing UIDVALIDITY and UID of the
+// messages in the given map by those of the mapped server messages
+func rewriteIndexUids(path, folderName string, remap map[uint64]MessageMeta) error {
+	idxName := idxFileName(path, folderName)
+	bs, err := os.ReadFile(idxName)
+	if err != nil {
+		return err
+	}
+	res := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	scanner.Split(scanCompleteLines)
+	for scanner.Scan() {
+		mm, err := parseIndexLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s: %w", idxName, err)
+		}
+		if to, ok := remap[mm.GetUuid()]; ok {
+			mm.UidValidity, mm.Uid = to.UidValidity, to.Uid
+		}
+		fmt.Fprintf(res, "%s\n", formatIndexLine(mm))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	tmpName := idxName + ".tmp"
+	if err := os.WriteFile(tmpName, res.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, idxName)
+}
+
+// Returns the sorted strings which are in as or bs, without duplicates
+func union(as, bs []string) []string {
+	have := map[string]bool{}
+	res := []string{}
+	for _, s := range append(append([]string{}, as...), bs...) {
+		if !have[s] {
+			have[s] = true
+			res = append(res, s)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
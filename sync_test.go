@@ -0,0 +1,65 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSyncCreatesLocalOnlyFoldersWhenPushing(t *testing.T) {
+	defer func(mode string) { syncMode = mode }(syncMode)
+	syncMode = syncBoth
+	c := newTestServer(t)
+	newTestStorage(t, formatMbox)
+	appendTestMessage(t, c, "Work", nil, time.Now(), "Subject: server\r\n\r\nbody\r\n")
+	storeTestMessages(t, "Archive", MessageMeta{}, "Subject: a1\r\n\r\nbody\r\n", "Subject: a2\r\n\r\nbody\r\n")
+
+	if err := cmdSync(c, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(fetchTestSubjects(t, c, "Archive")); got != "[a1 a2]" {
+		t.Errorf("got %s in Archive on the server, want [a1 a2]", got)
+	}
+	if local, err := readLocalIndex("Work"); err != nil || len(local.Messages) != 1 {
+		t.Errorf("got %v, %v, want the server message pulled", local, err)
+	}
+
+	// the pushed messages are recorded under their new UIDs, so a second sync transfers nothing
+	remote, err := NewImapFolderMeta(context.Background(), c, "Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := readLocalIndex("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := remote.FilterOut(local); len(missing) != 0 {
+		t.Errorf("server messages %v missing locally", missing)
+	}
+	folders, err := listSyncFolders(c, nil, []string{"Work", "Archive"}, []string{"Work", "Archive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sf := range folders {
+		if len(sf.pull.Messages) != 0 || len(sf.push.Messages) != 0 {
+			t.Errorf("%s: pull %v, push %v, want nothing", sf.name, sf.pull.Messages, sf.push.Messages)
+		}
+	}
+}
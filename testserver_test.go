@@ -0,0 +1,132 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Discards the log, which warnings about test messages would flood
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	log.SetOutput(io.Discard)
+	out = io.Discard
+	os.Exit(m.Run())
+}
+
+// Starts an IMAP server on localhost backed by memory, whose INBOX holds one
+// message, and points the connection flags at it. Returns a client logged in.
+func newTestServer(t *testing.T) *client.Client {
+	t.Helper()
+	return newTestServerWithBackend(t, memory.New())
+}
+
+// Starts an IMAP server like newTestServer, with the given backend
+func newTestServerWithBackend(t *testing.T, be backend.Backend) *client.Client {
+	t.Helper()
+	return startTestServer(t, imapserver.New(be), nil)
+}
+
+// Starts the given IMAP server on localhost, accepting connections through wrap
+// unless it is nil, and points the connection flags at it. Returns a client logged in.
+func startTestServer(t *testing.T, s *imapserver.Server, wrap func(net.Listener) net.Listener) *client.Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AllowInsecureAuth = true
+	if wrap != nil {
+		go s.Serve(wrap(l))
+	} else {
+		go s.Serve(l)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	server, port = "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+	user, pass, authMode = "username", "password", authPlain
+	tlsMode, proxyFlag, compressImap = tlsNone, proxyNone, compressOff
+	c, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logout(c) })
+	return c
+}
+
+// Appends a message to a folder of the test server, creating the folder if needed
+func appendTestMessage(t *testing.T, c *client.Client, folder string, flags []string, date time.Time, msg string) {
+	t.Helper()
+	if folder != "INBOX" {
+		c.Create(folder)
+	}
+	if err := c.Append(folder, flags, date, bytes.NewBufferString(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the flags of the messages in a folder of the test server by their subject
+func fetchTestFlags(t *testing.T, c *client.Client, folder string) map[string][]string {
+	t.Helper()
+	if _, err := c.Select(folder, true); err != nil {
+		t.Fatal(err)
+	}
+	seqset, _ := imap.ParseSeqSet("1:*")
+	messages := make(chan *imap.Message, 100)
+	if err := c.Fetch(seqset, []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope}, messages); err != nil {
+		t.Fatal(err)
+	}
+	res := map[string][]string{}
+	for msg := range messages {
+		flags := append([]string{}, msg.Flags...)
+		sort.Strings(flags)
+		res[msg.Envelope.Subject] = flags
+	}
+	return res
+}
+
+// Returns the subjects of the messages in a folder of the test server, in their order there
+func fetchTestSubjects(t *testing.T, c *client.Client, folder string) []string {
+	t.Helper()
+	if _, err := c.Select(folder, true); err != nil {
+		t.Fatal(err)
+	}
+	seqset, _ := imap.ParseSeqSet("1:*")
+	messages := make(chan *imap.Message, 100)
+	if err := c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope}, messages); err != nil {
+		t.Fatal(err)
+	}
+	subjects := []string{}
+	for msg := range messages {
+		subjects = append(subjects, msg.Envelope.Subject)
+	}
+	return subjects
+}
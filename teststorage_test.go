@@ -0,0 +1,68 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Points the local storage at a new temporary directory, in the given format
+func newTestStorage(t *testing.T, format string) {
+	t.Helper()
+	defer func(path, format, variant string) {
+		t.Cleanup(func() { localStoragePath, storageFormat, mboxVariant = path, format, variant })
+	}(localStoragePath, storageFormat, mboxVariant)
+	localStoragePath, storageFormat, mboxVariant = t.TempDir(), format, mboxRd
+}
+
+// Stores the given messages in a local folder, with UIDs counting from 1 and the
+// given metadata otherwise. Returns the metadata as stored.
+func storeTestMessages(t *testing.T, folder string, mm MessageMeta, msgs ...string) []MessageMeta {
+	t.Helper()
+	lf, err := OpenStorageAppend(localStoragePath, folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.UidValidity == 0 {
+		mm.UidValidity = 1
+	}
+	if mm.InternalDate.IsZero() {
+		mm.InternalDate = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	}
+	for i, msg := range msgs {
+		mm.Uid, mm.SeqNum = uint32(i+1), uint32(i+1)
+		if err := lf.Append(mm, "a@b.c", mm.InternalDate, strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = lf.Sync()
+	lf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf, err = OpenStorageReadOnly(localStoragePath, folder); err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Messages
+}
@@ -0,0 +1,92 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest number of bytes read or written at once on a throttled connection,
+// so the limit is kept smoothly instead of in bursts of large buffers
+const throttleChunk = 32 * 1024
+
+// Limits the data rate of all connections sharing it with a token bucket, which
+// holds at most a second's worth of bytes. Transfers exceeding the available
+// tokens wait until the bucket has refilled enough.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // may be negative while transfers are waiting
+	last   time.Time
+}
+
+// The limiter shared by all connections, set with -limit, or nil for no limit
+var bandwidth *rateLimiter
+
+func newRateLimiter(bytesPerSecond uint64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Takes n bytes from the bucket, and waits until they are refilled if it ran short
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+// A network connection whose reads and writes together are limited by a rateLimiter
+type throttledConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (tc *throttledConn) Read(b []byte) (int, error) {
+	if len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := tc.Conn.Read(b)
+	tc.limiter.wait(n)
+	return n, err
+}
+
+func (tc *throttledConn) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		tc.limiter.wait(len(chunk))
+		n, err := tc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,157 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// What to do with a folder whose UIDVALIDITY changed since its local backup, as
+// given with -on-uidvalidity-change
+const (
+	uidValidityFail     = "fail"     // fail the command
+	uidValidityRebackup = "rebackup" // download all messages again, and match them by Message-ID on restore
+	uidValiditySkip     = "skip"     // skip the folder
+)
+
+// Returns an error if the given strategy for UIDVALIDITY changes is unknown
+func validateOnUidValidityChange(s string) error {
+	switch s {
+	case uidValidityFail, uidValidityRebackup, uidValiditySkip:
+		return nil
+	}
+	return fmt.Errorf("unknown -on-uidvalidity-change %s, expected %s, %s or %s", s, uidValidityFail, uidValidityRebackup, uidValiditySkip)
+}
+
+// Returns whether the UIDVALIDITY of a server folder differs from that of the
+// last message in its local backup. Surrogate UIDs assigned by reindex have
+// UIDVALIDITY 0, which matches any.
+func uidValidityChanged(local, remote *ImapFolderMeta) bool {
+	return len(local.Messages) > 0 && local.UidValidity != 0 && local.UidValidity != remote.UidValidity
+}
+
+// Handles a UIDVALIDITY change of a folder as given with -on-uidvalidity-change,
+// logging it. Returns whether to skip the folder, or an error to fail with.
+// The given action describes what rebackup does for the calling command.
+func handleUidValidityChange(name string, local, remote *ImapFolderMeta, action string) (skip bool, err error) {
+	msg := fmt.Sprintf("Folder %s: UIDVALIDITY changed from %d to %d since the local backup", name, local.UidValidity, remote.UidValidity)
+	switch onUidValidityChange {
+	case uidValidityFail:
+		return false, &fatalError{fmt.Errorf("%s, use -on-uidvalidity-change %s or %s to continue", msg, uidValidityRebackup, uidValiditySkip)}
+	case uidValiditySkip:
+		slog.Warn(msg + ", skipping")
+		return true, nil
+	}
+	slog.Warn(msg + ", " + action)
+	return false, nil
+}
+
+// Fetches the Message-IDs of all messages in a server folder
+func fetchMessageIds(c *client.Client, folderName string) (map[string]bool, error) {
+	byUid, err := fetchMessageIdsByUid(c, folderName)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, id := range byUid {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Fetches the Message-IDs of all messages in a server folder by UID,
+// omitting messages without Message-ID
+func fetchMessageIdsByUid(c *client.Client, folderName string) (map[uint32]string, error) {
+	mbox, err := c.Select(folderName, true)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[uint32]string{}
+	if mbox.Messages == 0 {
+		return ids, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, mbox.Messages)
+	messages := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+	}()
+	for msg := range messages {
+		if msg.Envelope != nil && msg.Envelope.MessageId != "" {
+			ids[msg.Uid] = msg.Envelope.MessageId
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Returns the messages of a local folder whose Message-ID is not among the given
+// ones, along with their total size. As UIDs of another UIDVALIDITY cannot be
+// compared, this finds the messages missing on the server. Messages without
+// Message-ID are always returned.
+func filterOutByMessageId(lf StorageBackend, f *ImapFolderMeta, ids map[string]bool) (res []MessageMeta, size uint64, err error) {
+	buf := &bytes.Buffer{}
+	res = []MessageMeta{}
+	for _, mm := range f.Messages {
+		id, err := messageId(lf, mm, buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if id == "" || !ids[id] {
+			res = append(res, mm)
+			size += uint64(mm.Size)
+		}
+	}
+	return res, size, nil
+}
+
+// Returns the messages of a local folder which are missing in the given server
+// folder for restore, and their total size. Handles a UIDVALIDITY change since
+// the backup as given with -on-uidvalidity-change, returning none if skipped.
+func filterRestoreMessages(c *client.Client, lf StorageBackend, local, remote *ImapFolderMeta) ([]MessageMeta, uint64, error) {
+	if len(remote.Messages) > 0 && uidValidityChanged(local, remote) {
+		skip, err := handleUidValidityChange(local.Name, local, remote, "comparing messages by Message-ID")
+		if err != nil || skip {
+			return nil, 0, err
+		}
+	}
+	return filterMissingMessages(c, lf, local, remote)
+}
+
+// Returns the messages of a local folder which are missing in the given server
+// folder, and their total size. Compares them by UID, or by Message-ID if the
+// UIDVALIDITY changed since the backup.
+func filterMissingMessages(c *client.Client, lf StorageBackend, local, remote *ImapFolderMeta) ([]MessageMeta, uint64, error) {
+	if len(remote.Messages) == 0 || !uidValidityChanged(local, remote) {
+		res, size := local.FilterOut(remote)
+		return res, size, nil
+	}
+	ids, err := fetchMessageIds(c, remote.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return filterOutByMessageId(lf, local, ids)
+}
@@ -0,0 +1,113 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"github.com/emersion/go-message/textproto"
+	pb "github.com/schollz/progressbar/v3"
+)
+
+// Checks the local folders, or those given with -r, for consistency between index
+// and messages. Reads every message, checks that its header parses, that it is
+// framed as expected in the mailbox file or has the indexed size, and that it
+// matches its checksum if stored with -checksum. Lists problems
+// by folder, index line and uid, and returns an error if there are any.
+func cmdVerify() error {
+	folderNames, err := GetLocalFolderNames(localStoragePath)
+	if err != nil {
+		return err
+	}
+	folderNames = selectFolders(folderNames)
+
+	bar := pb.NewOptions64(int64(len(folderNames)), pb.OptionSetDescription("Verify"), pb.OptionSetVisibility(showProgress))
+	problems := []string{}
+	totalMsgs := 0
+	buf := &bytes.Buffer{}
+	for _, folderName := range folderNames {
+		bar.Describe("Verify " + folderName)
+		n, p, err := verifyFolder(folderName, buf)
+		if err != nil {
+			slog.Warn("Unable to verify folder", "folder", folderName, "err", err)
+			p = append(p, fmt.Sprintf("%s: %s", folderName, err))
+		}
+		totalMsgs += n
+		problems = append(problems, p...)
+		if err := bar.Add(1); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Verified %d folders with %d messages in %s\n", len(folderNames), totalMsgs, localStoragePath)
+	if len(problems) == 0 {
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("Problems found:")
+	for _, p := range problems {
+		fmt.Printf("|- %s\n", p)
+	}
+	return fmt.Errorf("found %d problems, use -r and -overwrite with backup to download affected folders again", len(problems))
+}
+
+// Checks all messages of a local folder. Returns the number of messages checked and
+// the problems found. Returns an error if the folder or its index cannot be read.
+func verifyFolder(folderName string, buf *bytes.Buffer) (n int, problems []string, err error) {
+	lf, err := OpenStorageReadOnly(localStoragePath, folderName)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer lf.Close()
+	f, err := lf.ReadAllIndex()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i, mm := range f.Messages {
+		if err := verifyMessage(lf, mm, buf); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: line %d uid %d: %s", folderName, i+1, mm.Uid, err))
+		}
+		n++
+	}
+	return n, problems, nil
+}
+
+// Checks a single message of a local folder
+func verifyMessage(lf StorageBackend, mm MessageMeta, buf *bytes.Buffer) error {
+	if err := lf.ReadMessage(mm, buf); err != nil {
+		return fmt.Errorf("unable to read message: %w", err)
+	}
+	if mf, ok := lf.(*LocalFolder); ok {
+		if err := mf.checkFraming(mm); err != nil {
+			return err
+		}
+	} else if buf.Len() != int(mm.Size) {
+		return fmt.Errorf("message has %d bytes, index says %d", buf.Len(), mm.Size)
+	}
+	if mm.Sha256 != "" && messageChecksum(buf.Bytes()) != mm.Sha256 {
+		return fmt.Errorf("checksum mismatch, message was modified or corrupted")
+	}
+	if _, err := textproto.ReadHeader(bufio.NewReader(buf)); err != nil {
+		return fmt.Errorf("unable to parse header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// go-imap-backup (C) 2022 by Markus L. Noga
+// Backup, restore and delete old messages from an IMAP server
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// How long to wait for the server to end IDLE, before the connection is considered lost
+const idleStopTimeout = 30 * time.Second
+
+// Signalled by logUpdates when a server reports new messages in the selected folder
+var mailboxChanged = make(chan struct{}, 1)
+
+// Notifies a waiting watch of a change in the selected folder, without blocking
+func notifyMailboxChanged() {
+	select {
+	case mailboxChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Picks the folder to watch with IDLE among the given folders: the one given with
+// -watch-folder if selected, else the first one
+func watchedFolder(folderNames []string) (string, error) {
+	if len(folderNames) == 0 {
+		return "", &fatalError{fmt.Errorf("no folders selected to watch")}
+	}
+	for _, name := range folderNames {
+		if name == watchFolder {
+			return name, nil
+		}
+	}
+	slog.Warn("Folder is not selected, watching another instead", "folder", watchFolder, "watching", folderNames[0])
+	return folderNames[0], nil
+}
+
+// Backs up the given folders, then keeps waiting in IDLE on the watched folder and
+// backs it up whenever the server reports new messages. All folders are backed up
+// again every -watch-interval, catching new messages in other folders and missed
+// events. Lost connections are reestablished. Returns nil on SIGINT or SIGTERM,
+// and errTimeLimit once -max-duration has passed.
+func cmdWatch(c *client.Client, folderNames []string) (err error) {
+	name, err := watchedFolder(folderNames)
+	if err != nil {
+		return err
+	}
+
+	// Log out of any connection replaced after a drop, the caller owns the original
+	orig := c
+	defer func() {
+		if c != orig {
+			logout(c)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var lastFull time.Time
+	for attempt := 0; ; {
+		if timeLimitReached() {
+			return errTimeLimit
+		}
+
+		// back up all folders when due, else only the watched one
+		names, full := []string{name}, time.Since(lastFull) >= watchInterval
+		if full {
+			names = folderNames
+		}
+		c, err = reconnect(c)
+		if err == nil {
+			err = cmdBackup(c, names)
+		}
+		var ffe *folderFailuresError
+		if errors.As(err, &ffe) {
+			err = nil // listed in the summary, and tried again on the next backup
+		}
+		var stopped bool
+		if err == nil {
+			if full {
+				lastFull = time.Now()
+			}
+			attempt = 0
+			wait := time.Until(lastFull.Add(watchInterval))
+			if !deadline.IsZero() && time.Until(deadline) < wait {
+				wait = time.Until(deadline)
+			}
+			stopped, err = idleUntilChanged(c, name, wait, stop)
+		}
+		if stopped {
+			slog.Info("Stopped watching", "folder", name)
+			return err
+		}
+		if err != nil {
+			if !isRetryable(err) {
+				return err
+			}
+			attempt++
+			lastFull = time.Time{} // back up all folders after reconnecting
+			slog.Warn("Error watching, reconnecting", "folder", name, "err", err)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(retryDelay(retryDelaySeconds, attempt)):
+			}
+		}
+	}
+}
+
+// Selects the given folder and waits in IDLE until the server reports new messages in
+// it, the timeout elapses or stop is signalled. Returns whether stop was signalled.
+// Servers without IDLE are polled with NOOP instead.
+func idleUntilChanged(c *client.Client, name string, timeout time.Duration, stop <-chan os.Signal) (stopped bool, err error) {
+	mbox, err := c.Select(name, true)
+	if err != nil {
+		return false, err
+	}
+	known := mbox.Messages
+
+	if verbose {
+		slog.Info("Watching for new messages", "folder", name)
+	}
+	stopIdle, done := make(chan struct{}), make(chan error, 1)
+	go func() {
+		done <- c.Idle(stopIdle, nil)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	// updates also arrive for messages already known, e.g. on select
+	for changed := false; !changed; {
+		select {
+		case err := <-done:
+			return false, err
+		case <-mailboxChanged:
+			changed = c.Mailbox() != nil && c.Mailbox().Messages > known
+		case <-timer.C:
+			changed = true
+		case <-stop:
+			changed, stopped = true, true
+		}
+	}
+
+	// a dead connection never answers DONE
+	close(stopIdle)
+	select {
+	case err = <-done:
+	case <-time.After(idleStopTimeout):
+		if terr := c.Terminate(); terr != nil {
+			slog.Warn("Error closing connection", "err", terr)
+		}
+		err = fmt.Errorf("no reply to ending IDLE on %s within %s", name, idleStopTimeout)
+	}
+	return stopped, err
+}